@@ -0,0 +1,627 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+	"code.benchapman.ie/boshstemcells/stemcells/tarball"
+	"github.com/gorilla/mux"
+	"golang.org/x/sync/singleflight"
+)
+
+const problemUnknownAdvisory = "https://boshstemcells.com/problems/unknown-advisory"
+
+// advisory is a security advisory, such as a USN, normalised from the USN or
+// OSV format.
+type advisory struct {
+	ID       string
+	Summary  string
+	Aliases  []string
+	Affected []affectedRange
+}
+
+// affectedRange is a range of versions of a binary package in a distro
+// release, such as "ubuntu:22.04", that an advisory affects. An empty
+// introduced version means every version before the end of the range. The
+// range ends before the fixed version or, when OSV only knows the last
+// affected version, after that one; with neither there is no fix.
+type affectedRange struct {
+	Distro       string
+	Package      string
+	Introduced   string
+	Fixed        string
+	LastAffected string
+}
+
+func (a affectedRange) affects(version string) bool {
+	if a.Introduced != "" && a.Introduced != "0" && tarball.CompareVersions(version, a.Introduced) < 0 {
+		return false
+	}
+	switch {
+	case a.Fixed != "":
+		return tarball.CompareVersions(version, a.Fixed) < 0
+	case a.LastAffected != "":
+		return tarball.CompareVersions(version, a.LastAffected) <= 0
+	}
+	return true
+}
+
+// advisoryMatch is an advisory that affects a stemcell. FixedIn is the first
+// later version of the line that it does not affect, if one is known.
+type advisoryMatch struct {
+	ID       string            `json:"id"`
+	Summary  string            `json:"summary,omitempty"`
+	Aliases  []string          `json:"aliases,omitempty"`
+	Packages []affectedPackage `json:"packages"`
+	FixedIn  string            `json:"fixed_in,omitempty"`
+}
+
+type affectedPackage struct {
+	Name      string `json:"name"`
+	Installed string `json:"installed"`
+	Fixed     string `json:"fixed,omitempty"`
+}
+
+// advisoryDatabase loads every .json file in a directory of USN and OSV
+// advisories, reloading them whenever the directory's files change so that
+// they can be refreshed out of band.
+type advisoryDatabase struct {
+	dir string
+
+	mu         sync.Mutex
+	signature  string
+	advisories map[string]advisory
+}
+
+// advisories is the advisory database. It is empty when ADVISORIES_DIR is
+// not set.
+var advisories = &advisoryDatabase{}
+
+func newAdvisoryDatabase(dir string) (*advisoryDatabase, error) {
+	db := &advisoryDatabase{dir: dir}
+	if _, err := db.load(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// load returns the advisories by ID, re-reading the directory if any file
+// has been added, removed or modified. If the files cannot be read the
+// previous advisories stay in use.
+func (db *advisoryDatabase) load() (map[string]advisory, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.dir == "" {
+		return map[string]advisory{}, nil
+	}
+
+	files, err := ioutil.ReadDir(db.dir)
+	if err != nil {
+		return db.advisories, err
+	}
+	signature := ""
+	for _, f := range files {
+		if filepath.Ext(f.Name()) == ".json" {
+			signature += fmt.Sprintf("%s %d %d\n", f.Name(), f.Size(), f.ModTime().UnixNano())
+		}
+	}
+	if db.advisories != nil && signature == db.signature {
+		return db.advisories, nil
+	}
+
+	loaded := map[string]advisory{}
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(db.dir, f.Name()))
+		if err != nil {
+			return db.advisories, err
+		}
+		list, err := parseAdvisories(data)
+		if err != nil {
+			return db.advisories, fmt.Errorf("%s: %s", f.Name(), err)
+		}
+		for _, a := range list {
+			loaded[a.ID] = a
+		}
+	}
+
+	db.advisories, db.signature = loaded, signature
+	return loaded, nil
+}
+
+// get returns the advisories in use, logging rather than failing if changed
+// files cannot be loaded.
+func (db *advisoryDatabase) get() map[string]advisory {
+	list, _ := db.current()
+	return list
+}
+
+// current returns the advisories in use and the signature of the files they
+// were loaded from, which changes whenever they are reloaded.
+func (db *advisoryDatabase) current() (map[string]advisory, string) {
+	list, err := db.load()
+	if err != nil {
+		log.Printf("could not reload advisories, keeping the previous ones: %s", err)
+	}
+	if list == nil {
+		list = map[string]advisory{}
+	}
+	return list, db.signatureNow()
+}
+
+// signatureNow returns the signature of the advisories in use, without
+// checking the directory for changes.
+func (db *advisoryDatabase) signatureNow() string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.signature
+}
+
+// osvAdvisory is an advisory in the OSV format, as published for Ubuntu by
+// https://github.com/canonical/ubuntu-security-notices.
+type osvAdvisory struct {
+	ID       string   `json:"id"`
+	Summary  string   `json:"summary"`
+	Aliases  []string `json:"aliases"`
+	Related  []string `json:"related"`
+	Affected []struct {
+		Package struct {
+			Ecosystem string `json:"ecosystem"`
+			Name      string `json:"name"`
+		} `json:"package"`
+		Ranges []struct {
+			Events []map[string]string `json:"events"`
+		} `json:"ranges"`
+		EcosystemSpecific struct {
+			Binaries []struct {
+				Name string `json:"binary_name"`
+			} `json:"binaries"`
+		} `json:"ecosystem_specific"`
+	} `json:"affected"`
+}
+
+// usnAdvisory is an entry of the Ubuntu Security Notices database.json.
+type usnAdvisory struct {
+	ID       string   `json:"id"`
+	Title    string   `json:"title"`
+	Summary  string   `json:"summary"`
+	CVEs     []string `json:"cves"`
+	Releases map[string]struct {
+		Binaries    map[string]struct{ Version string } `json:"binaries"`
+		AllBinaries map[string]struct{ Version string } `json:"allbinaries"`
+	} `json:"releases"`
+}
+
+// parseAdvisories parses an OSV advisory, a list of them, or a USN database
+// keyed by notice ID.
+func parseAdvisories(data []byte) ([]advisory, error) {
+	var probe interface{}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, err
+	}
+
+	switch v := probe.(type) {
+	case []interface{}:
+		var list []osvAdvisory
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		var result []advisory
+		for _, o := range list {
+			result = append(result, o.advisory())
+		}
+		return result, nil
+	case map[string]interface{}:
+		if _, ok := v["affected"]; ok {
+			var o osvAdvisory
+			if err := json.Unmarshal(data, &o); err != nil {
+				return nil, err
+			}
+			return []advisory{o.advisory()}, nil
+		}
+
+		var db map[string]usnAdvisory
+		if err := json.Unmarshal(data, &db); err != nil {
+			return nil, err
+		}
+		var result []advisory
+		for key, u := range db {
+			if u.ID == "" {
+				u.ID = key
+			}
+			result = append(result, u.advisory())
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("expected an OSV advisory or a USN database")
+}
+
+func (o osvAdvisory) advisory() advisory {
+	a := advisory{ID: o.ID, Summary: o.Summary, Aliases: append(o.Aliases, o.Related...)}
+	for _, affected := range o.Affected {
+		distro := osvDistro(affected.Package.Ecosystem)
+		if distro == "" {
+			continue
+		}
+
+		packages := []string{affected.Package.Name}
+		if binaries := affected.EcosystemSpecific.Binaries; len(binaries) > 0 {
+			packages = nil
+			for _, b := range binaries {
+				packages = append(packages, b.Name)
+			}
+		}
+
+		for _, r := range affected.Ranges {
+			introduced := ""
+			for _, event := range r.Events {
+				if v, ok := event["introduced"]; ok {
+					introduced = v
+				}
+				fixed, isFixed := event["fixed"]
+				lastAffected, isLastAffected := event["last_affected"]
+				if !isFixed && !isLastAffected {
+					continue
+				}
+				for _, p := range packages {
+					a.Affected = append(a.Affected, affectedRange{distro, p, introduced, fixed, lastAffected})
+				}
+				introduced = ""
+			}
+			if introduced != "" {
+				for _, p := range packages {
+					a.Affected = append(a.Affected, affectedRange{distro, p, introduced, "", ""})
+				}
+			}
+		}
+	}
+	return a
+}
+
+// osvDistro turns an OSV ecosystem such as "Ubuntu:22.04:LTS" or
+// "Ubuntu:Pro:16.04:LTS" into a distro release such as "ubuntu:22.04".
+func osvDistro(ecosystem string) string {
+	parts := strings.Split(ecosystem, ":")
+	for _, part := range parts[1:] {
+		if len(part) > 0 && part[0] >= '0' && part[0] <= '9' {
+			return strings.ToLower(parts[0]) + ":" + part
+		}
+	}
+	return ""
+}
+
+func (u usnAdvisory) advisory() advisory {
+	id := u.ID
+	if !strings.HasPrefix(id, "USN-") {
+		id = "USN-" + id
+	}
+
+	a := advisory{ID: id, Summary: u.Title, Aliases: u.CVEs}
+	if a.Summary == "" {
+		a.Summary = u.Summary
+	}
+	for codename, release := range u.Releases {
+		number, ok := ubuntuReleases[codename]
+		if !ok {
+			continue
+		}
+		binaries := release.AllBinaries
+		if len(binaries) == 0 {
+			binaries = release.Binaries
+		}
+		for name, b := range binaries {
+			a.Affected = append(a.Affected, affectedRange{"ubuntu:" + number, name, "", b.Version, ""})
+		}
+	}
+	return a
+}
+
+// affects returns the packages of a stemcell that the advisory affects.
+func (a advisory) affects(d distro, packages []tarball.Package) []affectedPackage {
+	release := d.name + ":" + d.version
+
+	installed := make(map[string]string, len(packages))
+	for _, p := range packages {
+		installed[p.Name] = p.Version
+	}
+
+	var affected []affectedPackage
+	for _, r := range a.Affected {
+		version, ok := installed[r.Package]
+		if r.Distro == release && ok && r.affects(version) {
+			affected = append(affected, affectedPackage{r.Package, version, r.Fixed})
+		}
+	}
+	return affected
+}
+
+// matchAdvisories returns the advisories that affect the packages of a
+// stemcell, by ID.
+func matchAdvisories(db map[string]advisory, d distro, packages []tarball.Package) []advisoryMatch {
+	matches := []advisoryMatch{}
+	for _, a := range db {
+		if affected := a.affects(d, packages); len(affected) > 0 {
+			matches = append(matches, advisoryMatch{ID: a.ID, Summary: a.Summary, Aliases: a.Aliases, Packages: affected})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].ID < matches[j].ID })
+	return matches
+}
+
+// maxPackageLookups is how many package lists are fetched at once.
+const maxPackageLookups = 8
+
+// packagesOf fetches the package lists of versions of a series concurrently.
+// The lists and errors are in the order of the versions.
+func packagesOf(upstream stemcells.Upstream, s stemcells.Series, versions []stemcells.Version) ([][]tarball.Package, []error) {
+	packages := make([][]tarball.Package, len(versions))
+	errs := make([]error, len(versions))
+
+	slots := make(chan struct{}, maxPackageLookups)
+	var wg sync.WaitGroup
+	for i, v := range versions {
+		wg.Add(1)
+		go func(i int, version string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			packages[i], errs[i] = upstream.StemcellPackages(s.Name(), version)
+		}(i, v.Version)
+	}
+	wg.Wait()
+	return packages, errs
+}
+
+// laterVersions returns the versions of a series after version, oldest
+// first.
+func laterVersions(s stemcells.Series, version string) ([]stemcells.Version, error) {
+	versions, err := source.StemcellVersions(s.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	var later []stemcells.Version
+	for i := len(versions) - 1; i >= 0; i-- {
+		if stemcells.CompareVersions(versions[i].Version, version) > 0 {
+			later = append(later, versions[i])
+		}
+	}
+	return later, nil
+}
+
+// maxFreeOfVersions is how many versions free-of resolution looks at, newest
+// first, before settling on the oldest free version it has found.
+const maxFreeOfVersions = 50
+
+// oldestFreeOf returns the oldest version of the series, no newer than
+// version and matching the constraint, from which on no version is affected
+// by the advisory. Package lists are fetched a few at a time, stopping at the
+// first affected version, and versions whose list cannot be fetched are
+// skipped.
+func oldestFreeOf(upstream stemcells.Upstream, s stemcells.Series, version, constraint, id string) (string, error) {
+	a, ok := advisories.get()[id]
+	if !ok {
+		return "", &pathError{problemUnknownAdvisory, fmt.Sprintf("%q is not a known advisory", id)}
+	}
+
+	versions, err := upstream.StemcellVersions(s.Name())
+	if err != nil {
+		return "", err
+	}
+	var candidates []stemcells.Version
+	for _, v := range versions {
+		if version != "" && stemcells.CompareVersions(v.Version, version) > 0 {
+			continue
+		}
+		if stemcells.MatchesConstraint(v.Version, constraint) {
+			candidates = append(candidates, v)
+		}
+	}
+
+	if len(candidates) > maxFreeOfVersions {
+		candidates = candidates[:maxFreeOfVersions]
+	}
+
+	d := parseDistro(lineOperatingSystem(s.Line))
+	free := ""
+walk:
+	for start := 0; start < len(candidates); start += maxPackageLookups {
+		end := start + maxPackageLookups
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+
+		packages, errs := packagesOf(upstream, s, candidates[start:end])
+		for i, v := range candidates[start:end] {
+			if errs[i] != nil {
+				log.Printf("checking %s %s for %s: %s", s.Name(), v.Version, id, errs[i])
+				continue
+			}
+			if len(a.affects(d, packages[i])) > 0 {
+				break walk
+			}
+			free = v.Version
+		}
+	}
+
+	if free == "" {
+		return "", &stemcells.NoVersionError{Name: s.Name(), Detail: fmt.Sprintf("no version free of %s", id)}
+	}
+	return free, nil
+}
+
+// advisoryReport is what is known about the advisories that affect a
+// version, against the advisories with the given signature. FixesPending is
+// set while later versions are being searched for the fixes.
+type advisoryReport struct {
+	signature    string
+	matches      []advisoryMatch
+	fixesPending bool
+}
+
+// maxAdvisoryReports is how many versions' advisory reports are kept.
+const maxAdvisoryReports = 1000
+
+// advisoryReportStore keeps the advisory reports of the versions most
+// recently asked about, searching for fixes in the background since that
+// means looking at the packages of every later version.
+type advisoryReportStore struct {
+	mu       sync.Mutex
+	reports  map[string]advisoryReport
+	order    []string
+	matching singleflight.Group
+}
+
+var advisoryReports = &advisoryReportStore{reports: map[string]advisoryReport{}}
+
+func (r *advisoryReportStore) get(key, signature string) (advisoryReport, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report, ok := r.reports[key]
+	if !ok || report.signature != signature {
+		return advisoryReport{}, false
+	}
+	report.matches = append([]advisoryMatch(nil), report.matches...)
+	return report, true
+}
+
+// put records a report unless one against newer advisories has been
+// recorded meanwhile, forgetting the oldest reports beyond
+// maxAdvisoryReports.
+func (r *advisoryReportStore) put(key string, report advisoryReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.reports[key]
+	if ok && existing.signature != report.signature && existing.signature == advisories.signatureNow() {
+		return
+	}
+	r.reports[key] = report
+	if ok {
+		return
+	}
+
+	r.order = append(r.order, key)
+	for len(r.order) > maxAdvisoryReports {
+		delete(r.reports, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+// lookup returns the advisories that affect a version, matching them against
+// its packages if it has not been asked about before. pending says whether
+// the versions that fix them are still being searched for.
+func (r *advisoryReportStore) lookup(s stemcells.Series, version string) (matches []advisoryMatch, pending bool, err error) {
+	db, signature := advisories.current()
+	key := s.Name() + "/" + version
+	if report, ok := r.get(key, signature); ok {
+		return report.matches, report.fixesPending, nil
+	}
+
+	_, err, _ = r.matching.Do(key+" "+signature, func() (interface{}, error) {
+		if _, ok := r.get(key, signature); ok {
+			return nil, nil
+		}
+		packages, err := source.StemcellPackages(s.Name(), version)
+		if err != nil {
+			return nil, err
+		}
+
+		matches := matchAdvisories(db, parseDistro(lineOperatingSystem(s.Line)), packages)
+		r.put(key, advisoryReport{signature: signature, matches: matches, fixesPending: len(matches) > 0})
+		if len(matches) > 0 {
+			go r.findFixes(db, signature, s, version, matches)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	report, _ := r.get(key, signature)
+	return report.matches, report.fixesPending, nil
+}
+
+// findFixes records the first later version of the series that each match
+// no longer affects.
+func (r *advisoryReportStore) findFixes(db map[string]advisory, signature string, s stemcells.Series, version string, matches []advisoryMatch) {
+	fixed := append([]advisoryMatch(nil), matches...)
+	defer func() {
+		r.put(s.Name()+"/"+version, advisoryReport{signature: signature, matches: fixed})
+	}()
+
+	later, err := laterVersions(s, version)
+	if err != nil {
+		log.Printf("looking for fixes of advisories of %s %s: %s", s.Name(), version, err)
+		return
+	}
+
+	packages, errs := packagesOf(source, s, later)
+	d := parseDistro(lineOperatingSystem(s.Line))
+	for i, v := range later {
+		if errs[i] != nil {
+			log.Printf("looking for fixes of advisories in %s %s: %s", s.Name(), v.Version, errs[i])
+			continue
+		}
+		for n := range fixed {
+			if fixed[n].FixedIn == "" && len(db[fixed[n].ID].affects(d, packages[i])) == 0 {
+				fixed[n].FixedIn = v.Version
+			}
+		}
+	}
+}
+
+// stemcellAdvisories is the advisory report of a version. FixesPending is
+// set while the versions that fix its advisories are still being searched
+// for, in which case asking again later fills in fixed_in.
+type stemcellAdvisories struct {
+	Name         string          `json:"name"`
+	Version      string          `json:"version"`
+	Advisories   []advisoryMatch `json:"advisories"`
+	FixesPending bool            `json:"fixes_pending,omitempty"`
+}
+
+// handleAdvisories lists the advisories that affect a version and the later
+// version of its line that fixes each.
+func handleAdvisories(w http.ResponseWriter, r *http.Request) {
+	s, selector, err := parseVersionPath(mux.Vars(r))
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	version, err := resolveStemcell(r, s, selector)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	res, err := resolver().Describe(s, version, time.Now())
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	matches, pending, err := advisoryReports.lookup(s, res.Version)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stemcellAdvisories{Name: res.Name, Version: res.Version, Advisories: matches, FixesPending: pending})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+	"github.com/gorilla/mux"
+)
+
+const (
+	problemInvalidAlias = "https://boshstemcells.com/problems/invalid-alias"
+	problemAliasExists  = "https://boshstemcells.com/problems/alias-exists"
+)
+
+var aliasNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*(/[a-z0-9][a-z0-9._-]*)*$`)
+
+// aliases holds the team-defined short links served under /p/.
+var aliases *aliasStore
+
+// alias pins a name, such as "team-payments/prod", to an IaaS, line and
+// version using the same names accepted in stemcell paths. An empty line or
+// version means the default line or the latest version.
+type alias struct {
+	Name      string    `json:"name"`
+	IaaS      string    `json:"iaas"`
+	Line      string    `json:"line,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// vars returns the alias as the mux variables of the equivalent stemcell
+// path.
+func (a alias) vars() map[string]string {
+	vars := map[string]string{"iaas": a.IaaS}
+	switch {
+	case a.Line != "" && a.Version != "":
+		vars["versionOrLine"] = a.Line
+		vars["version"] = a.Version
+	case a.Line != "":
+		vars["versionOrLine"] = a.Line
+	case a.Version != "":
+		vars["versionOrLine"] = a.Version
+	}
+	return vars
+}
+
+// validate checks that the alias names a stemcell that could be served.
+func (a alias) validate() error {
+	if !aliasNamePattern.MatchString(a.Name) {
+		return fmt.Errorf("%q is not a valid alias name; use lowercase words separated by slashes, e.g. team-payments/prod", a.Name)
+	}
+
+	req, err := parseStemcellPath(a.vars())
+	if err != nil {
+		return err
+	}
+	if name, _ := stemcells.SplitHypervisor(req.iaas); name == "auto" {
+		return fmt.Errorf("aliases must name a fixed IaaS, not %q", req.iaas)
+	}
+
+	infrastructure, hypervisor, err := lookupIaaS(req.iaas)
+	if err != nil {
+		return err
+	}
+	return stemcells.CheckPublished(stemcells.Series{Infrastructure: infrastructure, Hypervisor: hypervisor, Line: req.line, Raw: req.raw}, stemcells.AnyFlavor)
+}
+
+type aliasStore struct {
+	mu      sync.Mutex
+	file    fileStore
+	aliases map[string]alias
+}
+
+func newAliasStore(file fileStore) (*aliasStore, error) {
+	s := &aliasStore{file: file, aliases: map[string]alias{}}
+	if err := file.load(&s.aliases); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *aliasStore) get(name string) (alias, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.aliases[name]
+	return a, ok
+}
+
+func (s *aliasStore) list() []alias {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]alias, 0, len(s.aliases))
+	for _, a := range s.aliases {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (s *aliasStore) names() []string {
+	var names []string
+	for _, a := range s.list() {
+		names = append(names, a.Name)
+	}
+	return names
+}
+
+// put stores the alias, replacing any with the same name unless replace is
+// false. It reports whether the alias was newly created.
+func (s *aliasStore) put(a alias, replace bool) (created bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, exists := s.aliases[a.Name]
+	if exists && !replace {
+		return false, nil
+	}
+
+	a.UpdatedAt = time.Now().UTC()
+	s.aliases[a.Name] = a
+	if err := s.file.save(s.aliases); err != nil {
+		if exists {
+			s.aliases[a.Name] = previous
+		} else {
+			delete(s.aliases, a.Name)
+		}
+		return false, err
+	}
+	return !exists, nil
+}
+
+func (s *aliasStore) remove(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.aliases[name]
+	if !ok {
+		return false, nil
+	}
+
+	delete(s.aliases, name)
+	if err := s.file.save(s.aliases); err != nil {
+		s.aliases[name] = a
+		return false, err
+	}
+	return true, nil
+}
+
+// handleAlias serves a pinned short link through the normal stemcell path.
+func handleAlias(w http.ResponseWriter, r *http.Request) {
+	a, ok := aliases.get(mux.Vars(r)["alias"])
+	if !ok {
+		writePathError(w, r, &stemcells.UnknownNameError{Kind: "alias", Name: mux.Vars(r)["alias"], Candidates: aliases.names()})
+		return
+	}
+
+	serveStemcellPath(w, r, a.vars())
+}
+
+func handleListAliases(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, aliases.list())
+}
+
+func handleGetAlias(w http.ResponseWriter, r *http.Request) {
+	a, ok := aliases.get(mux.Vars(r)["alias"])
+	if !ok {
+		writeProblem(w, r, problem{Type: problemUnknownName, Status: http.StatusNotFound, Detail: fmt.Sprintf("unknown alias %q", mux.Vars(r)["alias"])})
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+func handleCreateAlias(w http.ResponseWriter, r *http.Request) {
+	var a alias
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		writeProblem(w, r, problem{Type: problemInvalidAlias, Status: http.StatusBadRequest, Detail: err.Error()})
+		return
+	}
+
+	saveAlias(w, r, a, false)
+}
+
+func handlePutAlias(w http.ResponseWriter, r *http.Request) {
+	var a alias
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		writeProblem(w, r, problem{Type: problemInvalidAlias, Status: http.StatusBadRequest, Detail: err.Error()})
+		return
+	}
+	a.Name = mux.Vars(r)["alias"]
+
+	saveAlias(w, r, a, true)
+}
+
+func saveAlias(w http.ResponseWriter, r *http.Request, a alias, replace bool) {
+	if err := a.validate(); err != nil {
+		writeProblem(w, r, problem{Type: problemInvalidAlias, Status: http.StatusUnprocessableEntity, Detail: err.Error()})
+		return
+	}
+
+	created, err := aliases.put(a, replace)
+	if err != nil {
+		writeProblem(w, r, problem{Type: "about:blank", Status: http.StatusInternalServerError, Detail: err.Error()})
+		return
+	}
+	if !created && !replace {
+		writeProblem(w, r, problem{Type: problemAliasExists, Status: http.StatusConflict, Detail: fmt.Sprintf("alias %q already exists; use PUT to update it", a.Name)})
+		return
+	}
+
+	a, _ = aliases.get(a.Name)
+	if created {
+		w.Header().Set("Location", "/api/v1/aliases/"+a.Name)
+		writeJSON(w, http.StatusCreated, a)
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+}
+
+func handleDeleteAlias(w http.ResponseWriter, r *http.Request) {
+	removed, err := aliases.remove(mux.Vars(r)["alias"])
+	if err != nil {
+		writeProblem(w, r, problem{Type: "about:blank", Status: http.StatusInternalServerError, Detail: err.Error()})
+		return
+	}
+	if !removed {
+		writeProblem(w, r, problem{Type: problemUnknownName, Status: http.StatusNotFound, Detail: fmt.Sprintf("unknown alias %q", mux.Vars(r)["alias"])})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const problemUnauthorized = "https://boshstemcells.com/problems/unauthorized"
+
+// adminToken is the bearer token required by the admin API. The admin API is
+// disabled when it is empty.
+var adminToken string
+
+// requireAdmin wraps an admin API handler so that it is only called for
+// requests that carry the admin token.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			writeProblem(w, r, problem{Type: problemUnauthorized, Status: http.StatusForbidden, Detail: "the admin API is disabled; set ADMIN_TOKEN to enable it"})
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="boshstemcells"`)
+			writeProblem(w, r, problem{Type: problemUnauthorized, Status: http.StatusUnauthorized, Detail: "a valid admin bearer token is required"})
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
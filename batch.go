@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+)
+
+const problemInvalidBatch = "https://boshstemcells.com/problems/invalid-batch"
+
+// maxBatchSize is the most queries a batch resolution may have.
+const maxBatchSize = 100
+
+// batchResult is the resolution of one query of a batch, or why it could not
+// be resolved.
+type batchResult struct {
+	Query      stemcells.Query       `json:"query"`
+	Resolution *stemcells.Resolution `json:"resolution,omitempty"`
+	Error      *problem              `json:"error,omitempty"`
+}
+
+// handleResolveBatch resolves a list of queries in one go, sharing the
+// upstream lookups of queries for the same series. The results are in the
+// order of the queries, each with its resolution or a problem.
+func handleResolveBatch(w http.ResponseWriter, r *http.Request) {
+	var queries []stemcells.Query
+	if err := json.NewDecoder(r.Body).Decode(&queries); err != nil {
+		writeProblem(w, r, problem{Type: problemInvalidBatch, Status: http.StatusBadRequest, Detail: err.Error()})
+		return
+	}
+	if len(queries) > maxBatchSize {
+		writeProblem(w, r, problem{Type: problemInvalidBatch, Status: http.StatusRequestEntityTooLarge, Detail: fmt.Sprintf("a batch can have at most %d queries, not %d", maxBatchSize, len(queries))})
+		return
+	}
+
+	upstream := newBatchUpstream(source)
+	results := make([]batchResult, len(queries))
+	var wg sync.WaitGroup
+	for i, q := range queries {
+		wg.Add(1)
+		go func(i int, q stemcells.Query) {
+			defer wg.Done()
+
+			results[i].Query = q
+			res, err := resolveQuery(upstream, q)
+			if err != nil {
+				p, _ := pathProblem(err)
+				p.Title = http.StatusText(p.Status)
+				results[i].Error = &p
+				return
+			}
+			results[i].Resolution = &res
+		}(i, q)
+	}
+	wg.Wait()
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+// resolveQuery resolves a query against upstream as its
+// /{iaas}/{line}/{version}?min-age={min_age} path would be, checking that
+// there is a light stemcell if it asks for one.
+func resolveQuery(upstream stemcells.Upstream, q stemcells.Query) (stemcells.Resolution, error) {
+	line, version := q.Line, q.Version
+	if line == "" {
+		line = defaultLine
+	}
+	if version == "" {
+		version = "latest"
+	}
+
+	s, selector, err := parseVersionPath(map[string]string{"iaas": q.IaaS, "line": line, "version": version})
+	if err != nil {
+		return stemcells.Resolution{}, err
+	}
+
+	if q.Light {
+		if err := stemcells.CheckPublished(s, stemcells.LightFlavor); err != nil {
+			return stemcells.Resolution{}, err
+		}
+	}
+
+	resolved, err := resolveStemcellIn(upstream, s, selector, url.Values{"min-age": {q.MinAge}})
+	if err != nil {
+		return stemcells.Resolution{}, err
+	}
+
+	res, err := resolverFor(upstream).Describe(s, resolved, time.Now())
+	if err != nil {
+		return stemcells.Resolution{}, err
+	}
+
+	if q.Light {
+		if _, _, err := res.Tarball(true); err != nil {
+			return stemcells.Resolution{}, &stemcells.NoVersionError{Name: res.Name, Detail: fmt.Sprintf("no light stemcell of version %s", res.Version)}
+		}
+	}
+	return res, nil
+}
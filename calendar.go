@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+)
+
+// calendarEvent is one lifecycle date of a stemcell line.
+type calendarEvent struct {
+	line    string
+	kind    string
+	summary string
+	date    time.Time
+}
+
+// handleCalendar serves the lifecycle dates of every stemcell line as an
+// iCalendar feed. It can be narrowed with repeated line and iaas query
+// parameters, which take the same names as stemcell paths.
+func handleCalendar(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	wantLines := map[string]bool{}
+	for _, name := range query["line"] {
+		line, ok := stemcells.CanonicalLine(name)
+		if !ok {
+			writePathError(w, r, &stemcells.UnknownNameError{Kind: "stemcell line", Name: name, Candidates: stemcells.LineNames()})
+			return
+		}
+		wantLines[line] = true
+	}
+
+	wantIaaSes := map[string]bool{}
+	for _, name := range query["iaas"] {
+		infrastructure, _, err := lookupIaaS(name)
+		if err != nil {
+			writePathError(w, r, err)
+			return
+		}
+		wantIaaSes[infrastructure] = true
+	}
+
+	var events []calendarEvent
+	for _, l := range stemcells.Lines {
+		if len(wantLines) > 0 && !wantLines[l.Name] {
+			continue
+		}
+		if len(wantIaaSes) > 0 && !publishedForAny(l, wantIaaSes) {
+			continue
+		}
+
+		events = append(events,
+			calendarEvent{l.Name, "ga", fmt.Sprintf("%s stemcells generally available", l.Name), l.Lifecycle.GA},
+			calendarEvent{l.Name, "deprecated", fmt.Sprintf("%s stemcells deprecated", l.Name), l.Lifecycle.Deprecated},
+			calendarEvent{l.Name, "eol", fmt.Sprintf("%s stemcells end of life", l.Name), l.Lifecycle.EOL},
+		)
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(renderCalendar(events, time.Now())))
+}
+
+func publishedForAny(l stemcells.Line, infrastructures map[string]bool) bool {
+	for infrastructure := range l.Published {
+		if infrastructures[infrastructure] {
+			return true
+		}
+	}
+	return false
+}
+
+// renderCalendar formats events as an RFC 5545 calendar of all-day events.
+func renderCalendar(events []calendarEvent, now time.Time) string {
+	var content []string
+	content = append(content,
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//boshstemcells.com//Stemcell lifecycle//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:BOSH stemcell lifecycle",
+	)
+
+	stamp := now.UTC().Format("20060102T150405Z")
+	for _, e := range events {
+		if e.date.IsZero() {
+			continue
+		}
+		content = append(content,
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:%s-%s@boshstemcells.com", e.line, e.kind),
+			"DTSTAMP:"+stamp,
+			"DTSTART;VALUE=DATE:"+e.date.Format("20060102"),
+			"DTEND;VALUE=DATE:"+e.date.AddDate(0, 0, 1).Format("20060102"),
+			"SUMMARY:"+escapeCalendarText(e.summary),
+			"CATEGORIES:"+escapeCalendarText(strings.ToUpper(e.kind)),
+			"TRANSP:TRANSPARENT",
+			"END:VEVENT",
+		)
+	}
+	content = append(content, "END:VCALENDAR")
+
+	var b strings.Builder
+	for _, line := range content {
+		b.WriteString(foldCalendarLine(line))
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+func escapeCalendarText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(text)
+}
+
+// foldCalendarLine splits a content line into 75 octet pieces joined by a
+// line break and a space, as RFC 5545 requires.
+func foldCalendarLine(line string) string {
+	const limit = 75
+
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > limit {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += size
+	}
+	return b.String()
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"sort"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+)
+
+// iaasNames lists every name accepted in the IaaS position, including "auto".
+func iaasNames() []string {
+	names := append([]string{"auto"}, stemcells.IaaSNames()...)
+	sort.Strings(names)
+	return names
+}
+
+// lookupIaaS resolves an IaaS name like stemcells.LookupIaaS, suggesting
+// "auto" as well for unknown names.
+func lookupIaaS(name string) (infrastructure, hypervisor string, err error) {
+	infrastructure, hypervisor, err = stemcells.LookupIaaS(name)
+	if e, ok := err.(*stemcells.UnknownNameError); ok && e.Kind == "IaaS" {
+		e.Candidates = iaasNames()
+	}
+	return infrastructure, hypervisor, err
+}
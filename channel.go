@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+	"github.com/gorilla/mux"
+)
+
+const (
+	problemEmptyChannel     = "https://boshstemcells.com/problems/empty-channel"
+	problemInvalidPromotion = "https://boshstemcells.com/problems/invalid-promotion"
+)
+
+// stableSoakTime is how long a version must have been the candidate before it
+// is promoted to stable.
+var stableSoakTime = 7 * 24 * time.Hour
+
+// channels holds the promotion history of every stemcell line.
+var channels *channelStore
+
+// promotion records a version of a line entering a channel.
+type promotion struct {
+	Line       string    `json:"line"`
+	Version    string    `json:"version"`
+	Channel    string    `json:"channel"`
+	PromotedAt time.Time `json:"promoted_at"`
+}
+
+// emptyChannelError is returned when nothing has been promoted to a channel
+// yet.
+type emptyChannelError struct {
+	line    string
+	channel string
+}
+
+func (e *emptyChannelError) Error() string {
+	return fmt.Sprintf("no %s version has been promoted to %s yet", e.line, e.channel)
+}
+
+type channelStore struct {
+	mu      sync.Mutex
+	file    fileStore
+	history []promotion
+}
+
+func newChannelStore(file fileStore) (*channelStore, error) {
+	s := &channelStore{file: file}
+	if err := file.load(&s.history); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// promote records version entering the candidate channel of line.
+func (s *channelStore) promote(line, version string) (promotion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := promotion{Line: line, Version: version, Channel: stemcells.ChannelCandidate, PromotedAt: time.Now().UTC()}
+	s.history = append(s.history, p)
+	if err := s.file.save(s.history); err != nil {
+		s.history = s.history[:len(s.history)-1]
+		return promotion{}, err
+	}
+	return p, nil
+}
+
+// current returns the version most recently promoted to channel, first
+// recording any stable promotions whose soak time has passed.
+func (s *channelStore) current(line, channel string) (promotion, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.settle(time.Now().UTC()); err != nil {
+		return promotion{}, false, err
+	}
+
+	var latest promotion
+	found := false
+	for _, p := range s.history {
+		if p.Line == line && p.Channel == channel && (!found || !p.PromotedAt.Before(latest.PromotedAt)) {
+			latest, found = p, true
+		}
+	}
+	return latest, found, nil
+}
+
+// lineHistory returns every promotion of line in the order they happened.
+func (s *channelStore) lineHistory(line string) ([]promotion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.settle(time.Now().UTC()); err != nil {
+		return nil, err
+	}
+
+	history := []promotion{}
+	for _, p := range s.history {
+		if p.Line == line {
+			history = append(history, p)
+		}
+	}
+	return history, nil
+}
+
+// settle promotes each candidate to stable once it has been the line's
+// candidate for stableSoakTime without being replaced, stamping the
+// promotion with the moment the soak ended. Callers must hold s.mu.
+func (s *channelStore) settle(now time.Time) error {
+	stable := map[string]bool{}
+	for _, p := range s.history {
+		if p.Channel == stemcells.ChannelStable {
+			stable[p.Line+"/"+p.Version] = true
+		}
+	}
+
+	changed := false
+	for i, p := range s.history {
+		if p.Channel != stemcells.ChannelCandidate || stable[p.Line+"/"+p.Version] {
+			continue
+		}
+
+		soaked := p.PromotedAt.Add(stableSoakTime)
+		if now.Before(soaked) || s.replaced(i, soaked) {
+			continue
+		}
+
+		s.history = append(s.history, promotion{Line: p.Line, Version: p.Version, Channel: stemcells.ChannelStable, PromotedAt: soaked})
+		stable[p.Line+"/"+p.Version] = true
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	return s.file.save(s.history)
+}
+
+// replaced reports whether another candidate of the same line was promoted
+// after the candidate promotion at index i and before the given time.
+func (s *channelStore) replaced(i int, before time.Time) bool {
+	candidate := s.history[i]
+	for _, p := range s.history {
+		if p.Line == candidate.Line && p.Channel == stemcells.ChannelCandidate && p.PromotedAt.After(candidate.PromotedAt) && p.PromotedAt.Before(before) {
+			return true
+		}
+	}
+	return false
+}
+
+// versionExists reports whether any series of the line has the version
+// upstream.
+func versionExists(line, version string) (bool, error) {
+	for _, name := range stemcells.Names() {
+		s, err := stemcells.ParseName(name)
+		if err != nil || s.Line != line {
+			continue
+		}
+
+		versions, err := source.StemcellVersions(name)
+		if err != nil {
+			return false, err
+		}
+		for _, v := range versions {
+			if v.Version == version {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// resolveChannel returns the version of the stemcell series in channel. The
+// edge channel is the newest version upstream published at least minAge ago.
+// Channels are kept per line, so the version promoted may not have been
+// published for the series.
+func resolveChannel(upstream stemcells.Upstream, s stemcells.Series, channel string, minAge time.Duration) (string, error) {
+	if channel == stemcells.ChannelEdge {
+		return newestVersionIn(upstream, s, minAge)
+	}
+
+	p, ok, err := channels.current(s.Line, channel)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", &emptyChannelError{line: s.Line, channel: channel}
+	}
+
+	versions, err := upstream.StemcellVersions(s.Name())
+	if err != nil {
+		return "", err
+	}
+	for _, v := range versions {
+		if v.Version == p.Version {
+			return p.Version, nil
+		}
+	}
+	// Versions hidden by the policy are left to its check, which explains why
+	// they cannot be served.
+	if _, denied := stemcellPolicy.get().deniedVersion(s.Line, p.Version); denied {
+		return p.Version, nil
+	}
+	return "", &stemcells.NoVersionError{Name: s.Name(), Detail: fmt.Sprintf("no version %s, the %s version of %s", p.Version, channel, s.Line)}
+}
+
+type channelsResponse struct {
+	Line      string      `json:"line"`
+	Candidate string      `json:"candidate,omitempty"`
+	Stable    string      `json:"stable,omitempty"`
+	SoakTime  string      `json:"soak_time"`
+	History   []promotion `json:"history"`
+}
+
+func handleGetChannels(w http.ResponseWriter, r *http.Request) {
+	line, ok := channelLine(w, r)
+	if !ok {
+		return
+	}
+
+	history, err := channels.lineHistory(line)
+	if err != nil {
+		writeProblem(w, r, problem{Type: "about:blank", Status: http.StatusInternalServerError, Detail: err.Error()})
+		return
+	}
+
+	response := channelsResponse{Line: line, SoakTime: stableSoakTime.String(), History: history}
+	if p, ok, _ := channels.current(line, stemcells.ChannelCandidate); ok {
+		response.Candidate = p.Version
+	}
+	if p, ok, _ := channels.current(line, stemcells.ChannelStable); ok {
+		response.Stable = p.Version
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func handlePromoteCandidate(w http.ResponseWriter, r *http.Request) {
+	line, ok := channelLine(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeProblem(w, r, problem{Type: problemInvalidPromotion, Status: http.StatusBadRequest, Detail: err.Error()})
+		return
+	}
+	if !stemcells.ValidVersion(body.Version) {
+		writeProblem(w, r, problem{Type: problemInvalidPromotion, Status: http.StatusUnprocessableEntity, Detail: fmt.Sprintf("%q is not a stemcell version", body.Version)})
+		return
+	}
+
+	exists, err := versionExists(line, body.Version)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+	if !exists {
+		writeProblem(w, r, problem{Type: problemInvalidPromotion, Status: http.StatusUnprocessableEntity, Detail: fmt.Sprintf("%s %s has not been published", line, body.Version)})
+		return
+	}
+
+	p, err := channels.promote(line, body.Version)
+	if err != nil {
+		writeProblem(w, r, problem{Type: "about:blank", Status: http.StatusInternalServerError, Detail: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, p)
+}
+
+// channelLine resolves the {line} variable of a channel API route, writing a
+// 404 if it is not a known line.
+func channelLine(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := mux.Vars(r)["line"]
+	line, ok := stemcells.CanonicalLine(name)
+	if !ok {
+		writeProblem(w, r, problem{Type: problemUnknownName, Status: http.StatusNotFound, Detail: fmt.Sprintf("unknown stemcell line %q", name), Suggestions: stemcells.Suggest(name, stemcells.LineNames())})
+		return "", false
+	}
+	return line, true
+}
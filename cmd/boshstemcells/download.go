@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+	"code.benchapman.ie/boshstemcells/stemcells/tarball"
+)
+
+func download(client stemcells.Client, args []string) error {
+	flags := commandFlags("download", "[-light] [-o FILE] IAAS [LINE [VERSION]]")
+	light := flags.Bool("light", false, "download the light stemcell")
+	output := flags.String("o", "", "save to `FILE` instead of the tarball's upstream name")
+	flags.Parse(args)
+	q := parseQuery(flags, flags.Args(), *light)
+
+	res, err := client.Resolve(context.Background(), q)
+	if err != nil {
+		return err
+	}
+	tarballURL, expected, err := res.Tarball(*light)
+	if err != nil {
+		return err
+	}
+
+	dest := *output
+	if dest == "" {
+		u, err := url.Parse(tarballURL)
+		if err != nil {
+			return err
+		}
+		dest = path.Base(u.Path)
+	}
+
+	if actual, err := fileSHA1(dest); err == nil && actual == expected {
+		fmt.Printf("%s %s is already at %s\n", res.Name, res.Version, dest)
+		return nil
+	}
+
+	partial := dest + ".part"
+	if err := fetch(tarballURL, partial); err != nil {
+		return err
+	}
+
+	actual, err := fileSHA1(partial)
+	if err != nil {
+		return err
+	}
+	if expected != "" && actual != expected {
+		os.Remove(partial)
+		return fmt.Errorf("downloaded %s has sha1 %s, expected %s", tarballURL, actual, expected)
+	}
+	if err := os.Rename(partial, dest); err != nil {
+		return err
+	}
+
+	fmt.Printf("saved %s %s to %s\n", res.Name, res.Version, dest)
+	return nil
+}
+
+// fetch downloads url to dest, carrying on from the end of dest if an
+// earlier download was interrupted.
+func fetch(url, dest string) error {
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The earlier download had finished.
+		return f.Close()
+	case http.StatusOK:
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return fmt.Errorf("downloading %s: %s; run the command again to resume", url, err)
+	}
+	return f.Close()
+}
+
+func verify(client stemcells.Client, args []string) error {
+	flags := commandFlags("verify", "TARBALL")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	file := flags.Arg(0)
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	i, err := tarball.Inspect(f)
+	if err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	s, err := stemcells.ParseName(i.Manifest.Name)
+	if err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+
+	res, err := client.Resolve(context.Background(), s.Query(i.Manifest.Version))
+	if err != nil {
+		return err
+	}
+	actual := i.SHA1
+
+	switch {
+	case res.SHA1 != "" && actual == res.SHA1:
+		fmt.Printf("%s is %s %s\n", file, res.Name, res.Version)
+	case res.LightSHA1 != "" && actual == res.LightSHA1:
+		fmt.Printf("%s is light %s %s\n", file, res.Name, res.Version)
+	default:
+		return fmt.Errorf("%s has sha1 %s, which does not match any published tarball of %s %s", file, actual, res.Name, res.Version)
+	}
+	return nil
+}
+
+func fileSHA1(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha1.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
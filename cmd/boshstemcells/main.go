@@ -0,0 +1,211 @@
+// Command boshstemcells resolves BOSH stemcells from the command line, using
+// the same IaaS and line names, channels and constraints as boshstemcells.com:
+//
+//	boshstemcells resolve aws xenial latest
+//	boshstemcells list gcp xenial 97.x
+//	boshstemcells download -light aws xenial stable
+//	boshstemcells verify bosh-stemcell-97.28-aws-xen-hvm-ubuntu-xenial-go_agent.tgz
+//	boshstemcells manifest aws xenial
+//
+// It asks a boshstemcells server, or bosh.io directly with -local.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+)
+
+const usage = `Usage: boshstemcells [options] <command> [arguments]
+
+Commands:
+  resolve [-light] [-json] IAAS [LINE [VERSION]]
+        print the name, version, tarball url and sha1 of a stemcell
+  list [-json] IAAS LINE [CONSTRAINT]
+        list versions, newest first
+  download [-light] [-o FILE] IAAS [LINE [VERSION]]
+        download a stemcell, resuming a partial download, and check its sha1
+  verify TARBALL
+        check a downloaded stemcell against the published sha1
+  manifest [-light] IAAS [LINE [VERSION]]
+        print the stemcells section of a deployment manifest
+
+VERSION is latest by default, and may be a version, a constraint such as
+97.x, a channel such as stable, or a relative version such as latest~1.
+
+Options:
+`
+
+func main() {
+	flags := flag.NewFlagSet("boshstemcells", flag.ExitOnError)
+	server := flags.String("server", serverURL(), "boshstemcells server `URL`; defaults to $BOSHSTEMCELLS_URL")
+	local := flags.Bool("local", false, "resolve against bosh.io directly instead of a server")
+	boshIO := flags.String("bosh-io", stemcells.DefaultBoshIOURL, "bosh.io `URL` used by -local")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var client stemcells.Client = stemcells.NewHTTPClient(*server)
+	if *local {
+		client = stemcells.NewLocalClient(stemcells.NewBoshIO(*boshIO, 0))
+	}
+
+	command, args := flags.Arg(0), flags.Args()[1:]
+	var err error
+	switch command {
+	case "resolve":
+		err = resolve(client, args)
+	case "list":
+		err = list(client, args)
+	case "download":
+		err = download(client, args)
+	case "verify":
+		err = verify(client, args)
+	case "manifest":
+		err = manifest(client, args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", command)
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func serverURL() string {
+	if u := os.Getenv("BOSHSTEMCELLS_URL"); u != "" {
+		return u
+	}
+	return stemcells.DefaultServerURL
+}
+
+// commandFlags returns the flags of a subcommand, whose usage is the
+// subcommand's line of the main usage.
+func commandFlags(name, arguments string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: boshstemcells %s %s\n", name, arguments)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseQuery parses IAAS [LINE [VERSION]] arguments.
+func parseQuery(flags *flag.FlagSet, args []string, light bool) stemcells.Query {
+	if len(args) < 1 || len(args) > 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	q := stemcells.Query{IaaS: args[0], Light: light}
+	if len(args) > 1 {
+		q.Line = args[1]
+	}
+	if len(args) > 2 {
+		q.Version = args[2]
+	}
+	return q
+}
+
+func resolve(client stemcells.Client, args []string) error {
+	flags := commandFlags("resolve", "[-light] [-json] IAAS [LINE [VERSION]]")
+	light := flags.Bool("light", false, "print the light stemcell's tarball")
+	asJSON := flags.Bool("json", false, "print the resolution as JSON")
+	flags.Parse(args)
+	q := parseQuery(flags, flags.Args(), *light)
+
+	res, err := client.Resolve(context.Background(), q)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(res)
+	}
+
+	url, sha1, err := res.Tarball(*light)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "name:\t%s\n", res.Name)
+	fmt.Fprintf(w, "version:\t%s\n", res.Version)
+	fmt.Fprintf(w, "url:\t%s\n", url)
+	fmt.Fprintf(w, "sha1:\t%s\n", sha1)
+	return w.Flush()
+}
+
+func list(client stemcells.Client, args []string) error {
+	flags := commandFlags("list", "[-json] IAAS LINE [CONSTRAINT]")
+	asJSON := flags.Bool("json", false, "print the versions as JSON")
+	flags.Parse(args)
+	if flags.NArg() < 2 || flags.NArg() > 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	versions, err := client.List(context.Background(), flags.Arg(0), flags.Arg(1), flags.Arg(2))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(versions)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, res := range versions {
+		if res.PublishedAt == nil {
+			fmt.Fprintln(w, res.Version)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\n", res.Version, res.PublishedAt.UTC().Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func manifest(client stemcells.Client, args []string) error {
+	flags := commandFlags("manifest", "[-light] IAAS [LINE [VERSION]]")
+	light := flags.Bool("light", false, "upload the light stemcell")
+	flags.Parse(args)
+	q := parseQuery(flags, flags.Args(), *light)
+
+	if !*light {
+		m, err := client.Manifest(context.Background(), q)
+		if err != nil {
+			return err
+		}
+		fmt.Print(m)
+		return nil
+	}
+
+	res, err := client.Resolve(context.Background(), q)
+	if err != nil {
+		return err
+	}
+	res.TarballURL, res.SHA1, err = res.Tarball(true)
+	if err != nil {
+		return err
+	}
+	fmt.Print(res.Manifest())
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
@@ -0,0 +1,29 @@
+// Command check is the check script of the stemcell Concourse resource.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"code.benchapman.ie/boshstemcells/concourse"
+)
+
+func main() {
+	var req concourse.CheckRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		fatal(err)
+	}
+
+	versions, err := concourse.Check(req)
+	if err != nil {
+		fatal(err)
+	}
+
+	json.NewEncoder(os.Stdout).Encode(versions)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,34 @@
+// Command in is the in script of the stemcell Concourse resource.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"code.benchapman.ie/boshstemcells/concourse"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: in DESTINATION")
+		os.Exit(1)
+	}
+
+	var req concourse.InRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		fatal(err)
+	}
+
+	response, err := concourse.In(os.Args[1], req)
+	if err != nil {
+		fatal(err)
+	}
+
+	json.NewEncoder(os.Stdout).Encode(response)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,34 @@
+// Command out is the out script of the stemcell Concourse resource.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"code.benchapman.ie/boshstemcells/concourse"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: out SOURCES")
+		os.Exit(1)
+	}
+
+	var req concourse.OutRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		fatal(err)
+	}
+
+	response, err := concourse.Out(os.Args[1], req)
+	if err != nil {
+		fatal(err)
+	}
+
+	json.NewEncoder(os.Stdout).Encode(response)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
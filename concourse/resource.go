@@ -0,0 +1,363 @@
+// Package concourse implements a Concourse resource type for BOSH stemcells.
+// It resolves IaaSes, lines and versions through a boshstemcells server, so
+// pipelines can use the same short names, channels and constraints as the
+// URLs, e.g.
+//
+//	source:
+//	  iaas: gcp
+//	  line: xenial
+//	  version: stable
+package concourse
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+)
+
+// DefaultURL is the server used when a source does not name one.
+const DefaultURL = stemcells.DefaultServerURL
+
+// apiClient makes requests to the server. downloadClient fetches tarballs,
+// which are large enough to need a much longer timeout.
+var (
+	apiClient      = &http.Client{Timeout: 30 * time.Second}
+	downloadClient = &http.Client{Timeout: 30 * time.Minute}
+)
+
+// Source configures the stemcell series a resource tracks.
+type Source struct {
+	// URL of the boshstemcells server.
+	URL string `json:"url,omitempty"`
+	// IaaS and Line accept the same names as stemcell paths, e.g. "gcp" and
+	// "xenial".
+	IaaS string `json:"iaas"`
+	Line string `json:"line"`
+	// Version selects the versions to track: "latest" (the default), a
+	// constraint such as "97.x" or a channel such as "stable".
+	Version string `json:"version,omitempty"`
+	// Light fetches light stemcells instead of full ones.
+	Light bool `json:"light,omitempty"`
+	// AdminToken is needed to put versions.
+	AdminToken string `json:"admin_token,omitempty"`
+}
+
+// Version is a Concourse version of a stemcell.
+type Version struct {
+	Version string `json:"version"`
+}
+
+// MetadataField is shown in the Concourse UI for a fetched version.
+type MetadataField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// CheckRequest is the input of the check script.
+type CheckRequest struct {
+	Source  Source   `json:"source"`
+	Version *Version `json:"version"`
+}
+
+// InParams configure a get step.
+type InParams struct {
+	// Tarball downloads the stemcell. It defaults to true.
+	Tarball *bool `json:"tarball,omitempty"`
+	// PreserveFilename keeps the tarball's upstream file name instead of
+	// stemcell.tgz.
+	PreserveFilename bool `json:"preserve_filename,omitempty"`
+}
+
+// InRequest is the input of the in script.
+type InRequest struct {
+	Source  Source   `json:"source"`
+	Version Version  `json:"version"`
+	Params  InParams `json:"params"`
+}
+
+// OutParams configure a put step.
+type OutParams struct {
+	// Version is the path of a file holding the version to promote to the
+	// candidate channel, e.g. "stemcell/version".
+	Version string `json:"version"`
+}
+
+// OutRequest is the input of the out script.
+type OutRequest struct {
+	Source Source    `json:"source"`
+	Params OutParams `json:"params"`
+}
+
+// Response is the output of the in and out scripts.
+type Response struct {
+	Version  Version         `json:"version"`
+	Metadata []MetadataField `json:"metadata,omitempty"`
+}
+
+func metadata(res stemcells.Resolution, url, sha1 string) []MetadataField {
+	metadata := []MetadataField{
+		{Name: "name", Value: res.Name},
+		{Name: "url", Value: url},
+		{Name: "sha1", Value: sha1},
+	}
+	if res.PublishedAt != nil {
+		metadata = append(metadata, MetadataField{Name: "published_at", Value: res.PublishedAt.UTC().Format(time.RFC3339)})
+	}
+	return metadata
+}
+
+func (src Source) validate() error {
+	if src.IaaS == "" {
+		return errors.New("source.iaas must be set")
+	}
+	if src.Line == "" {
+		return errors.New("source.line must be set")
+	}
+	return nil
+}
+
+func (src Source) baseURL() string {
+	if src.URL == "" {
+		return DefaultURL
+	}
+	return strings.TrimSuffix(src.URL, "/")
+}
+
+func (src Source) selector() string {
+	if src.Version == "" {
+		return "latest"
+	}
+	return src.Version
+}
+
+// walksVersions reports whether every upstream version matching the selector
+// is a valid version, rather than only the one it resolves to.
+func (src Source) walksVersions() bool {
+	return src.selector() == "latest" || strings.HasSuffix(src.selector(), ".x")
+}
+
+func (src Source) client() *stemcells.HTTPClient {
+	return stemcells.NewHTTPClient(src.baseURL())
+}
+
+// resolve asks the server for the version a selector resolves to.
+func (src Source) resolve(selector string) (stemcells.Resolution, error) {
+	return src.client().Resolve(context.Background(), stemcells.Query{IaaS: src.IaaS, Line: src.Line, Version: selector, Light: src.Light})
+}
+
+// list asks the server for the versions matching the source, newest first.
+func (src Source) list() ([]stemcells.Resolution, error) {
+	constraint := ""
+	if strings.HasSuffix(src.selector(), ".x") {
+		constraint = src.selector()
+	}
+	return src.client().List(context.Background(), src.IaaS, src.Line, constraint)
+}
+
+func do(req *http.Request, v interface{}) error {
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var problem struct {
+			Detail string `json:"detail"`
+		}
+		json.NewDecoder(resp.Body).Decode(&problem)
+		if problem.Detail == "" {
+			problem.Detail = resp.Status
+		}
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL, problem.Detail)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Check returns the versions newer than the requested one, oldest first. For
+// latest and constraints every matching upstream version is returned; for
+// channels and exact versions only the version they currently resolve to.
+func Check(req CheckRequest) ([]Version, error) {
+	src := req.Source
+	if err := src.validate(); err != nil {
+		return nil, err
+	}
+
+	current, err := src.resolve(src.selector())
+	if err != nil {
+		return nil, err
+	}
+	versions := []Version{{current.Version}}
+	if req.Version == nil || req.Version.Version == current.Version || !src.walksVersions() {
+		return versions, nil
+	}
+
+	list, err := src.list()
+	if err != nil {
+		return nil, err
+	}
+
+	newest := -1
+	for i, s := range list {
+		if s.Version == current.Version {
+			newest = i
+		}
+		if s.Version == req.Version.Version && newest >= 0 {
+			versions = nil
+			for j := i; j >= newest; j-- {
+				versions = append(versions, Version{list[j].Version})
+			}
+			break
+		}
+	}
+	return versions, nil
+}
+
+// In writes the version, sha1 and url of a stemcell to dir and, unless the
+// tarball param is false, downloads the tarball there, checking its sha1.
+func In(dir string, req InRequest) (Response, error) {
+	src := req.Source
+	if err := src.validate(); err != nil {
+		return Response{}, err
+	}
+
+	res, err := src.resolve(req.Version.Version)
+	if err != nil {
+		return Response{}, err
+	}
+	tarballURL, sha1, err := res.Tarball(src.Light)
+	if err != nil {
+		return Response{}, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Response{}, err
+	}
+	for name, content := range map[string]string{"version": res.Version, "sha1": sha1, "url": tarballURL} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			return Response{}, err
+		}
+	}
+
+	if req.Params.Tarball == nil || *req.Params.Tarball {
+		name := "stemcell.tgz"
+		if req.Params.PreserveFilename {
+			u, err := url.Parse(tarballURL)
+			if err != nil {
+				return Response{}, err
+			}
+			name = path.Base(u.Path)
+		}
+		if err := download(tarballURL, sha1, filepath.Join(dir, name)); err != nil {
+			return Response{}, err
+		}
+	}
+
+	return Response{Version: Version{res.Version}, Metadata: metadata(res, tarballURL, sha1)}, nil
+}
+
+// download saves url to dest, failing if its sha1 does not match. The tarball
+// is written to a temporary file beside dest and only renamed into place once
+// it has been checked, so a failed download leaves nothing behind.
+func download(url, expected, dest string) (err error) {
+	resp, err := downloadClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	hash := sha1.New()
+	if _, err := io.Copy(io.MultiWriter(f, hash), resp.Body); err != nil {
+		return err
+	}
+
+	if actual := hex.EncodeToString(hash.Sum(nil)); expected != "" && actual != expected {
+		return fmt.Errorf("downloaded %s has sha1 %s, expected %s", url, actual, expected)
+	}
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), dest)
+}
+
+// Out promotes the version in the params' version file, relative to dir, to
+// the line's candidate channel.
+func Out(dir string, req OutRequest) (Response, error) {
+	src := req.Source
+	if err := src.validate(); err != nil {
+		return Response{}, err
+	}
+	if src.AdminToken == "" {
+		return Response{}, errors.New("source.admin_token must be set to promote versions")
+	}
+	if req.Params.Version == "" {
+		return Response{}, errors.New("params.version must name a file holding the version to promote")
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, req.Params.Version))
+	if err != nil {
+		return Response{}, err
+	}
+	version := strings.TrimSpace(string(content))
+
+	body, err := json.Marshal(map[string]string{"version": version})
+	if err != nil {
+		return Response{}, err
+	}
+	r, err := http.NewRequest("POST", src.baseURL()+"/api/v1/channels/"+url.PathEscape(src.Line)+"/candidate", bytes.NewReader(body))
+	if err != nil {
+		return Response{}, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+src.AdminToken)
+
+	var promotion struct {
+		Line       string    `json:"line"`
+		PromotedAt time.Time `json:"promoted_at"`
+	}
+	if err := do(r, &promotion); err != nil {
+		return Response{}, err
+	}
+
+	return Response{
+		Version: Version{version},
+		Metadata: []MetadataField{
+			{Name: "line", Value: promotion.Line},
+			{Name: "channel", Value: "candidate"},
+			{Name: "promoted_at", Value: promotion.PromotedAt.UTC().Format(time.RFC3339)},
+		},
+	}, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+	"code.benchapman.ie/boshstemcells/stemcells/tarball"
+	"github.com/gorilla/mux"
+)
+
+// stemcellDiff is what changed in the packages of a series between two
+// versions.
+type stemcellDiff struct {
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	tarball.Diff
+}
+
+// handleDiff compares the packages of two versions of a series, each of
+// which may be any selector, as text or, to clients that ask for it, JSON.
+func handleDiff(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	s, from, err := parseVersionPath(map[string]string{"iaas": vars["iaas"], "line": vars["line"], "version": vars["from"]})
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+	to, err := stemcells.ParseSelector(vars["to"])
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	fromVersion, fromPackages, err := selectedPackages(r, s, from)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+	toVersion, toPackages, err := selectedPackages(r, s, to)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	d := stemcellDiff{
+		Name: s.Name(),
+		From: fromVersion,
+		To:   toVersion,
+		Diff: tarball.DiffPackages(fromPackages, toPackages),
+	}
+
+	switch negotiateContentType(r, "text/plain", "application/json") {
+	case "application/json":
+		writeJSON(w, http.StatusOK, d)
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(renderDiff(d)))
+	}
+}
+
+// selectedPackages returns the version a selector picks and the packages
+// installed in it, as listed upstream.
+func selectedPackages(r *http.Request, s stemcells.Series, selector stemcells.Selector) (string, []tarball.Package, error) {
+	version, err := resolveStemcell(r, s, selector)
+	if err != nil {
+		return "", nil, err
+	}
+	if version == "" {
+		if version, err = newestVersion(s, 0); err != nil {
+			return "", nil, err
+		}
+	}
+
+	packages, err := source.StemcellPackages(s.Name(), version)
+	if err != nil {
+		return "", nil, err
+	}
+	return version, packages, nil
+}
+
+// renderDiff formats a diff for people, kernel change first.
+func renderDiff(d stemcellDiff) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s -> %s\n", d.Name, d.From, d.To)
+
+	if d.Kernel != nil {
+		fmt.Fprintf(&b, "\nKernel: %s -> %s\n", describePackage(d.Kernel.From), describePackage(d.Kernel.To))
+	}
+	if d.Empty() {
+		b.WriteString("\nNo package changes.\n")
+		return b.String()
+	}
+
+	if len(d.Added) > 0 {
+		fmt.Fprintf(&b, "\nAdded (%d):\n", len(d.Added))
+		for _, p := range d.Added {
+			fmt.Fprintf(&b, "  %s %s\n", p.Name, p.Version)
+		}
+	}
+	if len(d.Removed) > 0 {
+		fmt.Fprintf(&b, "\nRemoved (%d):\n", len(d.Removed))
+		for _, p := range d.Removed {
+			fmt.Fprintf(&b, "  %s %s\n", p.Name, p.Version)
+		}
+	}
+	for _, section := range []struct {
+		title   string
+		changes []tarball.Change
+	}{{"Upgraded", d.Upgraded}, {"Downgraded", d.Downgraded}} {
+		if len(section.changes) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s (%d):\n", section.title, len(section.changes))
+		for _, c := range section.changes {
+			fmt.Fprintf(&b, "  %s %s -> %s\n", c.Name, c.From, c.To)
+		}
+	}
+	return b.String()
+}
+
+func describePackage(p *tarball.Package) string {
+	if p == nil {
+		return "none"
+	}
+	return p.Name + " " + p.Version
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+)
+
+// maxTarballSize is the largest stemcell tarball that will be downloaded or
+// accepted as an upload, 4GiB unless MAX_TARBALL_SIZE is set.
+var maxTarballSize int64 = 4 << 30
+
+var sha1Pattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// downloads fetches the stemcell tarballs that are inspected.
+var downloads *tarballDownloader
+
+// tarballDownloader downloads stemcell tarballs to be read once. Tarballs run
+// to hundreds of megabytes, so each is removed once read rather than kept.
+type tarballDownloader struct {
+	dir        string
+	httpClient *http.Client
+}
+
+// newTarballDownloader downloads into dir, or into the system's temporary
+// directory when dir is empty.
+func newTarballDownloader(dir string) (*tarballDownloader, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &tarballDownloader{
+		dir: dir,
+		// Full stemcells run to hundreds of megabytes.
+		httpClient: &http.Client{Timeout: 30 * time.Minute},
+	}, nil
+}
+
+// tarballKey identifies a tarball by its sha1, or by a hash of its URL when
+// bosh.io does not give a valid sha1.
+func tarballKey(url, sha1 string) string {
+	if sha1Pattern.MatchString(sha1) {
+		return sha1
+	}
+	return "url-" + hashOf(url)
+}
+
+// read downloads the tarball at url and calls fn with it, removing the
+// download afterwards. The download has to match sha1 unless it is empty.
+func (d *tarballDownloader) read(url, sha1 string, fn func(io.Reader) error) error {
+	f, err := d.download(url, sha1)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	return fn(f)
+}
+
+// download fetches the tarball at url into a temporary file, returning it
+// open and positioned at its start.
+func (d *tarballDownloader) download(url, expected string) (*os.File, error) {
+	resp, err := d.httpClient.Get(url)
+	if err != nil {
+		return nil, &tarballError{url, err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &tarballError{url, resp.Status}
+	}
+	if resp.ContentLength > maxTarballSize {
+		return nil, &tarballError{url, fmt.Sprintf("it is larger than %d bytes", maxTarballSize)}
+	}
+
+	f, err := ioutil.TempFile(d.dir, "stemcell")
+	if err != nil {
+		return nil, err
+	}
+	keep := false
+	defer func() {
+		if !keep {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	hash := sha1.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(resp.Body, maxTarballSize+1))
+	if err != nil {
+		return nil, &tarballError{url, err.Error()}
+	}
+	if n > maxTarballSize {
+		return nil, &tarballError{url, fmt.Sprintf("it is larger than %d bytes", maxTarballSize)}
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); expected != "" && actual != expected {
+		return nil, &tarballError{url, fmt.Sprintf("it has sha1 %s, expected %s", actual, expected)}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	keep = true
+	return f, nil
+}
+
+func hashOf(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+)
+
+// directorClient talks to a BOSH director, authenticating as a UAA client.
+type directorClient struct {
+	url          string
+	uaaURL       string
+	clientID     string
+	clientSecret string
+	httpClient   *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// newDirectorClient returns a client of the director at directorURL. The
+// UAA URL is looked up from the director's /info when empty, and caCert, if
+// not empty, is the PEM of the CA that signed the director and UAA
+// certificates.
+func newDirectorClient(directorURL, uaaURL, clientID, clientSecret string, caCert []byte) (*directorClient, error) {
+	// Start from the default transport so that HTTPS_PROXY and friends are
+	// honoured, as they are for every other request the service makes.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(caCert) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("the CA certificate is not PEM encoded")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &directorClient{
+		url:          strings.TrimSuffix(directorURL, "/"),
+		uaaURL:       strings.TrimSuffix(uaaURL, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		httpClient:   &http.Client{Timeout: 30 * time.Second, Transport: transport},
+	}, nil
+}
+
+// directorStemcell is a stemcell uploaded to a director.
+type directorStemcell struct {
+	Name            string `json:"name"`
+	OperatingSystem string `json:"operating_system"`
+	Version         string `json:"version"`
+}
+
+// directorDeployment is a deployment on a director and the stemcells it
+// uses.
+type directorDeployment struct {
+	Name      string `json:"name"`
+	Stemcells []struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"stemcells"`
+}
+
+func (c *directorClient) stemcells() ([]directorStemcell, error) {
+	var list []directorStemcell
+	return list, c.get("/stemcells", &list)
+}
+
+func (c *directorClient) deployments() ([]directorDeployment, error) {
+	var list []directorDeployment
+	return list, c.get("/deployments", &list)
+}
+
+func (c *directorClient) get(path string, v interface{}) error {
+	token, err := c.accessToken()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", c.url+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", req.URL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// accessToken returns a UAA token for the client, getting a new one shortly
+// before the previous one expires.
+func (c *directorClient) accessToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+
+	if c.uaaURL == "" {
+		uaaURL, err := c.lookupUAA()
+		if err != nil {
+			return "", err
+		}
+		c.uaaURL = uaaURL
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequest("POST", c.uaaURL+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(c.clientID, c.clientSecret)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("getting a UAA token: %s returned %s", req.URL, resp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	c.token = token.AccessToken
+	c.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return c.token, nil
+}
+
+// lookupUAA returns the UAA URL that the director's /info advertises.
+func (c *directorClient) lookupUAA() (string, error) {
+	resp, err := c.httpClient.Get(c.url + "/info")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s/info returned %s", c.url, resp.Status)
+	}
+
+	var info struct {
+		UserAuthentication struct {
+			Type    string `json:"type"`
+			Options struct {
+				URL string `json:"url"`
+			} `json:"options"`
+		} `json:"user_authentication"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", err
+	}
+	if info.UserAuthentication.Type != "uaa" || info.UserAuthentication.Options.URL == "" {
+		return "", fmt.Errorf("the director does not use UAA")
+	}
+	return strings.TrimSuffix(info.UserAuthentication.Options.URL, "/"), nil
+}
+
+// deploymentDrift is how far behind the target version a stemcell used by
+// a deployment is. DaysBehind counts from the publication of the first newer
+// version.
+type deploymentDrift struct {
+	Deployment      string `json:"deployment"`
+	Stemcell        string `json:"stemcell"`
+	OperatingSystem string `json:"operating_system,omitempty"`
+	Version         string `json:"version"`
+	Target          string `json:"target,omitempty"`
+	VersionsBehind  int    `json:"versions_behind"`
+	DaysBehind      int    `json:"days_behind"`
+	Error           string `json:"error,omitempty"`
+}
+
+// driftReport compares the stemcells of every deployment on a director with
+// the target versions of their series.
+type driftReport struct {
+	Director    string            `json:"director"`
+	Target      string            `json:"target"`
+	CheckedAt   *time.Time        `json:"checked_at,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	Deployments []deploymentDrift `json:"deployments"`
+}
+
+// driftMonitor periodically compares the deployments on a director with the
+// versions selected by a target, such as latest or stable.
+type driftMonitor struct {
+	director *directorClient
+	target   string
+	interval time.Duration
+
+	mu        sync.Mutex
+	report    driftReport
+	succeeded time.Time
+}
+
+// directorDrift is the running drift monitor, or nil when no director is
+// configured.
+var directorDrift *driftMonitor
+
+func newDriftMonitor(director *directorClient, target string, interval time.Duration) (*driftMonitor, error) {
+	selector, err := stemcells.ParseSelector(target)
+	if err != nil {
+		return nil, err
+	}
+	if selector != (stemcells.Selector{}) && selector.Channel == "" {
+		return nil, fmt.Errorf("%q is not latest or a promotion channel", target)
+	}
+
+	return &driftMonitor{
+		director: director,
+		target:   target,
+		interval: interval,
+		report:   driftReport{Director: director.url, Target: target, Deployments: []deploymentDrift{}},
+	}, nil
+}
+
+// run checks the director immediately and then every interval. It never
+// returns.
+func (m *driftMonitor) run() {
+	for {
+		m.check()
+		time.Sleep(m.interval)
+	}
+}
+
+func (m *driftMonitor) check() {
+	now := time.Now()
+	deployments, err := m.compare(now)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.report.CheckedAt = &now
+	if err != nil {
+		log.Printf("checking director %s for drift: %s", m.director.url, err)
+		m.report.Error = err.Error()
+		return
+	}
+	m.report.Error = ""
+	m.report.Deployments = deployments
+	m.succeeded = now
+}
+
+// compare lists the stemcells of each deployment with how far behind the
+// target they are.
+func (m *driftMonitor) compare(now time.Time) ([]deploymentDrift, error) {
+	uploaded, err := m.director.stemcells()
+	if err != nil {
+		return nil, err
+	}
+	deployments, err := m.director.deployments()
+	if err != nil {
+		return nil, err
+	}
+
+	operatingSystems := map[string]string{}
+	for _, s := range uploaded {
+		operatingSystems[s.Name+"/"+s.Version] = s.OperatingSystem
+	}
+
+	selector, _ := stemcells.ParseSelector(m.target)
+	drift := []deploymentDrift{}
+	for _, d := range deployments {
+		for _, used := range d.Stemcells {
+			entry := deploymentDrift{
+				Deployment:      d.Name,
+				Stemcell:        used.Name,
+				OperatingSystem: operatingSystems[used.Name+"/"+used.Version],
+				Version:         used.Version,
+			}
+			if err := entry.measure(selector, now); err != nil {
+				entry.Error = err.Error()
+			}
+			drift = append(drift, entry)
+		}
+	}
+
+	sort.Slice(drift, func(i, j int) bool {
+		if drift[i].Deployment != drift[j].Deployment {
+			return drift[i].Deployment < drift[j].Deployment
+		}
+		return drift[i].Stemcell < drift[j].Stemcell
+	})
+	return drift, nil
+}
+
+// measure fills in the target version of the stemcell's series and how many
+// versions and days the deployed version is behind it.
+func (d *deploymentDrift) measure(selector stemcells.Selector, now time.Time) error {
+	s, err := stemcells.ParseName(d.Stemcell)
+	if err != nil {
+		return err
+	}
+
+	target, err := resolveVersion(s, selector)
+	if err == nil && target == "" {
+		target, err = newestVersion(s, 0)
+	}
+	if err != nil {
+		return err
+	}
+	d.Target = target
+
+	versions, err := source.StemcellVersions(s.Name())
+	if err != nil {
+		return err
+	}
+
+	var firstNewer stemcells.Version
+	for _, v := range versions {
+		if stemcells.CompareVersions(v.Version, d.Version) > 0 && stemcells.CompareVersions(v.Version, target) <= 0 {
+			d.VersionsBehind++
+			firstNewer = v
+		}
+	}
+	if d.VersionsBehind > 0 && !firstNewer.PublishedAt.IsZero() {
+		d.DaysBehind = int(now.Sub(firstNewer.PublishedAt) / (24 * time.Hour))
+	}
+	return nil
+}
+
+func (m *driftMonitor) snapshot() (driftReport, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.report, m.succeeded
+}
+
+// handleDrift serves the latest drift report. ?versions-behind=N and
+// ?days-behind=N limit it to the deployments at least that far behind. The
+// report names the director's deployments, so it needs the admin token.
+func handleDrift(w http.ResponseWriter, r *http.Request) {
+	if directorDrift == nil {
+		writeProblem(w, r, problem{Type: "about:blank", Status: http.StatusNotFound, Detail: "no BOSH director is configured"})
+		return
+	}
+
+	minVersions, minDays := 0, 0
+	for name, n := range map[string]*int{"versions-behind": &minVersions, "days-behind": &minDays} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			writeProblem(w, r, problem{Type: "about:blank", Status: http.StatusBadRequest, Detail: fmt.Sprintf("%s must be a number, not %q", name, value)})
+			return
+		}
+		*n = parsed
+	}
+
+	report, _ := directorDrift.snapshot()
+	if minVersions > 0 || minDays > 0 {
+		behind := []deploymentDrift{}
+		for _, d := range report.Deployments {
+			if (minVersions > 0 && d.VersionsBehind >= minVersions) || (minDays > 0 && d.DaysBehind >= minDays) {
+				behind = append(behind, d)
+			}
+		}
+		report.Deployments = behind
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleMetrics exposes the drift report as Prometheus gauges, to scrapers
+// that present the admin token as their bearer token.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	if directorDrift != nil {
+		report, succeeded := directorDrift.snapshot()
+		writeDriftMetrics(&b, report, succeeded)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+func writeDriftMetrics(b *bytes.Buffer, report driftReport, succeeded time.Time) {
+	up := 1
+	if report.Error != "" || succeeded.IsZero() {
+		up = 0
+	}
+	director := []string{"director", report.Director}
+
+	writeGauge(b, "boshstemcells_director_up", "Whether the last check of the BOSH director succeeded.")
+	writeSample(b, "boshstemcells_director_up", director, float64(up))
+
+	writeGauge(b, "boshstemcells_director_last_success_timestamp_seconds", "When the BOSH director was last checked successfully.")
+	var last float64
+	if !succeeded.IsZero() {
+		last = float64(succeeded.Unix())
+	}
+	writeSample(b, "boshstemcells_director_last_success_timestamp_seconds", director, last)
+
+	for _, gauge := range []struct {
+		name, help string
+		value      func(deploymentDrift) int
+	}{
+		{"boshstemcells_deployment_stemcell_versions_behind", "How many versions the stemcell of a deployment is behind the target.", func(d deploymentDrift) int { return d.VersionsBehind }},
+		{"boshstemcells_deployment_stemcell_days_behind", "How many days ago a newer version of the stemcell of a deployment was published.", func(d deploymentDrift) int { return d.DaysBehind }},
+	} {
+		writeGauge(b, gauge.name, gauge.help)
+		for _, d := range report.Deployments {
+			if d.Error != "" {
+				continue
+			}
+			labels := make([]string, len(director), len(director)+8)
+			copy(labels, director)
+			labels = append(labels, "deployment", d.Deployment, "stemcell", d.Stemcell, "version", d.Version, "target", d.Target)
+			writeSample(b, gauge.name, labels, float64(gauge.value(d)))
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeGauge(b *bytes.Buffer, name, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+}
+
+// writeSample writes a sample in the Prometheus text format. labels
+// alternates label names and values.
+func writeSample(b *bytes.Buffer, name string, labels []string, value float64) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	fmt.Fprintf(b, "%s{%s} %s\n", name, strings.Join(pairs, ","), strconv.FormatFloat(value, 'f', -1, 64))
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+	"github.com/gorilla/mux"
+)
+
+// maxFeedEntries caps the number of versions in a feed.
+const maxFeedEntries = 50
+
+// feedEntry is a version of a stemcell series that came out while the server
+// was recording.
+type feedEntry struct {
+	stemcell stemcells.Series
+	version  stemcells.Version
+}
+
+func (e feedEntry) id() string {
+	return fmt.Sprintf("tag:boshstemcells.com,2018:%s/%s", e.stemcell.Name(), e.version.Version)
+}
+
+func (e feedEntry) title() string {
+	return fmt.Sprintf("%s %s", e.stemcell.Name(), e.version.Version)
+}
+
+func (e feedEntry) summary() string {
+	summary := fmt.Sprintf("%s version %s was published on %s.", e.stemcell.Name(), e.version.Version, e.version.PublishedAt.UTC().Format(time.RFC1123))
+	tarball := e.version.Regular
+	if tarball == nil {
+		tarball = e.version.Light
+	}
+	if tarball != nil {
+		summary += fmt.Sprintf(" Download: %s sha1: %s", tarball.URL, tarball.SHA1)
+	}
+	return summary
+}
+
+// enclosure returns where to download the version and how large the download
+// is: bosh.io's redirect to the full stemcell, or the light stemcell when
+// there is only that. ok is false when there is neither.
+func (e feedEntry) enclosure() (url string, size int64, ok bool) {
+	if e.version.Regular != nil {
+		return stemcells.BoshIOURL(e.stemcell.Name(), e.version.Version), e.version.Regular.Size, true
+	}
+	if e.version.Light != nil {
+		return e.version.Light.URL, e.version.Light.Size, true
+	}
+	return "", 0, false
+}
+
+// releaseNotesURL links to the notes of a stemcell version.
+func releaseNotesURL(s stemcells.Series, version string) string {
+	return fmt.Sprintf("https://bosh.io/stemcells/%s#v%s", s.Name(), version)
+}
+
+// feedEntries collects the versions of the series in the poller's snapshots
+// that came out after each series was first seen, newest first. The versions
+// listed when a series was first seen are left out, since when they came out
+// is not known.
+func feedEntries(series []stemcells.Series) []feedEntry {
+	var entries []feedEntry
+	for _, s := range series {
+		for _, v := range stemcellPoller.snapshot(s.Name()) {
+			if publishDates.discovered(s.Name(), v.Version) {
+				entries = append(entries, feedEntry{s, v})
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].version.PublishedAt.After(entries[j].version.PublishedAt)
+	})
+	if len(entries) > maxFeedEntries {
+		entries = entries[:maxFeedEntries]
+	}
+	return entries
+}
+
+// publishedSeries lists every published stemcell series.
+func publishedSeries() []stemcells.Series {
+	var series []stemcells.Series
+	for _, name := range stemcells.Names() {
+		s, err := stemcells.ParseName(name)
+		if err == nil {
+			series = append(series, s)
+		}
+	}
+	return series
+}
+
+func handleAllFeed(w http.ResponseWriter, r *http.Request) {
+	writeFeed(w, r, "All BOSH stemcells", "all", publishedSeries())
+}
+
+func handleStemcellFeed(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	infrastructure, hypervisor, err := lookupIaaS(vars["iaas"])
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	line, raw, ok := stemcells.LookupLine(vars["line"])
+	if !ok {
+		writePathError(w, r, &stemcells.UnknownNameError{Kind: "stemcell line", Name: vars["line"], Candidates: stemcells.LineNames()})
+		return
+	}
+
+	s := stemcells.Series{Infrastructure: infrastructure, Hypervisor: hypervisor, Line: line, Raw: raw}
+	if err := stemcells.CheckPublished(s, stemcells.AnyFlavor); err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	writeFeed(w, r, s.Name(), s.Name(), []stemcells.Series{s})
+}
+
+func writeFeed(w http.ResponseWriter, r *http.Request, title, id string, series []stemcells.Series) {
+	if stemcellPoller == nil {
+		writeProblem(w, r, problem{Type: "about:blank", Status: http.StatusNotFound, Detail: "feeds are only served when POLL_INTERVAL is set"})
+		return
+	}
+
+	entries := feedEntries(series)
+	self := "https://boshstemcells.com" + r.URL.Path
+
+	if mux.Vars(r)["format"] == "rss" {
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		w.Write([]byte(xml.Header))
+		xml.NewEncoder(w).Encode(newRSSFeed(title, self, entries))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(newAtomFeed(title, "tag:boshstemcells.com,2018:feeds/"+id, self, entries))
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Summary string     `xml:"summary"`
+	Links   []atomLink `xml:"link"`
+}
+
+func newAtomFeed(title, id, self string, entries []feedEntry) atomFeed {
+	feed := atomFeed{
+		ID:     id,
+		Title:  title,
+		Author: atomAuthor{Name: "BoshStemcells.com"},
+		Links:  []atomLink{{Href: self, Rel: "self", Type: "application/atom+xml"}},
+	}
+
+	updated := time.Time{}
+	for _, e := range entries {
+		if e.version.PublishedAt.After(updated) {
+			updated = e.version.PublishedAt
+		}
+		entry := atomEntry{
+			ID:      e.id(),
+			Title:   e.title(),
+			Updated: e.version.PublishedAt.UTC().Format(time.RFC3339),
+			Summary: e.summary(),
+		}
+		if url, _, ok := e.enclosure(); ok {
+			entry.Links = append(entry.Links, atomLink{Href: url, Rel: "enclosure", Type: "application/x-gzip"})
+		}
+		entry.Links = append(entry.Links, atomLink{Href: releaseNotesURL(e.stemcell, e.version.Version), Rel: "related", Type: "text/html"})
+		feed.Entries = append(feed.Entries, entry)
+	}
+	if updated.IsZero() {
+		updated = time.Unix(0, 0)
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+	return feed
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	Description string        `xml:"description"`
+	GUID        string        `xml:"guid"`
+	PubDate     string        `xml:"pubDate"`
+	Enclosure   *rssEnclosure `xml:"enclosure,omitempty"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+func newRSSFeed(title, self string, entries []feedEntry) rssFeed {
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{Title: title, Link: self, Description: "New versions of " + title},
+	}
+
+	for _, e := range entries {
+		item := rssItem{
+			Title:       e.title(),
+			Link:        releaseNotesURL(e.stemcell, e.version.Version),
+			Description: e.summary(),
+			GUID:        e.id(),
+			PubDate:     e.version.PublishedAt.UTC().Format(time.RFC1123Z),
+		}
+		if url, size, ok := e.enclosure(); ok {
+			item.Enclosure = &rssEnclosure{URL: url, Length: size, Type: "application/x-gzip"}
+		}
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+	return feed
+}
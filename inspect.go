@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+	"code.benchapman.ie/boshstemcells/stemcells/tarball"
+	"github.com/gorilla/mux"
+	"golang.org/x/sync/singleflight"
+)
+
+const problemInvalidTarball = "https://boshstemcells.com/problems/invalid-tarball"
+
+// inspections caches what stemcell tarballs contain, since inspecting one
+// means downloading all of it.
+var inspections *inspectionStore
+
+// tarballError is returned when a stemcell tarball cannot be downloaded or is
+// not what bosh.io says it is.
+type tarballError struct {
+	url    string
+	detail string
+}
+
+func (e *tarballError) Error() string {
+	return fmt.Sprintf("could not inspect %s: %s", e.url, e.detail)
+}
+
+// inspectionStore records the inspection of each tarball by its key, one
+// file per tarball so that recording an inspection does not rewrite the
+// others.
+type inspectionStore struct {
+	mu          sync.Mutex
+	inspections map[string]tarball.Inspection
+	inspecting  singleflight.Group
+}
+
+func newInspectionStore() *inspectionStore {
+	return &inspectionStore{inspections: map[string]tarball.Inspection{}}
+}
+
+func (s *inspectionStore) file(key string) fileStore {
+	return newFileStore(filepath.Join("inspections", key+".json"))
+}
+
+func (s *inspectionStore) get(key string) (tarball.Inspection, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i, ok := s.inspections[key]; ok {
+		return i, true, nil
+	}
+
+	var i *tarball.Inspection
+	if err := s.file(key).load(&i); err != nil || i == nil {
+		return tarball.Inspection{}, false, err
+	}
+	s.inspections[key] = *i
+	return *i, true, nil
+}
+
+func (s *inspectionStore) put(key string, i tarball.Inspection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inspections[key] = i
+	return s.file(key).save(i)
+}
+
+// inspectStemcell downloads and inspects the full or light tarball of a
+// resolved version, unless it has been inspected before. Concurrent requests
+// for the same tarball share one download.
+func inspectStemcell(res stemcells.Resolution, light bool) (tarball.Inspection, error) {
+	url, sha1, err := res.Tarball(light)
+	if err != nil {
+		return tarball.Inspection{}, &stemcells.NoVersionError{Name: res.Name, Detail: fmt.Sprintf("no tarball of version %s to inspect", res.Version)}
+	}
+
+	key := tarballKey(url, sha1)
+	i, err, _ := inspections.inspecting.Do(key, func() (interface{}, error) {
+		if i, ok, err := inspections.get(key); ok || err != nil {
+			return i, err
+		}
+
+		var i tarball.Inspection
+		err := downloads.read(url, sha1, func(r io.Reader) error {
+			var err error
+			if i, err = tarball.Inspect(r); err != nil {
+				return &tarballError{url, err.Error()}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return i, inspections.put(key, i)
+	})
+	if err != nil {
+		return tarball.Inspection{}, err
+	}
+	return i.(tarball.Inspection), nil
+}
+
+// handleInspectStemcell describes the contents of a version's tarball. Add
+// ?light=true to inspect the light stemcell instead.
+func handleInspectStemcell(w http.ResponseWriter, r *http.Request) {
+	s, selector, err := parseVersionPath(mux.Vars(r))
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	version, err := resolveStemcell(r, s, selector)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	res, err := resolver().Describe(s, version, time.Now())
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	i, err := inspectStemcell(res, r.URL.Query().Get("light") == "true")
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, i)
+}
+
+// handleInspectUpload describes the contents of a tarball in the request
+// body.
+func handleInspectUpload(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > maxTarballSize {
+		writeProblem(w, r, problem{Type: problemInvalidTarball, Status: http.StatusRequestEntityTooLarge, Detail: fmt.Sprintf("a tarball can be at most %d bytes", maxTarballSize)})
+		return
+	}
+
+	i, err := tarball.Inspect(http.MaxBytesReader(w, r.Body, maxTarballSize))
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, i)
+}
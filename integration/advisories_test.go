@@ -0,0 +1,273 @@
+package integration_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Advisories", func() {
+	const name = "bosh-google-kvm-ubuntu-jammy-go_agent"
+
+	var (
+		advisoriesDir     string
+		advisoriesSession *gexec.Session
+		advisoriesPort    int
+	)
+
+	type pkg struct{ Name, Installed, Fixed string }
+	type match struct {
+		ID       string
+		Summary  string
+		Aliases  []string
+		Packages []pkg
+		FixedIn  string `json:"fixed_in"`
+	}
+	type report struct {
+		Name         string
+		Version      string
+		Advisories   []match
+		FixesPending bool `json:"fixes_pending"`
+	}
+
+	get := func(path string, v interface{}) *http.Response {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", advisoriesPort, path), nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+
+		if v != nil && resp.StatusCode == http.StatusOK {
+			Expect(json.NewDecoder(resp.Body).Decode(v)).To(Succeed())
+		}
+		return resp
+	}
+
+	BeforeEach(func() {
+		boshIO.setVersions(name, "1.10", "1.12", "1.14", "1.16")
+		boshIO.setPackages(name, "1.10",
+			"curl=7.81.0-1ubuntu1.14",
+			"openssl=3.0.2-0ubuntu1.10",
+		)
+		boshIO.setPackages(name, "1.12",
+			"curl=7.81.0-1ubuntu1.14",
+			"openssl=3.0.2-0ubuntu1.12",
+		)
+		boshIO.setPackages(name, "1.14",
+			"curl=7.81.0-1ubuntu1.15",
+			"openssl=3.0.2-0ubuntu1.12",
+		)
+		boshIO.setPackages(name, "1.16",
+			"curl=7.81.0-1ubuntu1.15",
+			"openssl=3.0.2-0ubuntu1.12",
+		)
+
+		var err error
+		advisoriesDir, err = ioutil.TempDir("", "advisories")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(ioutil.WriteFile(filepath.Join(advisoriesDir, "database.json"), []byte(`{
+  "6000-1": {
+    "id": "6000-1",
+    "title": "OpenSSL vulnerabilities",
+    "cves": ["CVE-2023-0001"],
+    "releases": {
+      "focal": {"binaries": {"openssl": {"version": "1.1.1f-1ubuntu2.20"}}},
+      "jammy": {"binaries": {"openssl": {"version": "3.0.2-0ubuntu1.12"}}}
+    }
+  }
+}`), 0644)).To(Succeed())
+
+		Expect(ioutil.WriteFile(filepath.Join(advisoriesDir, "USN-6100-1.json"), []byte(`{
+  "id": "USN-6100-1",
+  "summary": "curl vulnerability",
+  "aliases": [],
+  "related": ["CVE-2023-0002"],
+  "affected": [{
+    "package": {"ecosystem": "Ubuntu:22.04:LTS", "name": "curl"},
+    "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "7.81.0-1ubuntu1.15"}]}],
+    "ecosystem_specific": {"binaries": [{"binary_name": "curl", "binary_version": "7.81.0-1ubuntu1.15"}]}
+  }, {
+    "package": {"ecosystem": "Ubuntu:24.04:LTS", "name": "curl"},
+    "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "8.5.0-2ubuntu10.2"}]}]
+  }]
+}`), 0644)).To(Succeed())
+
+		Expect(ioutil.WriteFile(filepath.Join(advisoriesDir, "unfixed.json"), []byte(`[{
+  "id": "USN-6200-1",
+  "summary": "OpenSSL regression",
+  "affected": [{
+    "package": {"ecosystem": "Ubuntu:22.04:LTS", "name": "openssl"},
+    "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "3.0.2-0ubuntu1.12"}]}]
+  }]
+}]`), 0644)).To(Succeed())
+
+		advisoriesSession, advisoriesPort = startServer("ADVISORIES_DIR=" + advisoriesDir)
+	})
+
+	AfterEach(func() {
+		advisoriesSession.Kill().Wait()
+		os.RemoveAll(advisoriesDir)
+	})
+
+	It("lists the advisories that affect a version and the versions that fix them", func() {
+		var r report
+		resp := get("/advisories/gcp/jammy/1.10", &r)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(r.Name).To(Equal(name))
+		Expect(r.Version).To(Equal("1.10"))
+
+		Eventually(func() report {
+			r = report{}
+			get("/advisories/gcp/jammy/1.10", &r)
+			return r
+		}).Should(Equal(report{name, "1.10", []match{
+			{"USN-6000-1", "OpenSSL vulnerabilities", []string{"CVE-2023-0001"}, []pkg{{"openssl", "3.0.2-0ubuntu1.10", "3.0.2-0ubuntu1.12"}}, "1.12"},
+			{"USN-6100-1", "curl vulnerability", []string{"CVE-2023-0002"}, []pkg{{"curl", "7.81.0-1ubuntu1.14", "7.81.0-1ubuntu1.15"}}, "1.14"},
+		}, false}))
+	})
+
+	It("leaves out the fix of advisories no later version fixes", func() {
+		var r report
+		Eventually(func() report {
+			r = report{}
+			get("/advisories/gcp/jammy/latest", &r)
+			return r
+		}).Should(Equal(report{name, "1.16", []match{
+			{"USN-6200-1", "OpenSSL regression", nil, []pkg{{"openssl", "3.0.2-0ubuntu1.12", ""}}, ""},
+		}, false}))
+	})
+
+	It("includes advisories in the JSON metadata", func() {
+		var metadata struct {
+			Version    string
+			Advisories *[]match
+		}
+		resp := get("/gcp/jammy/1.12", &metadata)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(metadata.Version).To(Equal("1.12"))
+		Expect(metadata.Advisories).ToNot(BeNil())
+		Expect(*metadata.Advisories).To(HaveLen(2))
+
+		Eventually(func() []match {
+			get("/gcp/jammy/1.12", &metadata)
+			return *metadata.Advisories
+		}).Should(WithTransform(func(matches []match) []string {
+			var ids []string
+			for _, a := range matches {
+				ids = append(ids, a.ID+" "+a.FixedIn)
+			}
+			return ids
+		}, Equal([]string{"USN-6100-1 1.14", "USN-6200-1 "})))
+	})
+
+	It("includes null advisories in the JSON metadata of versions without a package list", func() {
+		boshIO.setVersions(name, "1.10", "1.12", "1.14", "1.16", "1.18")
+		boshIO.setTarball(name, "1.18", false, []byte("full stemcell"))
+
+		var metadata map[string]interface{}
+		resp := get("/gcp/jammy/1.18", &metadata)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(metadata).To(HaveKeyWithValue("advisories", BeNil()))
+	})
+
+	It("skips versions without a package list when picking a version free of an advisory", func() {
+		boshIO.setVersions(name, "1.10", "1.12", "1.13", "1.14", "1.16")
+		boshIO.setTarball(name, "1.13", false, []byte("full stemcell"))
+		for _, v := range []string{"1.10", "1.12", "1.14", "1.16"} {
+			boshIO.setPackages(name, v, "curl=7.81.0-1ubuntu1.15", "openssl=3.0.2-0ubuntu1.12")
+		}
+		boshIO.setPackages(name, "1.10", "curl=7.81.0-1ubuntu1.14", "openssl=3.0.2-0ubuntu1.12")
+
+		var metadata struct{ Version string }
+		resp := get("/gcp/jammy/latest?free-of=USN-6100-1", &metadata)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(metadata.Version).To(Equal("1.12"))
+	})
+
+	It("does not download tarballs to match advisories", func() {
+		var r report
+		Eventually(func() bool {
+			r = report{}
+			get("/advisories/gcp/jammy/1.10", &r)
+			return r.FixesPending
+		}).Should(BeFalse())
+		get("/gcp/jammy/latest?free-of=USN-6100-1", nil)
+
+		for _, version := range []string{"1.10", "1.12", "1.14", "1.16"} {
+			Expect(boshIO.downloadCount("/tarballs/" + name + "-" + version + ".tgz")).To(BeZero())
+		}
+	})
+
+	It("picks the oldest version free of an advisory", func() {
+		var metadata struct{ Version string }
+		resp := get("/gcp/jammy/latest?free-of=USN-6100-1", &metadata)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(metadata.Version).To(Equal("1.14"))
+
+		resp = get("/gcp/jammy/latest?free-of=USN-6000-1", &metadata)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(metadata.Version).To(Equal("1.12"))
+	})
+
+	It("finds no version free of an advisory that affects the newest", func() {
+		resp := get("/gcp/jammy/latest?free-of=USN-6200-1", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("rejects unknown advisories and selectors other than latest", func() {
+		resp := get("/gcp/jammy/latest?free-of=USN-1-1", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+		resp = get("/gcp/jammy/1.10?free-of=USN-6100-1", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+
+	It("picks up advisories refreshed out of band", func() {
+		Expect(ioutil.WriteFile(filepath.Join(advisoriesDir, "USN-6300-1.json"), []byte(`{
+  "id": "USN-6300-1",
+  "summary": "curl regression",
+  "affected": [{
+    "package": {"ecosystem": "Ubuntu:22.04:LTS", "name": "curl"},
+    "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "7.81.0-1ubuntu1.15"}, {"fixed": "7.81.0-1ubuntu1.16"}]}]
+  }]
+}`), 0644)).To(Succeed())
+
+		var r report
+		resp := get("/advisories/gcp/jammy/1.16", &r)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(r.Advisories).To(HaveLen(2))
+		Expect(r.Advisories[1].ID).To(Equal("USN-6300-1"))
+	})
+
+	It("ends ranges at the last affected version", func() {
+		Expect(ioutil.WriteFile(filepath.Join(advisoriesDir, "USN-6400-1.json"), []byte(`{
+  "id": "USN-6400-1",
+  "summary": "curl regression",
+  "affected": [{
+    "package": {"ecosystem": "Ubuntu:22.04:LTS", "name": "curl"},
+    "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"last_affected": "7.81.0-1ubuntu1.14"}]}]
+  }]
+}`), 0644)).To(Succeed())
+
+		var r report
+		Eventually(func() []match {
+			get("/advisories/gcp/jammy/1.12", &r)
+			return r.Advisories
+		}).Should(ContainElement(match{"USN-6400-1", "curl regression", nil, []pkg{{"curl", "7.81.0-1ubuntu1.14", ""}}, "1.14"}))
+
+		get("/advisories/gcp/jammy/1.14", &r)
+		for _, m := range r.Advisories {
+			Expect(m.ID).ToNot(Equal("USN-6400-1"))
+		}
+	})
+})
@@ -0,0 +1,99 @@
+package integration_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Aliases", func() {
+	var (
+		aliasSession *gexec.Session
+		aliasPort    int
+		dataDir      string
+		client       *http.Client
+	)
+
+	request := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", aliasPort, path), strings.NewReader(body))
+		Expect(err).ToNot(HaveOccurred())
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := client.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		return response
+	}
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "aliases")
+		Expect(err).ToNot(HaveOccurred())
+
+		client = &http.Client{
+			CheckRedirect: func(r *http.Request, ra []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		aliasSession, aliasPort = startServer("ADMIN_TOKEN=secret", "DATA_DIR="+dataDir)
+	})
+
+	AfterEach(func() {
+		aliasSession.Kill().Wait()
+		os.RemoveAll(dataDir)
+	})
+
+	It("redirects a pinned alias to its stemcell", func() {
+		response := request("POST", "/api/v1/aliases", "secret", `{"name": "team-payments/prod", "iaas": "aws", "line": "xenial", "version": "97.28"}`)
+		Expect(response.StatusCode).To(Equal(http.StatusCreated))
+		Expect(response.Header.Get("Location")).To(Equal("/api/v1/aliases/team-payments/prod"))
+
+		response = request("GET", "/p/team-payments/prod", "", "")
+		Expect(response.StatusCode).To(Equal(301))
+		Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/bosh-aws-xen-hvm-ubuntu-xenial-go_agent?v=97.28"))
+	})
+
+	It("updates an alias in place and keeps it across restarts", func() {
+		Expect(request("PUT", "/api/v1/aliases/team-payments/prod", "secret", `{"iaas": "aws", "line": "xenial", "version": "97.28"}`).StatusCode).To(Equal(http.StatusCreated))
+		Expect(request("PUT", "/api/v1/aliases/team-payments/prod", "secret", `{"iaas": "gcp", "line": "bionic"}`).StatusCode).To(Equal(http.StatusOK))
+
+		aliasSession.Kill().Wait()
+		aliasSession, aliasPort = startServer("ADMIN_TOKEN=secret", "DATA_DIR="+dataDir)
+
+		response := request("GET", "/p/team-payments/prod", "", "")
+		Expect(response.StatusCode).To(Equal(301))
+		Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/bosh-google-kvm-ubuntu-bionic-go_agent"))
+	})
+
+	It("refuses to create an alias that already exists", func() {
+		Expect(request("POST", "/api/v1/aliases", "secret", `{"name": "dev", "iaas": "aws"}`).StatusCode).To(Equal(http.StatusCreated))
+		Expect(request("POST", "/api/v1/aliases", "secret", `{"name": "dev", "iaas": "gcp"}`).StatusCode).To(Equal(http.StatusConflict))
+	})
+
+	It("requires the admin token to change aliases", func() {
+		Expect(request("POST", "/api/v1/aliases", "", `{"name": "dev", "iaas": "aws"}`).StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(request("PUT", "/api/v1/aliases/dev", "wrong", `{"iaas": "aws"}`).StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(request("DELETE", "/api/v1/aliases/dev", "", "").StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("refuses aliases that could not be served", func() {
+		Expect(request("PUT", "/api/v1/aliases/dev", "secret", `{"iaas": "softlayer", "line": "windows2019"}`).StatusCode).To(Equal(http.StatusUnprocessableEntity))
+		Expect(request("PUT", "/api/v1/aliases/dev", "secret", `{"iaas": "auto"}`).StatusCode).To(Equal(http.StatusUnprocessableEntity))
+		Expect(request("PUT", "/api/v1/aliases/Not%20Valid", "secret", `{"iaas": "aws"}`).StatusCode).To(Equal(http.StatusUnprocessableEntity))
+	})
+
+	It("lists and deletes aliases", func() {
+		Expect(request("PUT", "/api/v1/aliases/dev", "secret", `{"iaas": "aws"}`).StatusCode).To(Equal(http.StatusCreated))
+
+		body, err := ioutil.ReadAll(request("GET", "/api/v1/aliases", "", "").Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(ContainSubstring(`"name":"dev"`))
+
+		Expect(request("DELETE", "/api/v1/aliases/dev", "secret", "").StatusCode).To(Equal(http.StatusNoContent))
+		Expect(request("GET", "/p/dev", "", "").StatusCode).To(Equal(http.StatusNotFound))
+	})
+})
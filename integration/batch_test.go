@@ -0,0 +1,171 @@
+package integration_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Batch resolution", func() {
+	const (
+		aws   = "bosh-aws-xen-hvm-ubuntu-jammy-go_agent"
+		azure = "bosh-azure-hyperv-ubuntu-jammy-go_agent"
+	)
+
+	type query struct {
+		IaaS    string `json:"iaas"`
+		Line    string `json:"line"`
+		Version string `json:"version,omitempty"`
+		MinAge  string `json:"min_age,omitempty"`
+		Light   bool   `json:"light,omitempty"`
+	}
+	type result struct {
+		Query      query
+		Resolution *struct {
+			Name, Version   string
+			LightTarballURL string `json:"light_tarball_url"`
+			LightSHA1       string `json:"light_sha1"`
+		}
+		Error *struct {
+			Type   string
+			Status int
+			Detail string
+		}
+	}
+
+	postTo := func(path, body string) (*http.Response, []result) {
+		resp, err := http.Post(fmt.Sprintf("http://localhost:%d%s", serverPort, path), "application/json", bytes.NewBufferString(body))
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+
+		var results []result
+		if resp.StatusCode == http.StatusOK {
+			Expect(json.NewDecoder(resp.Body).Decode(&results)).To(Succeed())
+		}
+		return resp, results
+	}
+	post := func(body string) (*http.Response, []result) {
+		return postTo("/api/v1/resolve", body)
+	}
+
+	BeforeEach(func() {
+		boshIO.setVersions(aws, "1.30", "1.28", "1.21", "1.20")
+		boshIO.setTarball(aws, "1.30", true, []byte("light 1.30"))
+		boshIO.setVersions(azure, "1.30", "1.29")
+	})
+
+	It("resolves every query in order", func() {
+		resp, results := post(`[
+  {"iaas": "aws", "line": "jammy"},
+  {"iaas": "aws", "line": "jammy", "version": "previous"},
+  {"iaas": "aws", "line": "jammy", "version": "1.x~2"},
+  {"iaas": "aws", "line": "jammy", "version": "latest", "light": true},
+  {"iaas": "azure", "line": "jammy", "version": "1.29"}
+]`)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(results).To(HaveLen(5))
+
+		var versions []string
+		for _, r := range results {
+			Expect(r.Error).To(BeNil())
+			versions = append(versions, r.Resolution.Name+" "+r.Resolution.Version)
+		}
+		Expect(versions).To(Equal([]string{aws + " 1.30", aws + " 1.28", aws + " 1.21", aws + " 1.30", azure + " 1.29"}))
+		Expect(results[1].Query).To(Equal(query{IaaS: "aws", Line: "jammy", Version: "previous"}))
+		Expect(results[3].Resolution.LightSHA1).To(Equal(sha1Of("light 1.30")))
+	})
+
+	It("looks up each series upstream once per batch", func() {
+		awsLookups, azureLookups := boshIO.lookupCount(aws), boshIO.lookupCount(azure)
+
+		var queries []query
+		for _, iaas := range []string{"aws", "azure"} {
+			for _, version := range []string{"latest", "previous", "1.x", "1.30", "edge", "n-1"} {
+				queries = append(queries, query{IaaS: iaas, Line: "jammy", Version: version})
+			}
+		}
+		body, err := json.Marshal(queries)
+		Expect(err).ToNot(HaveOccurred())
+
+		resp, results := post(string(body))
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(results).To(HaveLen(12))
+		for _, r := range results {
+			Expect(r.Error).To(BeNil())
+		}
+
+		Expect(boshIO.lookupCount(aws) - awsLookups).To(Equal(1))
+		Expect(boshIO.lookupCount(azure) - azureLookups).To(Equal(1))
+	})
+
+	It("looks up each series again for the next batch", func() {
+		lookups := boshIO.lookupCount(aws)
+
+		_, results := post(`[{"iaas": "aws", "line": "jammy"}]`)
+		Expect(results[0].Resolution.Version).To(Equal("1.30"))
+
+		boshIO.setVersions(aws, "1.31", "1.30", "1.28")
+		_, results = post(`[{"iaas": "aws", "line": "jammy"}]`)
+		Expect(results[0].Resolution.Version).To(Equal("1.31"))
+		Expect(boshIO.lookupCount(aws) - lookups).To(Equal(2))
+	})
+
+	It("applies each query's own min-age", func() {
+		boshIO.setPublished(aws, "1.30", time.Now().Add(-time.Hour))
+		boshIO.setPublished(aws, "1.28", time.Now().Add(-2*24*time.Hour))
+		boshIO.setPublished(aws, "1.21", time.Now().Add(-10*24*time.Hour))
+		boshIO.setPublished(aws, "1.20", time.Now().Add(-11*24*time.Hour))
+
+		resp, results := postTo("/api/v1/resolve?min-age=30d", `[
+  {"iaas": "aws", "line": "jammy"},
+  {"iaas": "aws", "line": "jammy", "min_age": "1d"},
+  {"iaas": "aws", "line": "jammy", "version": "edge", "min_age": "72h"},
+  {"iaas": "aws", "line": "jammy", "min_age": "30d"},
+  {"iaas": "aws", "line": "jammy", "min_age": "soon"}
+]`)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(results).To(HaveLen(5))
+
+		Expect(results[0].Resolution.Version).To(Equal("1.30"))
+		Expect(results[1].Resolution.Version).To(Equal("1.28"))
+		Expect(results[2].Resolution.Version).To(Equal("1.21"))
+		Expect(results[3].Error.Status).To(Equal(http.StatusNotFound))
+		Expect(results[4].Error.Status).To(Equal(http.StatusBadRequest))
+		Expect(results[1].Query.MinAge).To(Equal("1d"))
+	})
+
+	It("reports a problem for each query that cannot be resolved", func() {
+		resp, results := post(`[
+  {"iaas": "aws", "line": "jammy", "version": "banana"},
+  {"iaas": "aws", "line": "jammy", "version": "2.x"},
+  {"iaas": "aws", "line": "jammy", "version": "1.28", "light": true},
+  {"iaas": "amazon-web-services", "line": "jammy"},
+  {"iaas": "aws", "line": "jammy"},
+  {"iaas": "azure", "line": "jammy", "light": true}
+]`)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(results).To(HaveLen(6))
+
+		Expect(results[0].Error.Status).To(Equal(http.StatusBadRequest))
+		Expect(results[1].Error.Status).To(Equal(http.StatusNotFound))
+		Expect(results[2].Error.Status).To(Equal(http.StatusNotFound))
+		Expect(results[2].Error.Detail).To(Equal(aws + " has no light stemcell of version 1.28"))
+		Expect(results[3].Error.Status).To(Equal(http.StatusNotFound))
+		Expect(results[3].Error.Type).To(Equal("https://boshstemcells.com/problems/unknown-name"))
+		Expect(results[4].Error).To(BeNil())
+		Expect(results[4].Resolution.Version).To(Equal("1.30"))
+		Expect(results[5].Error.Status).To(Equal(http.StatusNotFound))
+		Expect(results[5].Error.Detail).To(Equal("light ubuntu-jammy stemcells are not published for azure; they are only published for aws, gcp"))
+	})
+
+	It("rejects bodies that are not a list of queries", func() {
+		resp, _ := post(`{"iaas": "aws"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+})
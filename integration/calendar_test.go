@@ -0,0 +1,52 @@
+package integration_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Lifecycle calendar", func() {
+	get := func(path string) (*http.Response, string) {
+		response, err := http.Get(fmt.Sprintf("http://localhost:%d%s", serverPort, path))
+		Expect(err).ToNot(HaveOccurred())
+		body, err := ioutil.ReadAll(response.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return response, string(body)
+	}
+
+	It("serves every line's lifecycle dates as iCalendar", func() {
+		response, body := get("/calendar.ics")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(response.Header.Get("Content-Type")).To(HavePrefix("text/calendar"))
+		Expect(body).To(HavePrefix("BEGIN:VCALENDAR\r\nVERSION:2.0\r\n"))
+		Expect(body).To(HaveSuffix("END:VCALENDAR\r\n"))
+		Expect(body).To(ContainSubstring("UID:ubuntu-trusty-eol@boshstemcells.com\r\n"))
+		Expect(body).To(ContainSubstring("DTSTART;VALUE=DATE:20190430\r\nDTEND;VALUE=DATE:20190501\r\nSUMMARY:ubuntu-trusty stemcells end of life\r\n"))
+		Expect(body).To(ContainSubstring("UID:windows2012R2-deprecated@boshstemcells.com"))
+		Expect(strings.Count(body, "BEGIN:VEVENT")).To(Equal(3 * 13))
+	})
+
+	It("filters by line", func() {
+		_, body := get("/calendar.ics?line=trusty&line=windows2012")
+		Expect(strings.Count(body, "BEGIN:VEVENT")).To(Equal(6))
+		Expect(body).ToNot(ContainSubstring("ubuntu-xenial"))
+	})
+
+	It("filters by IaaS", func() {
+		_, body := get("/calendar.ics?iaas=softlayer")
+		Expect(body).To(ContainSubstring("ubuntu-xenial-ga"))
+		Expect(body).ToNot(ContainSubstring("windows"))
+		Expect(body).ToNot(ContainSubstring("centos"))
+	})
+
+	It("suggests lines for unknown filters", func() {
+		response, body := get("/calendar.ics?line=trusy")
+		Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+		Expect(body).To(ContainSubstring("Did you mean trusty?"))
+	})
+})
@@ -0,0 +1,145 @@
+package integration_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Promotion channels", func() {
+	var (
+		channelSession *gexec.Session
+		channelPort    int
+		client         *http.Client
+	)
+
+	location := func(path string) (int, string) {
+		response, err := client.Get(fmt.Sprintf("http://localhost:%d%s", channelPort, path))
+		Expect(err).ToNot(HaveOccurred())
+		return response.StatusCode, response.Header.Get("Location")
+	}
+
+	promote := func(line, version string) *http.Response {
+		req, err := http.NewRequest("POST", fmt.Sprintf("http://localhost:%d/api/v1/channels/%s/candidate", channelPort, line), strings.NewReader(fmt.Sprintf(`{"version": %q}`, version)))
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer secret")
+		response, err := client.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		return response
+	}
+
+	BeforeEach(func() {
+		client = &http.Client{
+			CheckRedirect: func(r *http.Request, ra []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		boshIO.setVersions("bosh-aws-xen-hvm-ubuntu-xenial-go_agent", "97.12", "97.28", "97.3")
+		channelSession, channelPort = startServer("ADMIN_TOKEN=secret", "STABLE_SOAK_TIME=2s")
+	})
+
+	AfterEach(func() {
+		channelSession.Kill().Wait()
+	})
+
+	It("resolves edge to the newest version upstream", func() {
+		status, loc := location("/aws/xenial/edge")
+		Expect(status).To(Equal(301))
+		Expect(loc).To(Equal("https://bosh.io/d/stemcells/bosh-aws-xen-hvm-ubuntu-xenial-go_agent?v=97.28"))
+	})
+
+	It("resolves candidate to the version promoted through the API", func() {
+		status, _ := location("/aws/xenial/candidate")
+		Expect(status).To(Equal(http.StatusNotFound))
+
+		Expect(promote("xenial", "97.12").StatusCode).To(Equal(http.StatusCreated))
+
+		status, loc := location("/aws/xenial/candidate")
+		Expect(status).To(Equal(301))
+		Expect(loc).To(Equal("https://bosh.io/d/stemcells/bosh-aws-xen-hvm-ubuntu-xenial-go_agent?v=97.12"))
+	})
+
+	It("returns 404 when the series has not published the line's candidate", func() {
+		boshIO.setVersions("bosh-google-kvm-ubuntu-xenial-go_agent", "97.12")
+		Expect(promote("xenial", "97.28").StatusCode).To(Equal(http.StatusCreated))
+
+		status, _ := location("/gcp/xenial/candidate")
+		Expect(status).To(Equal(http.StatusNotFound))
+
+		status, loc := location("/aws/xenial/candidate")
+		Expect(status).To(Equal(301))
+		Expect(loc).To(Equal("https://bosh.io/d/stemcells/bosh-aws-xen-hvm-ubuntu-xenial-go_agent?v=97.28"))
+	})
+
+	It("promotes a candidate to stable once it has soaked", func() {
+		Expect(promote("xenial", "97.12").StatusCode).To(Equal(http.StatusCreated))
+
+		status, _ := location("/aws/xenial/stable")
+		Expect(status).To(Equal(http.StatusNotFound))
+
+		Eventually(func() string {
+			_, loc := location("/aws/xenial/stable")
+			return loc
+		}, "5s", "250ms").Should(Equal("https://bosh.io/d/stemcells/bosh-aws-xen-hvm-ubuntu-xenial-go_agent?v=97.12"))
+
+		response, err := client.Get(fmt.Sprintf("http://localhost:%d/api/v1/channels/xenial", channelPort))
+		Expect(err).ToNot(HaveOccurred())
+
+		var channels struct {
+			Candidate string `json:"candidate"`
+			Stable    string `json:"stable"`
+			History   []struct {
+				Channel    string    `json:"channel"`
+				PromotedAt time.Time `json:"promoted_at"`
+			} `json:"history"`
+		}
+		Expect(json.NewDecoder(response.Body).Decode(&channels)).To(Succeed())
+		Expect(channels.Candidate).To(Equal("97.12"))
+		Expect(channels.Stable).To(Equal("97.12"))
+		Expect(channels.History).To(HaveLen(2))
+		Expect(channels.History[1].PromotedAt.Sub(channels.History[0].PromotedAt)).To(Equal(2 * time.Second))
+	})
+
+	It("only promotes the candidate that was current for the whole soak time", func() {
+		Expect(promote("xenial", "97.12").StatusCode).To(Equal(http.StatusCreated))
+		time.Sleep(time.Second)
+		Expect(promote("xenial", "97.28").StatusCode).To(Equal(http.StatusCreated))
+
+		Eventually(func() string {
+			_, loc := location("/aws/xenial/stable")
+			return loc
+		}, "5s", "250ms").Should(Equal("https://bosh.io/d/stemcells/bosh-aws-xen-hvm-ubuntu-xenial-go_agent?v=97.28"))
+
+		response, err := client.Get(fmt.Sprintf("http://localhost:%d/api/v1/channels/xenial", channelPort))
+		Expect(err).ToNot(HaveOccurred())
+
+		var channels struct {
+			History []struct {
+				Version string `json:"version"`
+				Channel string `json:"channel"`
+			} `json:"history"`
+		}
+		Expect(json.NewDecoder(response.Body).Decode(&channels)).To(Succeed())
+		Expect(channels.History).To(HaveLen(3))
+		Expect(channels.History[2].Version).To(Equal("97.28"))
+		Expect(channels.History[2].Channel).To(Equal("stable"))
+	})
+
+	It("refuses to promote versions that have not been published", func() {
+		response := promote("xenial", "97.99")
+		Expect(response.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+
+		status, _ := location("/aws/xenial/candidate")
+		Expect(status).To(Equal(http.StatusNotFound))
+	})
+
+	It("refuses promotions without the admin token", func() {
+		response, err := client.Post(fmt.Sprintf("http://localhost:%d/api/v1/channels/xenial/candidate", channelPort), "application/json", strings.NewReader(`{"version": "97.12"}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+})
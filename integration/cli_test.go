@@ -0,0 +1,151 @@
+package integration_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Command-line tool", func() {
+	const (
+		name = "bosh-vsphere-esxi-ubuntu-jammy-go_agent"
+		gcp  = "bosh-google-kvm-ubuntu-jammy-go_agent"
+	)
+
+	var (
+		dir     string
+		tarball []byte
+	)
+
+	run := func(args ...string) *gexec.Session {
+		cmd := exec.Command(pathToCLI, append([]string{"-server", fmt.Sprintf("http://localhost:%d", serverPort), "-bosh-io", boshIO.server.URL}, args...)...)
+		cmd.Dir = dir
+		s, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(s, "10s").Should(gexec.Exit())
+		return s
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cli")
+		Expect(err).ToNot(HaveOccurred())
+
+		tarball = stemcellTarball(map[string]string{
+			"stemcell.MF": "name: " + name + "\nversion: \"1.12\"\n",
+			"image":       "disk image",
+		})
+		boshIO.setVersions(name, "1.5", "1.10", "1.12", "2.1")
+		boshIO.setTarball(name, "1.12", false, tarball)
+		boshIO.setVersions(gcp, "1.12")
+		boshIO.setTarball(gcp, "1.12", true, []byte("light stemcell"))
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	for _, mode := range [][]string{{}, {"-local"}} {
+		mode := mode
+
+		Context(fmt.Sprintf("with options %v", mode), func() {
+			It("resolves a stemcell", func() {
+				s := run(append(mode, "resolve", "vsphere", "jammy", "1.x")...)
+				Expect(s.ExitCode()).To(Equal(0))
+				Expect(string(s.Out.Contents())).To(Equal(fmt.Sprintf(
+					"name:    %s\nversion: 1.12\nurl:     %s/tarballs/%s-1.12.tgz\nsha1:    %s\n",
+					name, boshIO.server.URL, name, sha1Of(string(tarball)))))
+			})
+
+			It("lists versions", func() {
+				s := run(append(mode, "list", "vsphere", "j", "1.x")...)
+				Expect(s.ExitCode()).To(Equal(0))
+
+				var versions []string
+				for _, line := range strings.Split(strings.TrimSpace(string(s.Out.Contents())), "\n") {
+					versions = append(versions, strings.Fields(line)[0])
+				}
+				Expect(versions).To(Equal([]string{"1.12", "1.10", "1.5"}))
+			})
+
+			It("prints a manifest snippet", func() {
+				s := run(append(mode, "manifest", "-light", "gcp", "jammy", "1.12")...)
+				Expect(s.ExitCode()).To(Equal(0))
+				Expect(string(s.Out.Contents())).To(Equal(fmt.Sprintf(
+					"# bosh upload-stemcell --sha1 %s %s/tarballs/light-%s-1.12.tgz\nstemcells:\n- alias: default\n  os: ubuntu-jammy\n  version: \"1.12\"\n",
+					sha1Of("light stemcell"), boshIO.server.URL, gcp)))
+			})
+
+			It("reports unknown lines", func() {
+				s := run(append(mode, "resolve", "vsphere", "jamy")...)
+				Expect(s.ExitCode()).To(Equal(1))
+				Expect(string(s.Err.Contents())).To(ContainSubstring(`unknown stemcell line "jamy"`))
+			})
+		})
+	}
+
+	Describe("download", func() {
+		It("saves the tarball under its upstream name", func() {
+			s := run("download", "vsphere", "jammy", "1.12")
+			Expect(s.ExitCode()).To(Equal(0))
+			Expect(ioutil.ReadFile(filepath.Join(dir, name+"-1.12.tgz"))).To(Equal(tarball))
+		})
+
+		It("resumes a partial download", func() {
+			Expect(ioutil.WriteFile(filepath.Join(dir, "stemcell.tgz.part"), tarball[:10], 0644)).To(Succeed())
+
+			s := run("download", "-o", "stemcell.tgz", "vsphere", "jammy", "1.12")
+			Expect(s.ExitCode()).To(Equal(0))
+			Expect(ioutil.ReadFile(filepath.Join(dir, "stemcell.tgz"))).To(Equal(tarball))
+			Expect(filepath.Join(dir, "stemcell.tgz.part")).ToNot(BeAnExistingFile())
+		})
+
+		It("fails when the sha1 does not match", func() {
+			boshIO.mu.Lock()
+			boshIO.tarballs["/tarballs/light-"+gcp+"-1.12.tgz"] = []byte("tampered stemcell")
+			boshIO.mu.Unlock()
+
+			s := run("download", "-light", "gcp", "jammy", "1.12")
+			Expect(s.ExitCode()).To(Equal(1))
+			Expect(string(s.Err.Contents())).To(ContainSubstring("expected " + sha1Of("light stemcell")))
+			Expect(filepath.Join(dir, "light-"+gcp+"-1.12.tgz")).ToNot(BeAnExistingFile())
+		})
+	})
+
+	Describe("verify", func() {
+		It("identifies a published tarball", func() {
+			Expect(ioutil.WriteFile(filepath.Join(dir, "stemcell.tgz"), tarball, 0644)).To(Succeed())
+
+			s := run("verify", "stemcell.tgz")
+			Expect(s.ExitCode()).To(Equal(0))
+			Expect(string(s.Out.Contents())).To(Equal("stemcell.tgz is " + name + " 1.12\n"))
+		})
+
+		It("fails for a tarball that does not match", func() {
+			modified := stemcellTarball(map[string]string{
+				"stemcell.MF": "name: " + name + "\nversion: \"1.12\"\n",
+				"image":       "modified disk image",
+			})
+			Expect(ioutil.WriteFile(filepath.Join(dir, "stemcell.tgz"), modified, 0644)).To(Succeed())
+
+			s := run("verify", "stemcell.tgz")
+			Expect(s.ExitCode()).To(Equal(1))
+			Expect(string(s.Err.Contents())).To(ContainSubstring("does not match any published tarball of " + name + " 1.12"))
+		})
+
+		It("fails for files that are not stemcells", func() {
+			Expect(ioutil.WriteFile(filepath.Join(dir, "stemcell.tgz"), []byte("not a tarball"), 0644)).To(Succeed())
+
+			s := run("verify", "stemcell.tgz")
+			Expect(s.ExitCode()).To(Equal(1))
+			Expect(string(s.Err.Contents())).To(ContainSubstring("stemcell.tgz: not a stemcell tarball"))
+		})
+	})
+})
@@ -0,0 +1,183 @@
+package integration_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+)
+
+var _ = Describe("Go client", func() {
+	const (
+		name = "bosh-vsphere-esxi-ubuntu-jammy-go_agent"
+		gcp  = "bosh-google-kvm-ubuntu-jammy-go_agent"
+	)
+
+	BeforeEach(func() {
+		boshIO.setVersions(name, "1.5", "1.10", "1.12", "2.1")
+		boshIO.setTarball(name, "1.12", false, []byte("full stemcell"))
+		boshIO.setTarball(name, "1.12", true, []byte("light stemcell"))
+		boshIO.setVersions("bosh-vsphere-esxi-ubuntu-noble-go_agent", "1.28", "1.20")
+		boshIO.setVersions(gcp, "1.12")
+		boshIO.setTarball(gcp, "1.12", false, []byte("full gcp stemcell"))
+		boshIO.setTarball(gcp, "1.12", true, []byte("light gcp stemcell"))
+	})
+
+	clients := map[string]func() stemcells.Client{
+		"HTTP": func() stemcells.Client {
+			return stemcells.NewHTTPClient(fmt.Sprintf("http://localhost:%d", serverPort))
+		},
+		"local": func() stemcells.Client {
+			return stemcells.NewLocalClient(stemcells.NewBoshIO(boshIO.server.URL, 0))
+		},
+	}
+
+	for kind, newClient := range clients {
+		newClient := newClient
+
+		Context("with the "+kind+" client", func() {
+			var client stemcells.Client
+
+			BeforeEach(func() {
+				client = newClient()
+			})
+
+			It("resolves a query", func() {
+				res, err := client.Resolve(context.Background(), stemcells.Query{IaaS: "vsphere", Line: "jammy", Version: "1.x"})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.Name).To(Equal(name))
+				Expect(res.Version).To(Equal("1.12"))
+				Expect(res.TarballURL).To(Equal(boshIO.server.URL + "/tarballs/" + name + "-1.12.tgz"))
+				Expect(res.LightTarballURL).To(Equal(boshIO.server.URL + "/tarballs/light-" + name + "-1.12.tgz"))
+			})
+
+			It("applies a query's min-age", func() {
+				boshIO.setPublished(name, "2.1", time.Now().Add(-time.Hour))
+				boshIO.setPublished(name, "1.12", time.Now().Add(-2*24*time.Hour))
+
+				res, err := client.Resolve(context.Background(), stemcells.Query{IaaS: "vsphere", Line: "jammy", MinAge: "1d"})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.Version).To(Equal("1.12"))
+			})
+
+			It("lists versions matching a constraint", func() {
+				list, err := client.List(context.Background(), "vsphere", "jammy", "1.x")
+				Expect(err).ToNot(HaveOccurred())
+
+				var versions []string
+				for _, res := range list {
+					versions = append(versions, res.Version)
+				}
+				Expect(versions).To(Equal([]string{"1.12", "1.10", "1.5"}))
+			})
+
+			It("returns checksums of full and light stemcells", func() {
+				sha1, err := client.Checksum(context.Background(), stemcells.Query{IaaS: "gcp", Line: "jammy", Version: "1.12"})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(sha1).To(Equal(sha1Of("full gcp stemcell")))
+
+				sha1, err = client.Checksum(context.Background(), stemcells.Query{IaaS: "gcp", Line: "jammy", Version: "1.12", Light: true})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(sha1).To(Equal(sha1Of("light gcp stemcell")))
+			})
+
+			It("returns a manifest snippet", func() {
+				manifest, err := client.Manifest(context.Background(), stemcells.Query{IaaS: "vsphere", Line: "jammy", Version: "1.12"})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(manifest).To(Equal(fmt.Sprintf(
+					"# bosh upload-stemcell --sha1 %s %s/tarballs/%s-1.12.tgz\nstemcells:\n- alias: default\n  os: ubuntu-jammy\n  version: \"1.12\"\n",
+					sha1Of("full stemcell"), boshIO.server.URL, name)))
+			})
+
+			It("resolves the default line when a query does not name one", func() {
+				res, err := client.Resolve(context.Background(), stemcells.Query{IaaS: "vsphere"})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.Name).To(Equal("bosh-vsphere-esxi-ubuntu-noble-go_agent"))
+				Expect(res.Version).To(Equal("1.28"))
+			})
+
+			It("reports unknown lines", func() {
+				_, err := client.Resolve(context.Background(), stemcells.Query{IaaS: "vsphere", Line: "jamy"})
+				Expect(err).To(MatchError(ContainSubstring(`unknown stemcell line "jamy"`)))
+			})
+		})
+	}
+
+	Describe("the local client", func() {
+		It("takes undated versions to be old enough for latest and constraints alike", func() {
+			boshIO.setPublished(name, "2.1", time.Now().Add(-time.Hour))
+			client := stemcells.NewLocalClient(stemcells.NewBoshIO(boshIO.server.URL, 0))
+
+			for _, version := range []string{"latest", "1.x"} {
+				res, err := client.Resolve(context.Background(), stemcells.Query{IaaS: "vsphere", Line: "jammy", Version: version, MinAge: "72h"})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res.Version).To(Equal("1.12"), version)
+			}
+		})
+
+		It("refuses light queries for IaaSes without light stemcells", func() {
+			client := stemcells.NewLocalClient(stemcells.NewBoshIO(boshIO.server.URL, 0))
+
+			_, err := client.Resolve(context.Background(), stemcells.Query{IaaS: "vsphere", Line: "jammy", Light: true})
+			Expect(err).To(BeAssignableToTypeOf(&stemcells.UnsupportedCombinationError{}))
+			Expect(err.Error()).To(Equal("light ubuntu-jammy stemcells are not published for vsphere; they are only published for aws, gcp"))
+		})
+	})
+
+	Describe("the HTTP client", func() {
+		It("retries server errors", func() {
+			var mu sync.Mutex
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				requests++
+				if requests < 3 {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				http.Redirect(w, r, fmt.Sprintf("http://localhost:%d%s", serverPort, r.URL.Path), http.StatusTemporaryRedirect)
+			}))
+			defer server.Close()
+
+			client := stemcells.NewHTTPClient(server.URL)
+			client.Backoff = time.Millisecond
+			res, err := client.Resolve(context.Background(), stemcells.Query{IaaS: "vsphere", Line: "jammy"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Version).To(Equal("2.1"))
+			Expect(requests).To(Equal(3))
+		})
+
+		It("returns problem details as API errors", func() {
+			client := stemcells.NewHTTPClient(fmt.Sprintf("http://localhost:%d", serverPort))
+			_, err := client.Resolve(context.Background(), stemcells.Query{IaaS: "vsphere", Line: "jamy"})
+
+			apiErr, ok := err.(*stemcells.APIError)
+			Expect(ok).To(BeTrue())
+			Expect(apiErr.Status).To(Equal(http.StatusNotFound))
+			Expect(apiErr.Type).To(Equal("https://boshstemcells.com/problems/unknown-name"))
+		})
+
+		It("stops retrying when the context is done", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			client := stemcells.NewHTTPClient(server.URL)
+			client.Backoff = time.Hour
+			_, err := client.Resolve(ctx, stemcells.Query{IaaS: "vsphere", Line: "jammy"})
+			Expect(err).To(Equal(context.DeadlineExceeded))
+		})
+	})
+})
@@ -0,0 +1,184 @@
+package integration_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Concourse resource", func() {
+	const name = "bosh-vsphere-esxi-ubuntu-jammy-go_agent"
+
+	var dir string
+
+	run := func(bin string, input interface{}, args ...string) *gexec.Session {
+		stdin, err := json.Marshal(input)
+		Expect(err).ToNot(HaveOccurred())
+
+		cmd := exec.Command(bin, args...)
+		cmd.Stdin = strings.NewReader(string(stdin))
+		s, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(s, "10s").Should(gexec.Exit())
+		return s
+	}
+
+	source := func(version string) map[string]interface{} {
+		return map[string]interface{}{
+			"url":     fmt.Sprintf("http://localhost:%d", serverPort),
+			"iaas":    "vsphere",
+			"line":    "jammy",
+			"version": version,
+		}
+	}
+
+	check := func(source map[string]interface{}, version string) []string {
+		input := map[string]interface{}{"source": source}
+		if version != "" {
+			input["version"] = map[string]string{"version": version}
+		}
+		s := run(pathToCheck, input)
+		Expect(s.ExitCode()).To(Equal(0))
+
+		var versions []struct{ Version string }
+		Expect(json.Unmarshal(s.Out.Contents(), &versions)).To(Succeed())
+		var list []string
+		for _, v := range versions {
+			list = append(list, v.Version)
+		}
+		return list
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "concourse")
+		Expect(err).ToNot(HaveOccurred())
+
+		boshIO.setVersions(name, "1.5", "1.10", "1.12", "2.1")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Describe("check", func() {
+		It("emits the latest version when there is no current version", func() {
+			Expect(check(source(""), "")).To(Equal([]string{"2.1"}))
+		})
+
+		It("emits every version since the current one", func() {
+			Expect(check(source("latest"), "1.10")).To(Equal([]string{"1.10", "1.12", "2.1"}))
+			Expect(check(source("latest"), "2.1")).To(Equal([]string{"2.1"}))
+		})
+
+		It("only emits versions matching a constraint", func() {
+			Expect(check(source("1.x"), "")).To(Equal([]string{"1.12"}))
+			Expect(check(source("1.x"), "1.5")).To(Equal([]string{"1.5", "1.10", "1.12"}))
+		})
+
+		It("emits the version an exact selector names", func() {
+			Expect(check(source("1.10"), "1.5")).To(Equal([]string{"1.10"}))
+		})
+
+		It("fails for unknown lines", func() {
+			src := source("")
+			src["line"] = "jamy"
+			s := run(pathToCheck, map[string]interface{}{"source": src})
+			Expect(s.ExitCode()).To(Equal(1))
+			Expect(string(s.Err.Contents())).To(ContainSubstring(`unknown stemcell line "jamy"`))
+		})
+	})
+
+	Describe("in", func() {
+		It("downloads the tarball and writes its version, sha1 and url", func() {
+			boshIO.setTarball(name, "1.12", false, []byte("full stemcell"))
+
+			s := run(pathToIn, map[string]interface{}{"source": source(""), "version": map[string]string{"version": "1.12"}}, dir)
+			Expect(s.ExitCode()).To(Equal(0))
+
+			var response struct {
+				Version  struct{ Version string }
+				Metadata []struct{ Name, Value string }
+			}
+			Expect(json.Unmarshal(s.Out.Contents(), &response)).To(Succeed())
+			Expect(response.Version.Version).To(Equal("1.12"))
+			Expect(response.Metadata).To(ContainElement(struct{ Name, Value string }{"name", name}))
+
+			Expect(ioutil.ReadFile(filepath.Join(dir, "version"))).To(Equal([]byte("1.12")))
+			Expect(ioutil.ReadFile(filepath.Join(dir, "sha1"))).To(Equal([]byte("8ff450b6da627bea3128e984afacbb7f260218ae")))
+			Expect(ioutil.ReadFile(filepath.Join(dir, "url"))).To(HaveSuffix("/tarballs/" + name + "-1.12.tgz"))
+			Expect(ioutil.ReadFile(filepath.Join(dir, "stemcell.tgz"))).To(Equal([]byte("full stemcell")))
+		})
+
+		It("downloads light stemcells and keeps their file name", func() {
+			const light = "bosh-google-kvm-ubuntu-jammy-go_agent"
+			boshIO.setVersions(light, "1.12")
+			boshIO.setTarball(light, "1.12", true, []byte("light stemcell"))
+
+			src := source("")
+			src["iaas"], src["light"] = "gcp", true
+			s := run(pathToIn, map[string]interface{}{"source": src, "version": map[string]string{"version": "1.12"}, "params": map[string]bool{"preserve_filename": true}}, dir)
+			Expect(s.ExitCode()).To(Equal(0))
+			Expect(ioutil.ReadFile(filepath.Join(dir, "light-"+light+"-1.12.tgz"))).To(Equal([]byte("light stemcell")))
+		})
+
+		It("can skip the download", func() {
+			s := run(pathToIn, map[string]interface{}{"source": source(""), "version": map[string]string{"version": "1.12"}, "params": map[string]bool{"tarball": false}}, dir)
+			Expect(s.ExitCode()).To(Equal(0))
+			Expect(filepath.Join(dir, "version")).To(BeAnExistingFile())
+			Expect(filepath.Join(dir, "stemcell.tgz")).ToNot(BeAnExistingFile())
+		})
+
+		It("fails when the sha1 does not match", func() {
+			boshIO.setTarball(name, "1.12", false, []byte("full stemcell"))
+			boshIO.mu.Lock()
+			boshIO.tarballs["/tarballs/"+name+"-1.12.tgz"] = []byte("tampered stemcell")
+			boshIO.mu.Unlock()
+
+			s := run(pathToIn, map[string]interface{}{"source": source(""), "version": map[string]string{"version": "1.12"}}, dir)
+			Expect(s.ExitCode()).To(Equal(1))
+			Expect(string(s.Err.Contents())).To(ContainSubstring("expected 8ff450b6da627bea3128e984afacbb7f260218ae"))
+
+			files, err := ioutil.ReadDir(dir)
+			Expect(err).ToNot(HaveOccurred())
+			var names []string
+			for _, f := range files {
+				names = append(names, f.Name())
+			}
+			Expect(names).To(ConsistOf("sha1", "url", "version"))
+		})
+	})
+
+	Describe("out", func() {
+		It("promotes the version to the candidate channel", func() {
+			adminSession, adminPort := startServer("ADMIN_TOKEN=secret")
+			defer adminSession.Kill()
+
+			Expect(os.MkdirAll(filepath.Join(dir, "stemcell"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "stemcell", "version"), []byte("1.10\n"), 0644)).To(Succeed())
+
+			src := source("candidate")
+			src["url"] = fmt.Sprintf("http://localhost:%d", adminPort)
+			src["admin_token"] = "secret"
+			s := run(pathToOut, map[string]interface{}{"source": src, "params": map[string]string{"version": "stemcell/version"}}, dir)
+			Expect(s.ExitCode()).To(Equal(0))
+			Expect(string(s.Out.Contents())).To(ContainSubstring(`"version":{"version":"1.10"}`))
+
+			Expect(check(src, "")).To(Equal([]string{"1.10"}))
+		})
+
+		It("requires an admin token", func() {
+			s := run(pathToOut, map[string]interface{}{"source": source(""), "params": map[string]string{"version": "stemcell/version"}}, dir)
+			Expect(s.ExitCode()).To(Equal(1))
+			Expect(string(s.Err.Contents())).To(ContainSubstring("admin_token"))
+		})
+	})
+})
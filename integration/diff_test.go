@@ -0,0 +1,140 @@
+package integration_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Package diffs", func() {
+	const name = "bosh-aws-xen-hvm-ubuntu-noble-go_agent"
+
+	get := func(path, accept string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", serverPort, path), nil)
+		Expect(err).ToNot(HaveOccurred())
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return resp, body
+	}
+
+	BeforeEach(func() {
+		boshIO.setVersions(name, "1.10", "1.12", "1.14")
+		boshIO.setPackages(name, "1.10",
+			"bash=5.2.21-2ubuntu4",
+			"curl=8.5.0-2ubuntu10.1",
+			"libfoo=2.0",
+			"linux-image-6.8.0-40-generic=6.8.0-40.40",
+			"openssl=3.0.13-0ubuntu3.1",
+			"tzdata=2024a~rc1",
+		)
+		boshIO.setPackages(name, "1.12",
+			"bash=5.2.21-2ubuntu4",
+			"libfoo=1.9",
+			"linux-image-6.8.0-45-generic=6.8.0-45.45",
+			"openssl=3.0.13-0ubuntu3.10",
+			"tzdata=2024a",
+			"wget=1.21.4-1ubuntu4",
+		)
+		boshIO.setPackages(name, "1.14",
+			"bash=5.2.21-2ubuntu4",
+			"libfoo=1.9",
+			"linux-image-6.8.0-45-generic=6.8.0-45.45",
+			"openssl=3.0.13-0ubuntu3.10",
+			"tzdata=2024a",
+			"wget=1.21.4-1ubuntu4",
+		)
+	})
+
+	It("lists added, removed, upgraded and downgraded packages as text", func() {
+		resp, body := get("/diff/aws/noble/1.10/1.12", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("text/plain; charset=utf-8"))
+		Expect(string(body)).To(Equal(name + ` 1.10 -> 1.12
+
+Kernel: linux-image-6.8.0-40-generic 6.8.0-40.40 -> linux-image-6.8.0-45-generic 6.8.0-45.45
+
+Added (2):
+  linux-image-6.8.0-45-generic 6.8.0-45.45
+  wget 1.21.4-1ubuntu4
+
+Removed (2):
+  curl 8.5.0-2ubuntu10.1
+  linux-image-6.8.0-40-generic 6.8.0-40.40
+
+Upgraded (2):
+  openssl 3.0.13-0ubuntu3.1 -> 3.0.13-0ubuntu3.10
+  tzdata 2024a~rc1 -> 2024a
+
+Downgraded (1):
+  libfoo 2.0 -> 1.9
+`))
+	})
+
+	It("returns JSON to clients that ask for it", func() {
+		resp, body := get("/diff/aws/noble/1.10/latest", "application/json")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		type pkg struct{ Name, Version string }
+		type change struct{ Name, From, To string }
+		var d struct {
+			Name       string
+			From       string
+			To         string
+			Added      []pkg
+			Removed    []pkg
+			Upgraded   []change
+			Downgraded []change
+			Kernel     struct{ From, To pkg }
+		}
+		Expect(json.Unmarshal(body, &d)).To(Succeed())
+		Expect(d.Name).To(Equal(name))
+		Expect(d.From).To(Equal("1.10"))
+		Expect(d.To).To(Equal("1.14"))
+		Expect(d.Added).To(ConsistOf(pkg{"linux-image-6.8.0-45-generic", "6.8.0-45.45"}, pkg{"wget", "1.21.4-1ubuntu4"}))
+		Expect(d.Removed).To(ConsistOf(pkg{"curl", "8.5.0-2ubuntu10.1"}, pkg{"linux-image-6.8.0-40-generic", "6.8.0-40.40"}))
+		Expect(d.Upgraded).To(ConsistOf(change{"openssl", "3.0.13-0ubuntu3.1", "3.0.13-0ubuntu3.10"}, change{"tzdata", "2024a~rc1", "2024a"}))
+		Expect(d.Downgraded).To(ConsistOf(change{"libfoo", "2.0", "1.9"}))
+		Expect(d.Kernel.From).To(Equal(pkg{"linux-image-6.8.0-40-generic", "6.8.0-40.40"}))
+		Expect(d.Kernel.To).To(Equal(pkg{"linux-image-6.8.0-45-generic", "6.8.0-45.45"}))
+	})
+
+	It("says when nothing changed", func() {
+		resp, body := get("/diff/aws/noble/1.12/1.14", "text/plain")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(string(body)).To(Equal(name + " 1.12 -> 1.14\n\nNo package changes.\n"))
+	})
+
+	It("reads the package lists published with the stemcells rather than their tarballs", func() {
+		resp, _ := get("/diff/aws/noble/1.10/1.12", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(boshIO.downloadCount("/tarballs/" + name + "-1.10.tgz")).To(BeZero())
+		Expect(boshIO.downloadCount("/tarballs/" + name + "-1.12.tgz")).To(BeZero())
+	})
+
+	It("returns 404 for versions without a package list", func() {
+		boshIO.setVersions(name, "1.10", "1.12", "1.14", "1.16")
+		boshIO.setPackages(name, "1.14", "bash=5.2.21-2ubuntu4")
+		boshIO.setTarball(name, "1.16", false, fakeStemcell(name, "1.16", "bash=5.2.21-2ubuntu4"))
+
+		resp, body := get("/diff/aws/noble/1.14/1.16", "text/plain")
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		Expect(string(body)).To(Equal(name + " has no package list for version 1.16\n"))
+	})
+
+	It("rejects invalid versions", func() {
+		resp, _ := get("/diff/aws/noble/1.10/banana", "application/json")
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+})
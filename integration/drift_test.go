@@ -0,0 +1,202 @@
+package integration_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Director drift", func() {
+	const name = "bosh-vsphere-esxi-ubuntu-noble-go_agent"
+
+	var (
+		director     *httptest.Server
+		driftSession *gexec.Session
+		driftPort    int
+	)
+
+	type drift struct {
+		Deployment     string
+		Stemcell       string
+		Version        string
+		Target         string
+		VersionsBehind int `json:"versions_behind"`
+		DaysBehind     int `json:"days_behind"`
+		Error          string
+	}
+	type report struct {
+		Target      string
+		CheckedAt   *time.Time `json:"checked_at"`
+		Error       string
+		Deployments []drift
+	}
+
+	get := func(path string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", driftPort, path), nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer admin")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return resp, body
+	}
+
+	checked := func(path string) report {
+		var r report
+		Eventually(func() *time.Time {
+			_, body := get(path)
+			Expect(json.Unmarshal(body, &r)).To(Succeed())
+			return r.CheckedAt
+		}, "5s").ShouldNot(BeNil())
+		return r
+	}
+
+	BeforeEach(func() {
+		director = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/info":
+				fmt.Fprintf(w, `{"name": "fake", "user_authentication": {"type": "uaa", "options": {"url": "http://%s/uaa"}}}`, r.Host)
+				return
+			case "/uaa/oauth/token":
+				if id, secret, _ := r.BasicAuth(); id != "drift" || secret != "secret" || r.FormValue("grant_type") != "client_credentials" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Write([]byte(`{"access_token": "token", "token_type": "bearer", "expires_in": 3600}`))
+				return
+			}
+
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			switch r.URL.Path {
+			case "/stemcells":
+				w.Write([]byte(`[
+  {"name": "` + name + `", "operating_system": "ubuntu-noble", "version": "1.12", "cpi": "", "deployments": [{"name": "cf"}]},
+  {"name": "` + name + `", "operating_system": "ubuntu-noble", "version": "1.16", "cpi": "", "deployments": [{"name": "redis"}]}
+]`))
+			case "/deployments":
+				w.Write([]byte(`[
+  {"name": "redis", "releases": [], "stemcells": [{"name": "` + name + `", "version": "1.16"}], "cloud_config": "latest", "teams": []},
+  {"name": "cf", "releases": [], "stemcells": [{"name": "` + name + `", "version": "1.12"}], "cloud_config": "latest", "teams": []},
+  {"name": "legacy", "releases": [], "stemcells": [{"name": "my-custom-stemcell", "version": "3"}], "cloud_config": "none", "teams": []}
+]`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+
+		now := time.Now()
+		boshIO.setVersions(name, "1.16", "1.14", "1.12", "1.10")
+		boshIO.setPublished(name, "1.16", now.Add(-24*time.Hour))
+		boshIO.setPublished(name, "1.14", now.Add(-5*24*time.Hour-time.Hour))
+		boshIO.setPublished(name, "1.12", now.Add(-20*24*time.Hour))
+		boshIO.setPublished(name, "1.10", now.Add(-40*24*time.Hour))
+	})
+
+	AfterEach(func() {
+		driftSession.Kill().Wait()
+		director.Close()
+	})
+
+	Context("with valid credentials", func() {
+		BeforeEach(func() {
+			driftSession, driftPort = startServer("ADMIN_TOKEN=admin", "BOSH_DIRECTOR_URL="+director.URL, "BOSH_CLIENT=drift", "BOSH_CLIENT_SECRET=secret", "DRIFT_INTERVAL=1h")
+		})
+
+		It("reports how far behind the latest version each deployment is", func() {
+			r := checked("/api/v1/drift")
+			Expect(r.Target).To(Equal("latest"))
+			Expect(r.Error).To(BeEmpty())
+			Expect(r.Deployments).To(HaveLen(3))
+			Expect(r.Deployments[0]).To(Equal(drift{"cf", name, "1.12", "1.16", 2, 5, ""}))
+			Expect(r.Deployments[1].Deployment).To(Equal("legacy"))
+			Expect(r.Deployments[1].Error).To(ContainSubstring("my-custom-stemcell"))
+			Expect(r.Deployments[2]).To(Equal(drift{"redis", name, "1.16", "1.16", 0, 0, ""}))
+		})
+
+		It("only lists deployments at least as far behind as asked", func() {
+			checked("/api/v1/drift")
+
+			var r report
+			_, body := get("/api/v1/drift?versions-behind=1")
+			Expect(json.Unmarshal(body, &r)).To(Succeed())
+			Expect(r.Deployments).To(HaveLen(1))
+			Expect(r.Deployments[0].Deployment).To(Equal("cf"))
+
+			_, body = get("/api/v1/drift?days-behind=6")
+			Expect(json.Unmarshal(body, &r)).To(Succeed())
+			Expect(r.Deployments).To(BeEmpty())
+
+			resp, _ := get("/api/v1/drift?days-behind=many")
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+
+		It("requires the admin token", func() {
+			for _, path := range []string{"/api/v1/drift", "/metrics"} {
+				resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s", driftPort, path))
+				Expect(err).ToNot(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			}
+		})
+
+		It("exposes Prometheus gauges", func() {
+			checked("/api/v1/drift")
+
+			resp, body := get("/metrics")
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Content-Type")).To(HavePrefix("text/plain; version=0.0.4"))
+
+			labels := fmt.Sprintf(`director="%s",deployment="cf",stemcell="%s",version="1.12",target="1.16"`, director.URL, name)
+			Expect(string(body)).To(ContainSubstring(fmt.Sprintf(`boshstemcells_director_up{director="%s"} 1`, director.URL)))
+			Expect(string(body)).To(ContainSubstring("# TYPE boshstemcells_deployment_stemcell_versions_behind gauge\n"))
+			Expect(string(body)).To(ContainSubstring("boshstemcells_deployment_stemcell_versions_behind{" + labels + "} 2\n"))
+			Expect(string(body)).To(ContainSubstring("boshstemcells_deployment_stemcell_days_behind{" + labels + "} 5\n"))
+			Expect(string(body)).ToNot(ContainSubstring(`deployment="legacy"`))
+		})
+	})
+
+	It("reports when the director cannot be reached", func() {
+		driftSession, driftPort = startServer("ADMIN_TOKEN=admin", "BOSH_DIRECTOR_URL="+director.URL, "BOSH_CLIENT=drift", "BOSH_CLIENT_SECRET=wrong", "DRIFT_INTERVAL=1h")
+
+		r := checked("/api/v1/drift")
+		Expect(r.Error).To(ContainSubstring("401"))
+
+		_, body := get("/metrics")
+		Expect(string(body)).To(ContainSubstring(fmt.Sprintf(`boshstemcells_director_up{director="%s"} 0`, director.URL)))
+	})
+
+	It("reaches the director through the proxy in the environment", func() {
+		// The proxy serves the director's responses itself, so the director
+		// is only reachable through it.
+		proxy := httptest.NewServer(director.Config.Handler)
+		defer proxy.Close()
+
+		driftSession, driftPort = startServer("ADMIN_TOKEN=admin", "BOSH_DIRECTOR_URL=http://director.invalid", "HTTP_PROXY="+proxy.URL, "BOSH_CLIENT=drift", "BOSH_CLIENT_SECRET=secret", "DRIFT_INTERVAL=1h")
+
+		r := checked("/api/v1/drift")
+		Expect(r.Error).To(BeEmpty())
+		Expect(r.Deployments).To(HaveLen(3))
+	})
+
+	It("compares with a promotion channel", func() {
+		driftSession, driftPort = startServer("ADMIN_TOKEN=admin", "BOSH_DIRECTOR_URL="+director.URL, "BOSH_CLIENT=drift", "BOSH_CLIENT_SECRET=secret", "DRIFT_INTERVAL=1h", "DRIFT_TARGET=edge")
+
+		r := checked("/api/v1/drift")
+		Expect(r.Target).To(Equal("edge"))
+		Expect(r.Deployments[0]).To(Equal(drift{"cf", name, "1.12", "1.16", 2, 5, ""}))
+	})
+})
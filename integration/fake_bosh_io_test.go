@@ -0,0 +1,238 @@
+package integration_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeBoshIO stands in for the bosh.io stemcell API.
+type fakeBoshIO struct {
+	server *httptest.Server
+
+	mu        sync.Mutex
+	stemcells map[string][]map[string]interface{}
+	tarballs  map[string][]byte
+	lookups   map[string]int
+	downloads map[string]int
+}
+
+func newFakeBoshIO() *fakeBoshIO {
+	f := &fakeBoshIO{stemcells: map[string][]map[string]interface{}{}, tarballs: map[string][]byte{}, lookups: map[string]int{}, downloads: map[string]int{}}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+// setVersions replaces the versions listed for a stemcell series.
+func (f *fakeBoshIO) setVersions(name string, versions ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var list []map[string]interface{}
+	for _, v := range versions {
+		list = append(list, map[string]interface{}{
+			"name":    name,
+			"version": v,
+			"regular": map[string]interface{}{
+				"url":  "https://s3.amazonaws.com/bosh-core-stemcells/" + name + "-" + v + ".tgz",
+				"size": 1024,
+				"sha1": strings.Repeat("a", 40),
+			},
+		})
+	}
+	f.stemcells[name] = list
+}
+
+// setPublished gives a listed version a publish date.
+func (f *fakeBoshIO) setPublished(name, version string, publishedAt time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, v := range f.stemcells[name] {
+		if v["version"] == version {
+			v["published_at"] = publishedAt.UTC().Format(time.RFC3339)
+		}
+	}
+}
+
+// lookupCount returns how many times the versions of a series have been
+// listed.
+func (f *fakeBoshIO) lookupCount(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.lookups[name]
+}
+
+// downloadCount returns how many times a tarball has been downloaded by its
+// path.
+func (f *fakeBoshIO) downloadCount(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.downloads[path]
+}
+
+// setTarball serves content as the full or light tarball of a listed
+// version.
+func (f *fakeBoshIO) setTarball(name, version string, light bool, content []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	flavor, prefix := "regular", ""
+	if light {
+		flavor, prefix = "light", "light-"
+	}
+	path := "/tarballs/" + prefix + name + "-" + version + ".tgz"
+	f.tarballs[path] = content
+
+	for _, v := range f.stemcells[name] {
+		if v["version"] == version {
+			v[flavor] = map[string]interface{}{
+				"url":  f.server.URL + path,
+				"size": len(content),
+				"sha1": sha1Of(string(content)),
+			}
+		}
+	}
+}
+
+// setLightOnly serves content as the light tarball of a listed version and
+// stops listing its full tarball.
+func (f *fakeBoshIO) setLightOnly(name, version string, content []byte) {
+	f.setTarball(name, version, true, content)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, v := range f.stemcells[name] {
+		if v["version"] == version {
+			delete(v, "regular")
+		}
+	}
+}
+
+// setPackages publishes the dpkg package list of a listed version next to
+// its full tarball, each package given as name=version.
+func (f *fakeBoshIO) setPackages(name, version string, packages ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tarballs["/tarballs/"+name+"-"+version+".stemcell_dpkg_l.txt"] = []byte(dpkgList(packages))
+	for _, v := range f.stemcells[name] {
+		if v["version"] == version {
+			v["regular"].(map[string]interface{})["url"] = f.server.URL + "/tarballs/" + name + "-" + version + ".tgz"
+		}
+	}
+}
+
+// stemcellTarball builds a gzipped tarball of files, in the layout of a
+// stemcell tarball when files include a stemcell.MF.
+func stemcellTarball(files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name]))})
+		tw.Write([]byte(files[name]))
+	}
+
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// fakeStemcell builds a stemcell tarball whose image has the given packages,
+// each given as name=version.
+func fakeStemcell(name, version string, packages ...string) []byte {
+	os := "ubuntu-" + strings.Split(strings.SplitN(name, "ubuntu-", 2)[1], "-")[0]
+	return stemcellTarball(map[string]string{
+		"stemcell.MF": fmt.Sprintf(`---
+name: %s
+version: '%s'
+bosh_protocol: '1'
+api_version: 3
+sha1: %s
+operating_system: %s
+stemcell_formats:
+- vsphere-ova
+cloud_properties:
+  name: %s
+  version: '%s'
+  disk: 5120
+`, name, version, sha1Of("image of "+version), os, name, version),
+		"image":               "image of " + version,
+		"stemcell_dpkg_l.txt": dpkgList(packages),
+	})
+}
+
+// dpkgList is the dpkg -l output for packages, each given as name=version.
+func dpkgList(packages []string) string {
+	dpkg := "Desired=Unknown/Install/Remove/Purge/Hold\n" +
+		"||/ Name                 Version            Architecture Description\n" +
+		"+++-====================-==================-============-===========\n"
+	for _, p := range packages {
+		parts := strings.SplitN(p, "=", 2)
+		dpkg += fmt.Sprintf("ii  %-20s %-18s amd64        the %s package\n", parts[0], parts[1], parts[0])
+	}
+	return dpkg
+}
+
+func sha1Of(content string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(content)))
+}
+
+func (f *fakeBoshIO) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/tarballs/") {
+		f.serveTarball(w, r)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/api/v1/stemcells/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/stemcells/")
+	f.lookups[name]++
+	list, ok := f.stemcells[name]
+	if !ok {
+		list = []map[string]interface{}{}
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+func (f *fakeBoshIO) serveTarball(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	content, ok := f.tarballs[r.URL.Path]
+	f.downloads[r.URL.Path]++
+	f.mu.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(content))
+}
+
+func (f *fakeBoshIO) close() {
+	f.server.Close()
+}
@@ -0,0 +1,143 @@
+package integration_test
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Feeds", func() {
+	const name = "bosh-vsphere-esxi-ubuntu-noble-go_agent"
+
+	var (
+		feedSession *gexec.Session
+		feedPort    int
+	)
+
+	get := func(path string) (*http.Response, string) {
+		response, err := http.Get(fmt.Sprintf("http://localhost:%d%s", feedPort, path))
+		Expect(err).ToNot(HaveOccurred())
+		body, err := ioutil.ReadAll(response.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return response, string(body)
+	}
+
+	type entry struct {
+		ID      string `xml:"id"`
+		Title   string `xml:"title"`
+		Updated string `xml:"updated"`
+		Summary string `xml:"summary"`
+		Links   []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+	}
+
+	entries := func(path string) func() []entry {
+		return func() []entry {
+			var feed struct {
+				Entries []entry `xml:"entry"`
+			}
+			_, body := get(path)
+			Expect(xml.Unmarshal([]byte(body), &feed)).To(Succeed())
+			return feed.Entries
+		}
+	}
+
+	publish := func(versions ...string) {
+		boshIO.setVersions(name, versions...)
+		boshIO.setPublished(name, "1.10", time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+		boshIO.setPublished(name, "1.12", time.Date(2024, 6, 8, 12, 0, 0, 0, time.UTC))
+		boshIO.setPublished(name, "1.15", time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC))
+	}
+
+	BeforeEach(func() {
+		publish("1.10", "1.12")
+
+		lookups := boshIO.lookupCount(name)
+		feedSession, feedPort = startServer("POLL_INTERVAL=100ms")
+		Eventually(func() int { return boshIO.lookupCount(name) }).Should(BeNumerically(">", lookups))
+
+		publish("1.10", "1.12", "1.15")
+	})
+
+	AfterEach(func() {
+		feedSession.Kill()
+	})
+
+	It("serves an Atom feed of a series' versions", func() {
+		Eventually(entries("/feeds/vsphere/noble.atom")).Should(HaveLen(1))
+
+		response, _ := get("/feeds/vsphere/noble.atom")
+		Expect(response.Header.Get("Content-Type")).To(HavePrefix("application/atom+xml"))
+
+		latest := entries("/feeds/vsphere/noble.atom")()[0]
+		Expect(latest.ID).To(Equal("tag:boshstemcells.com,2018:" + name + "/1.15"))
+		Expect(latest.Title).To(Equal(name + " 1.15"))
+		Expect(latest.Updated).To(Equal("2024-06-15T12:00:00Z"))
+		Expect(latest.Summary).To(ContainSubstring("https://s3.amazonaws.com/bosh-core-stemcells/" + name + "-1.15.tgz"))
+		Expect(latest.Summary).To(ContainSubstring("sha1: aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+		Expect(latest.Links[0].Href).To(Equal("https://bosh.io/d/stemcells/" + name + "?v=1.15"))
+		Expect(latest.Links[1].Rel).To(Equal("related"))
+	})
+
+	It("leaves out the versions listed when the series was first polled", func() {
+		Eventually(entries("/feeds/vsphere/noble.atom")).Should(HaveLen(1))
+		Consistently(entries("/feeds/vsphere/noble.atom"), "300ms").Should(HaveLen(1))
+	})
+
+	It("adds versions as the poller discovers them", func() {
+		Eventually(entries("/feeds/vsphere/noble.atom")).Should(HaveLen(1))
+
+		publish("1.10", "1.12", "1.15", "1.16")
+
+		Eventually(entries("/feeds/vsphere/noble.atom")).Should(HaveLen(2))
+		Expect(entries("/feeds/vsphere/noble.atom")()[0].Title).To(Equal(name + " 1.16"))
+	})
+
+	It("serves a feed of all stemcells", func() {
+		Eventually(entries("/feeds/all.atom")).Should(ContainElement(WithTransform(func(e entry) string { return e.Title }, Equal(name+" 1.15"))))
+	})
+
+	It("serves RSS", func() {
+		Eventually(func() string {
+			_, body := get("/feeds/vsphere/noble.rss")
+			return body
+		}).Should(ContainSubstring("<title>" + name + " 1.15</title>"))
+
+		response, body := get("/feeds/vsphere/noble.rss")
+		Expect(response.Header.Get("Content-Type")).To(HavePrefix("application/rss+xml"))
+		Expect(body).To(ContainSubstring(`<enclosure url="https://bosh.io/d/stemcells/` + name + `?v=1.15" length="1024" type="application/x-gzip">`))
+	})
+
+	It("encloses the light stemcell of versions that only have one", func() {
+		publish("1.10", "1.12", "1.15", "1.16")
+		boshIO.setLightOnly(name, "1.16", []byte("light 1.16"))
+
+		Eventually(func() string {
+			_, body := get("/feeds/vsphere/noble.rss")
+			return body
+		}).Should(ContainSubstring(`<enclosure url="` + boshIO.server.URL + `/tarballs/light-` + name + `-1.16.tgz" length="10" type="application/x-gzip">`))
+	})
+
+	It("rejects unknown and unpublished series", func() {
+		response, body := get("/feeds/vsphere/nobel.atom")
+		Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+		Expect(body).To(ContainSubstring("Did you mean noble?"))
+
+		response, _ = get("/feeds/softlayer/windows2019.atom")
+		Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("is not served unless the server polls", func() {
+		response, err := http.Get(fmt.Sprintf("http://localhost:%d/feeds/all.atom", serverPort))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+	})
+})
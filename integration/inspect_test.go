@@ -0,0 +1,240 @@
+package integration_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Tarball inspection", func() {
+	const name = "bosh-vsphere-esxi-ubuntu-noble-go_agent"
+
+	type pkg struct {
+		Name         string `json:"name"`
+		Version      string `json:"version"`
+		Architecture string `json:"architecture"`
+		Description  string `json:"description"`
+	}
+
+	type inspection struct {
+		Manifest struct {
+			Name            string                 `json:"name"`
+			Version         string                 `json:"version"`
+			OperatingSystem string                 `json:"operating_system"`
+			APIVersion      int                    `json:"api_version"`
+			SHA1            string                 `json:"sha1"`
+			StemcellFormats []string               `json:"stemcell_formats"`
+			CloudProperties map[string]interface{} `json:"cloud_properties"`
+		} `json:"manifest"`
+		SHA1      string `json:"sha1"`
+		ImageSHA1 string `json:"image_sha1"`
+		Packages  []pkg  `json:"packages"`
+		Kernel    *pkg   `json:"kernel"`
+	}
+
+	var tarball []byte
+
+	get := func(path string) (*http.Response, inspection) {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s", serverPort, path))
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+
+		var i inspection
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		json.Unmarshal(body, &i)
+		return resp, i
+	}
+
+	BeforeEach(func() {
+		tarball = fakeStemcell(name, "1.40", "bash=5.2.21-2ubuntu4", "linux-image-virtual=6.8.0-45.45", "linux-image-6.8.0-45-generic=6.8.0-45.45")
+		boshIO.setVersions(name, "1.38", "1.40")
+		boshIO.setTarball(name, "1.40", false, tarball)
+		boshIO.setTarball(name, "1.40", true, fakeStemcell(name, "1.40"))
+	})
+
+	It("describes the manifest, image and packages of a version", func() {
+		resp, i := get("/api/v1/inspect/vsphere/noble/latest")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		Expect(i.Manifest.Name).To(Equal(name))
+		Expect(i.Manifest.Version).To(Equal("1.40"))
+		Expect(i.Manifest.OperatingSystem).To(Equal("ubuntu-noble"))
+		Expect(i.Manifest.APIVersion).To(Equal(3))
+		Expect(i.Manifest.StemcellFormats).To(Equal([]string{"vsphere-ova"}))
+		Expect(i.Manifest.CloudProperties).To(HaveKeyWithValue("disk", BeNumerically("==", 5120)))
+		Expect(i.SHA1).To(Equal(sha1Of(string(tarball))))
+		Expect(i.ImageSHA1).To(Equal(i.Manifest.SHA1))
+
+		Expect(i.Packages).To(ConsistOf(
+			pkg{"bash", "5.2.21-2ubuntu4", "amd64", "the bash package"},
+			pkg{"linux-image-virtual", "6.8.0-45.45", "amd64", "the linux-image-virtual package"},
+			pkg{"linux-image-6.8.0-45-generic", "6.8.0-45.45", "amd64", "the linux-image-6.8.0-45-generic package"},
+		))
+		Expect(i.Kernel).To(Equal(&pkg{"linux-image-6.8.0-45-generic", "6.8.0-45.45", "amd64", "the linux-image-6.8.0-45-generic package"}))
+	})
+
+	It("inspects light stemcells", func() {
+		resp, i := get("/api/v1/inspect/vsphere/noble/1.40?light=true")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(i.Manifest.Version).To(Equal("1.40"))
+		Expect(i.Packages).To(BeEmpty())
+	})
+
+	It("remembers tarballs it has inspected", func() {
+		resp, _ := get("/api/v1/inspect/vsphere/noble/1.40")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		boshIO.mu.Lock()
+		delete(boshIO.tarballs, "/tarballs/"+name+"-1.40.tgz")
+		boshIO.mu.Unlock()
+
+		resp, i := get("/api/v1/inspect/vsphere/noble/1.40")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(i.Manifest.Version).To(Equal("1.40"))
+	})
+
+	It("keeps inspections rather than tarballs", func() {
+		dataDir, err := ioutil.TempDir("", "inspect")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dataDir)
+
+		session, port := startServer("DATA_DIR=" + dataDir)
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d/api/v1/inspect/vsphere/noble/1.40", port))
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		session.Kill().Wait()
+
+		Expect(filepath.Join(dataDir, "inspections", sha1Of(string(tarball))+".json")).To(BeARegularFile())
+		tarballs, err := ioutil.ReadDir(filepath.Join(dataDir, "tarballs"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tarballs).To(BeEmpty())
+	})
+
+	It("fails when the tarball does not match its published sha1", func() {
+		boshIO.setTarball(name, "1.38", false, fakeStemcell(name, "1.38"))
+		boshIO.mu.Lock()
+		boshIO.tarballs["/tarballs/"+name+"-1.38.tgz"] = fakeStemcell(name, "1.38", "bash=5.2")
+		boshIO.mu.Unlock()
+
+		resp, _ := get("/api/v1/inspect/vsphere/noble/1.38")
+		Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+	})
+
+	It("downloads a tarball once for concurrent inspections", func() {
+		boshIO.setVersions(name, "1.38", "1.39", "1.40")
+		boshIO.setTarball(name, "1.39", false, fakeStemcell(name, "1.39", "bash=5.2.21-2ubuntu4"))
+
+		var wg sync.WaitGroup
+		for n := 0; n < 5; n++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				resp, i := get("/api/v1/inspect/vsphere/noble/1.39")
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(i.Manifest.Version).To(Equal("1.39"))
+			}()
+		}
+		wg.Wait()
+
+		Expect(boshIO.downloadCount("/tarballs/" + name + "-1.39.tgz")).To(Equal(1))
+	})
+
+	It("fails for versions without a tarball", func() {
+		resp, _ := get("/api/v1/inspect/vsphere/noble/1.38?light=true")
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	Describe("uploads", func() {
+		var (
+			uploadSession *gexec.Session
+			uploadPort    int
+		)
+
+		upload := func(port int, token string, body []byte) *http.Response {
+			req, err := http.NewRequest("POST", fmt.Sprintf("http://localhost:%d/api/v1/inspect", port), bytes.NewReader(body))
+			Expect(err).ToNot(HaveOccurred())
+			req.Header.Set("Content-Type", "application/gzip")
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			return resp
+		}
+
+		BeforeEach(func() {
+			uploadSession, uploadPort = startServer("ADMIN_TOKEN=secret")
+		})
+
+		AfterEach(func() {
+			uploadSession.Kill()
+		})
+
+		It("describes an uploaded tarball", func() {
+			resp := upload(uploadPort, "secret", tarball)
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			var i inspection
+			Expect(json.NewDecoder(resp.Body).Decode(&i)).To(Succeed())
+			Expect(i.Manifest.Name).To(Equal(name))
+			Expect(i.Kernel.Version).To(Equal("6.8.0-45.45"))
+		})
+
+		It("requires the admin token", func() {
+			resp := upload(uploadPort, "", tarball)
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("rejects tarballs over the size limit", func() {
+			session, port := startServer("ADMIN_TOKEN=secret", "MAX_TARBALL_SIZE=64")
+			defer session.Kill()
+
+			resp := upload(port, "secret", tarball)
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusRequestEntityTooLarge))
+
+			resp, err := http.Get(fmt.Sprintf("http://localhost:%d/api/v1/inspect/vsphere/noble/1.40", port))
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+		})
+
+		It("rejects files that are not stemcells", func() {
+			for _, body := range [][]byte{[]byte("not a tarball"), stemcellTarball(map[string]string{"image": "disk"})} {
+				resp := upload(uploadPort, "secret", body)
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+				Expect(resp.Header.Get("Content-Type")).To(Equal("application/problem+json"))
+			}
+		})
+
+		It("does not read manifests that decompress to more than a megabyte", func() {
+			body := stemcellTarball(map[string]string{"stemcell.MF": "name: " + strings.Repeat(" ", 2<<20)})
+			Expect(len(body)).To(BeNumerically("<", 64<<10))
+
+			resp := upload(uploadPort, "secret", body)
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+
+			data, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("stemcell.MF is larger than 1048576 bytes"))
+		})
+	})
+})
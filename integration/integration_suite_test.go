@@ -16,49 +16,72 @@ import (
 var (
 	serverPort int
 	session    *gexec.Session
+	pathToBin  string
+	boshIO     *fakeBoshIO
+
+	pathToCheck, pathToIn, pathToOut string
+	pathToCLI                        string
 )
 
 func TestIntegration(t *testing.T) {
 	RegisterFailHandler(Fail)
 
 	BeforeSuite(func() {
-		var (
-			err       error
-			pathToBin string
-		)
+		var err error
 
 		pathToBin, err = gexec.Build("code.benchapman.ie/boshstemcells")
 		Expect(err).ToNot(HaveOccurred())
 
-		listener, err := net.Listen("tcp", ":0")
-		if err != nil {
-			panic(err)
-		}
-
-		serverPort = listener.Addr().(*net.TCPAddr).Port
-
-		listener.Close()
-
-		cmd := exec.Command(pathToBin)
-		cmd.Env = os.Environ()
-		cmd.Env = append(cmd.Env, fmt.Sprintf("PORT=%d", serverPort))
-		pwd, err := os.Getwd()
+		pathToCheck, err = gexec.Build("code.benchapman.ie/boshstemcells/concourse/cmd/check")
+		Expect(err).ToNot(HaveOccurred())
+		pathToIn, err = gexec.Build("code.benchapman.ie/boshstemcells/concourse/cmd/in")
+		Expect(err).ToNot(HaveOccurred())
+		pathToOut, err = gexec.Build("code.benchapman.ie/boshstemcells/concourse/cmd/out")
+		Expect(err).ToNot(HaveOccurred())
+		pathToCLI, err = gexec.Build("code.benchapman.ie/boshstemcells/cmd/boshstemcells")
 		Expect(err).ToNot(HaveOccurred())
-		cmd.Dir = filepath.Join(pwd, "..")
-
-		session, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
-		Expect(err).NotTo(HaveOccurred())
 
-		Eventually(func() error {
-			_, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", serverPort))
-			return err
-		}, "10s").ShouldNot(HaveOccurred())
+		boshIO = newFakeBoshIO()
+		session, serverPort = startServer()
 	})
 
 	AfterSuite(func() {
 		session.Kill()
+		boshIO.close()
 		gexec.CleanupBuildArtifacts()
 	})
 
 	RunSpecs(t, "Integration Suite")
 }
+
+// startServer runs the server binary on a free port against the fake bosh.io,
+// with env added to the test process's environment.
+func startServer(env ...string) (*gexec.Session, int) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		panic(err)
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	listener.Close()
+
+	cmd := exec.Command(pathToBin)
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, fmt.Sprintf("PORT=%d", port))
+	cmd.Env = append(cmd.Env, "BOSH_IO_API_URL="+boshIO.server.URL, "UPSTREAM_CACHE_TTL=0s")
+	cmd.Env = append(cmd.Env, env...)
+	pwd, err := os.Getwd()
+	Expect(err).ToNot(HaveOccurred())
+	cmd.Dir = filepath.Join(pwd, "..")
+
+	s, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+	Expect(err).NotTo(HaveOccurred())
+
+	Eventually(func() error {
+		_, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		return err
+	}, "10s").ShouldNot(HaveOccurred())
+
+	return s, port
+}
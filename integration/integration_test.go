@@ -1,6 +1,7 @@
 package integration_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -8,6 +9,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
 )
 
 var _ = Describe("BoshStemcells.com", func() {
@@ -31,15 +33,13 @@ var _ = Describe("BoshStemcells.com", func() {
 		response, err := client.Get(fmt.Sprintf("http://localhost:%d%s", serverPort, path))
 		Expect(err).ToNot(HaveOccurred())
 		Expect(response.StatusCode).To(Equal(301))
-		Expect(response.Header.Get("Location")).To(Equal(fmt.Sprintf("https://bosh.io/d/stemcells/bosh-%s-ubuntu-xenial-go_agent", boshUrlPath)))
+		Expect(response.Header.Get("Location")).To(Equal(fmt.Sprintf("https://bosh.io/d/stemcells/bosh-%s-ubuntu-noble-go_agent", boshUrlPath)))
 	},
 		Entry("gcp", "/gcp", "google-kvm"),
 		Entry("vsphere", "/vsphere", "vsphere-esxi"),
 		Entry("aws", "/aws", "aws-xen-hvm"),
 		Entry("azure", "/azure", "azure-hyperv"),
 		Entry("openstack", "/openstack", "openstack-kvm"),
-		Entry("softlayer", "/softlayer", "softlayer-xen"),
-		Entry("vcloud", "/vcloud", "vcloud-esxi"),
 		Entry("lite", "/lite", "warden-boshlite"),
 	)
 
@@ -51,7 +51,7 @@ var _ = Describe("BoshStemcells.com", func() {
 		response, err := client.Get(fmt.Sprintf("http://localhost:%d/gcp/1234.56", serverPort))
 		Expect(err).ToNot(HaveOccurred())
 		Expect(response.StatusCode).To(Equal(301))
-		Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/bosh-google-kvm-ubuntu-xenial-go_agent?v=1234.56"))
+		Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/bosh-google-kvm-ubuntu-noble-go_agent?v=1234.56"))
 	})
 
 	It("Redirects to latest", func() {
@@ -62,7 +62,16 @@ var _ = Describe("BoshStemcells.com", func() {
 		response, err := client.Get(fmt.Sprintf("http://localhost:%d/gcp/latest", serverPort))
 		Expect(err).ToNot(HaveOccurred())
 		Expect(response.StatusCode).To(Equal(301))
-		Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/bosh-google-kvm-ubuntu-xenial-go_agent"))
+		Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/bosh-google-kvm-ubuntu-noble-go_agent"))
+	})
+
+	It("explains when an IaaS does not publish the default line", func() {
+		response, err := http.Get(fmt.Sprintf("http://localhost:%d/softlayer", serverPort))
+		Expect(err).ToNot(HaveOccurred())
+		body, err := ioutil.ReadAll(response.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+		Expect(string(body)).To(ContainSubstring("ubuntu-noble stemcells are not published for softlayer"))
 	})
 
 	DescribeTable("Autodetects", func(ipAddress, boshUrlPath string) {
@@ -75,7 +84,7 @@ var _ = Describe("BoshStemcells.com", func() {
 		response, err := client.Do(req)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(response.StatusCode).To(Equal(301))
-		Expect(response.Header.Get("Location")).To(Equal(fmt.Sprintf("https://bosh.io/d/stemcells/bosh-%s-ubuntu-xenial-go_agent", boshUrlPath)))
+		Expect(response.Header.Get("Location")).To(Equal(fmt.Sprintf("https://bosh.io/d/stemcells/bosh-%s-ubuntu-noble-go_agent", boshUrlPath)))
 	},
 		Entry("gcp", "35.203.192.88", "google-kvm"),
 		Entry("aws", "52.210.132.254", "aws-xen-hvm"),
@@ -118,8 +127,62 @@ var _ = Describe("BoshStemcells.com", func() {
 		Entry("centos", "/centos", "centos-7"),
 		Entry("centos7", "/centos7", "centos-7"),
 		Entry("centos-7", "/centos-7", "centos-7"),
+		Entry("bionic", "/bionic", "ubuntu-bionic"),
+		Entry("jammy", "/jammy", "ubuntu-jammy"),
+		Entry("jammy shortcut", "/j", "ubuntu-jammy"),
+		Entry("noble", "/noble", "ubuntu-noble"),
+		Entry("xenial-fips", "/xenial-fips", "ubuntu-xenial-fips"),
+		Entry("windows1803", "/windows1803", "windows1803"),
+		Entry("windows2019", "/windows2019", "windows2019"),
+		Entry("win19", "/win19", "windows2019"),
 	)
 
+	DescribeTable("can select raw stemcells", func(path, location string) {
+		client := &http.Client{
+			CheckRedirect: func(r *http.Request, ra []*http.Request) error { return http.ErrUseLastResponse },
+		}
+
+		response, err := client.Get(fmt.Sprintf("http://localhost:%d%s", serverPort, path))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(301))
+		Expect(response.Header.Get("Location")).To(Equal(location))
+	},
+		Entry("openstack", "/openstack/xenial-raw", "https://bosh.io/d/stemcells/bosh-openstack-kvm-ubuntu-xenial-go_agent-raw"),
+		Entry("azure with a version", "/azure/bionic-raw/170.9", "https://bosh.io/d/stemcells/bosh-azure-hyperv-ubuntu-bionic-go_agent-raw?v=170.9"),
+	)
+
+	It("refuses raw stemcells for IaaSes that do not publish them", func() {
+		response, err := http.Get(fmt.Sprintf("http://localhost:%d/aws/xenial-raw", serverPort))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	Context("when the default stemcell line is configured", func() {
+		var (
+			defaultSession *gexec.Session
+			defaultPort    int
+		)
+
+		BeforeEach(func() {
+			defaultSession, defaultPort = startServer("DEFAULT_STEMCELL_LINE=bionic")
+		})
+
+		AfterEach(func() {
+			defaultSession.Kill()
+		})
+
+		It("redirects to that line when none is given", func() {
+			client := &http.Client{
+				CheckRedirect: func(r *http.Request, ra []*http.Request) error { return http.ErrUseLastResponse },
+			}
+
+			response, err := client.Get(fmt.Sprintf("http://localhost:%d/gcp/latest", defaultPort))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(301))
+			Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/bosh-google-kvm-ubuntu-bionic-go_agent"))
+		})
+	})
+
 	It("can accept a stemcell line as the second path variable and a version as the third path variable", func() {
 		client := &http.Client{
 			CheckRedirect: func(r *http.Request, ra []*http.Request) error { return http.ErrUseLastResponse },
@@ -141,4 +204,126 @@ var _ = Describe("BoshStemcells.com", func() {
 		Expect(response.StatusCode).To(Equal(301))
 		Expect(response.Header.Get("Location")).To(Equal(fmt.Sprintf("https://bosh.io/d/stemcells/bosh-%s-ubuntu-trusty-go_agent", "aws-xen-hvm")))
 	})
+
+	DescribeTable("rejects malformed paths with a problem body", func(path, problemType string) {
+		client := &http.Client{
+			CheckRedirect: func(r *http.Request, ra []*http.Request) error { return http.ErrUseLastResponse },
+		}
+
+		response, err := client.Get(fmt.Sprintf("http://localhost:%d%s", serverPort, path))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusBadRequest))
+		Expect(response.Header.Get("Content-Type")).To(Equal("application/problem+json"))
+
+		var body map[string]interface{}
+		Expect(json.NewDecoder(response.Body).Decode(&body)).To(Succeed())
+		Expect(body["type"]).To(Equal(problemType))
+		Expect(body["status"]).To(BeNumerically("==", http.StatusBadRequest))
+		Expect(body["detail"]).ToNot(BeEmpty())
+	},
+		Entry("query smuggled into the version", "/aws/1.0&foo=bar", "https://boshstemcells.com/problems/invalid-version"),
+		Entry("encoded query in the version", "/aws/1.0%3Ffoo%3Dbar", "https://boshstemcells.com/problems/invalid-version"),
+		Entry("empty version component", "/aws/1..2", "https://boshstemcells.com/problems/invalid-version"),
+		Entry("non-numeric version after a line", "/aws/trusty/abc", "https://boshstemcells.com/problems/invalid-version"),
+		Entry("version in place of a line", "/aws/1.0/2.0", "https://boshstemcells.com/problems/invalid-line"),
+		Entry("encoded characters in the IaaS", "/aw%25s", "https://boshstemcells.com/problems/invalid-iaas"),
+	)
+
+	Describe("unknown names", func() {
+		get := func(path, accept string) (*http.Response, string) {
+			req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", serverPort, path), nil)
+			Expect(err).ToNot(HaveOccurred())
+			if accept != "" {
+				req.Header.Set("Accept", accept)
+			}
+			response, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			body, err := ioutil.ReadAll(response.Body)
+			Expect(err).ToNot(HaveOccurred())
+			return response, string(body)
+		}
+
+		It("suggests the closest IaaS as plain text by default", func() {
+			response, body := get("/vpshere", "")
+			Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+			Expect(response.Header.Get("Content-Type")).To(HavePrefix("text/plain"))
+			Expect(body).To(ContainSubstring("Did you mean vsphere?"))
+			Expect(body).To(ContainSubstring("Valid values are: "))
+			Expect(body).To(ContainSubstring("softlayer"))
+		})
+
+		It("suggests the closest stemcell line as HTML for browsers", func() {
+			response, body := get("/aws/xenail", "text/html,application/xhtml+xml,*/*;q=0.8")
+			Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+			Expect(response.Header.Get("Content-Type")).To(HavePrefix("text/html"))
+			Expect(body).To(ContainSubstring("Did you mean <code>xenial</code>?"))
+		})
+
+		It("suggests the closest stemcell line as problem JSON", func() {
+			response, body := get("/aws/xenail/latest", "application/json")
+			Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+			Expect(response.Header.Get("Content-Type")).To(Equal("application/problem+json"))
+
+			var problem struct {
+				Type        string   `json:"type"`
+				Suggestions []string `json:"suggestions"`
+				Valid       []string `json:"valid"`
+			}
+			Expect(json.Unmarshal([]byte(body), &problem)).To(Succeed())
+			Expect(problem.Type).To(Equal("https://boshstemcells.com/problems/unknown-name"))
+			Expect(problem.Suggestions).To(Equal([]string{"xenial"}))
+			Expect(problem.Valid).To(ContainElement("trusty"))
+		})
+
+		It("lists the valid values when nothing is close", func() {
+			response, body := get("/nonsense", "")
+			Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+			Expect(body).ToNot(ContainSubstring("Did you mean"))
+			Expect(body).To(ContainSubstring("auto"))
+		})
+	})
+
+	DescribeTable("refuses IaaS and stemcell line combinations that are not published", func(path, detail string) {
+		response, err := http.Get(fmt.Sprintf("http://localhost:%d%s", serverPort, path))
+		Expect(err).ToNot(HaveOccurred())
+		body, err := ioutil.ReadAll(response.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+		Expect(string(body)).To(Equal(detail + "\n"))
+	},
+		Entry("windows2012 on softlayer", "/softlayer/windows2012", "windows2012R2 stemcells are not published for softlayer; they are only published for aws, azure, gcp"),
+		Entry("windows on bosh-lite", "/lite/windows/1200.14", "windows2016 stemcells are not published for lite; they are only published for aws, azure, gcp"),
+		Entry("centos on softlayer", "/softlayer/centos", "centos-7 stemcells are not published for softlayer; they are only published for aws, azure, gcp, openstack, vsphere, lite"),
+	)
+
+	DescribeTable("can override the hypervisor and name stemcells directly", func(path, location string) {
+		client := &http.Client{
+			CheckRedirect: func(r *http.Request, ra []*http.Request) error { return http.ErrUseLastResponse },
+		}
+
+		response, err := client.Get(fmt.Sprintf("http://localhost:%d%s", serverPort, path))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(301))
+		Expect(response.Header.Get("Location")).To(Equal(location))
+	},
+		Entry("aws pv", "/aws:xen/trusty", "https://bosh.io/d/stemcells/bosh-aws-xen-ubuntu-trusty-go_agent"),
+		Entry("aws hvm", "/amazon:xen-hvm/xenial/97.28", "https://bosh.io/d/stemcells/bosh-aws-xen-hvm-ubuntu-xenial-go_agent?v=97.28"),
+		Entry("softlayer esxi", "/softlayer:esxi/xenial", "https://bosh.io/d/stemcells/bosh-softlayer-esxi-ubuntu-xenial-go_agent"),
+		Entry("canonical name", "/s/bosh-aws-xen-hvm-ubuntu-xenial-go_agent", "https://bosh.io/d/stemcells/bosh-aws-xen-hvm-ubuntu-xenial-go_agent"),
+		Entry("canonical name with latest", "/s/bosh-aws-xen-hvm-ubuntu-xenial-go_agent/latest", "https://bosh.io/d/stemcells/bosh-aws-xen-hvm-ubuntu-xenial-go_agent"),
+		Entry("canonical raw name with a version", "/s/bosh-openstack-kvm-ubuntu-xenial-go_agent-raw/97.28", "https://bosh.io/d/stemcells/bosh-openstack-kvm-ubuntu-xenial-go_agent-raw?v=97.28"),
+	)
+
+	DescribeTable("rejects unknown hypervisors and stemcell names", func(path, detail string) {
+		response, err := http.Get(fmt.Sprintf("http://localhost:%d%s", serverPort, path))
+		Expect(err).ToNot(HaveOccurred())
+		body, err := ioutil.ReadAll(response.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+		Expect(string(body)).To(ContainSubstring(detail))
+	},
+		Entry("unknown hypervisor", "/aws:kvm/xenial", "Valid values are: xen-hvm, xen"),
+		Entry("misspelt stemcell name", "/s/bosh-aws-xen-hvm-ubuntu-xenail-go_agent", "Did you mean bosh-aws-xen-hvm-ubuntu-xenial-go_agent?"),
+		Entry("unpublished stemcell name", "/s/bosh-softlayer-xen-windows2019-go_agent", "windows2019 stemcells are not published for softlayer"),
+	)
 })
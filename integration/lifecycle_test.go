@@ -0,0 +1,106 @@
+package integration_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Lifecycle", func() {
+	var client *http.Client
+
+	get := func(port int, path, accept string) *http.Response {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", port, path), nil)
+		Expect(err).ToNot(HaveOccurred())
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		response, err := client.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		return response
+	}
+
+	BeforeEach(func() {
+		client = &http.Client{
+			CheckRedirect: func(r *http.Request, ra []*http.Request) error { return http.ErrUseLastResponse },
+		}
+	})
+
+	It("warns about end of life lines in headers", func() {
+		response := get(serverPort, "/aws/trusty", "")
+		Expect(response.StatusCode).To(Equal(301))
+		Expect(response.Header.Get("Deprecation")).To(Equal("@1525046400"))
+		Expect(response.Header.Get("Sunset")).To(Equal("Tue, 30 Apr 2019 00:00:00 GMT"))
+		Expect(response.Header.Get("Warning")).To(ContainSubstring("ubuntu-trusty stemcells reached end of life on 2019-04-30"))
+	})
+
+	It("does not warn about supported lines", func() {
+		response := get(serverPort, "/aws/noble", "")
+		Expect(response.StatusCode).To(Equal(301))
+		Expect(response.Header.Get("Sunset")).To(BeEmpty())
+		Expect(response.Header.Get("Warning")).To(BeEmpty())
+	})
+
+	It("shows browsers a banner before sending them to a deprecated line", func() {
+		response := get(serverPort, "/aws/windows2012/1200.14", "text/html,application/xhtml+xml,*/*;q=0.8")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		body, err := ioutil.ReadAll(response.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(ContainSubstring(`<div class="alert alert-warning" role="alert">windows2012R2 stemcells reached end of life on 2023-10-10`))
+		Expect(string(body)).To(ContainSubstring(`href="https://bosh.io/d/stemcells/bosh-aws-xen-hvm-windows2012R2-go_agent?v=1200.14"`))
+	})
+
+	It("includes the lifecycle in JSON", func() {
+		boshIO.setVersions("bosh-openstack-kvm-ubuntu-trusty-go_agent", "3586.25", "3586.26")
+
+		response := get(serverPort, "/openstack/trusty", "application/json")
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+
+		var resolution struct {
+			Version   string `json:"version"`
+			URL       string `json:"url"`
+			SHA1      string `json:"sha1"`
+			Lifecycle struct {
+				Status    string `json:"status"`
+				EndOfLife string `json:"end_of_life"`
+				Warning   string `json:"warning"`
+			} `json:"lifecycle"`
+		}
+		Expect(json.NewDecoder(response.Body).Decode(&resolution)).To(Succeed())
+		Expect(resolution.Version).To(Equal("3586.26"))
+		Expect(resolution.URL).To(Equal("https://bosh.io/d/stemcells/bosh-openstack-kvm-ubuntu-trusty-go_agent?v=3586.26"))
+		Expect(resolution.SHA1).ToNot(BeEmpty())
+		Expect(resolution.Lifecycle.Status).To(Equal("end-of-life"))
+		Expect(resolution.Lifecycle.EndOfLife).To(Equal("2019-04-30"))
+		Expect(resolution.Lifecycle.Warning).ToNot(BeEmpty())
+	})
+
+	Context("in strict mode", func() {
+		var (
+			strictSession *gexec.Session
+			strictPort    int
+		)
+
+		BeforeEach(func() {
+			strictSession, strictPort = startServer("STRICT_LIFECYCLE=true")
+		})
+
+		AfterEach(func() {
+			strictSession.Kill().Wait()
+		})
+
+		It("refuses end of life lines", func() {
+			Expect(get(strictPort, "/aws/trusty", "").StatusCode).To(Equal(http.StatusGone))
+			Expect(get(strictPort, "/aws/noble", "").StatusCode).To(Equal(301))
+		})
+
+		It("serves the default line", func() {
+			Expect(get(strictPort, "/aws", "").StatusCode).To(Equal(301))
+		})
+	})
+})
@@ -0,0 +1,185 @@
+package integration_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Release notes", func() {
+	const name = "bosh-vsphere-esxi-ubuntu-jammy-go_agent"
+
+	var (
+		github       *httptest.Server
+		mu           sync.Mutex
+		requests     []string
+		dataDir      string
+		notesSession *gexec.Session
+		notesPort    int
+	)
+
+	get := func(path, accept string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", notesPort, path), nil)
+		Expect(err).ToNot(HaveOccurred())
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return resp, body
+	}
+
+	BeforeEach(func() {
+		requests = nil
+		github = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requests = append(requests, r.URL.Path)
+			mu.Unlock()
+
+			switch r.URL.Path {
+			case "/repos/cloudfoundry/bosh-linux-stemcell-builder/releases/tags/ubuntu-jammy/v1.20":
+				w.Write([]byte(`{
+  "tag_name": "ubuntu-jammy/v1.20",
+  "name": "Jammy 1.20",
+  "html_url": "https://github.com/cloudfoundry/bosh-linux-stemcell-builder/releases/tag/ubuntu-jammy/v1.20",
+  "published_at": "2024-03-01T12:00:00Z",
+  "body": "## Fixes\n\n- Bump kernel for USN-6000-1",
+  "body_html": "<h2>Fixes</h2>\n<ul><li>Bump kernel for USN-6000-1</li></ul><script>alert(1)</script><p onclick=\"alert(2)\"><a href=\"javascript:alert(3)\">x</a> <a href=\"https://ubuntu.com/security/notices/USN-6000-1\">USN-6000-1</a></p>"
+}`))
+			case "/repos/cloudfoundry/bosh-linux-stemcell-builder/releases/tags/stable-1.18":
+				w.Write([]byte(`{"tag_name": "stable-1.18", "body": "Older notes <b>unrendered</b>"}`))
+			case "/repos/cloudfoundry/bosh-linux-stemcell-builder/releases/tags/ubuntu-jammy/v1.19":
+				w.WriteHeader(http.StatusInternalServerError)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		boshIO.setVersions(name, "1.17", "1.18", "1.19", "1.20")
+
+		var err error
+		dataDir, err = ioutil.TempDir("", "notes")
+		Expect(err).ToNot(HaveOccurred())
+		notesSession, notesPort = startServer("RELEASE_NOTES_URL="+github.URL, "DATA_DIR="+dataDir)
+	})
+
+	AfterEach(func() {
+		notesSession.Kill().Wait()
+		github.Close()
+		os.RemoveAll(dataDir)
+	})
+
+	It("serves the notes of the latest version as markdown", func() {
+		resp, body := get("/vsphere/jammy/latest/notes", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("text/markdown; charset=utf-8"))
+		Expect(string(body)).To(Equal("## Fixes\n\n- Bump kernel for USN-6000-1"))
+	})
+
+	It("serves the notes as HTML to browsers", func() {
+		resp, body := get("/vsphere/jammy/1.20/notes", "text/html,application/xhtml+xml,*/*;q=0.8")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("text/html; charset=utf-8"))
+		Expect(string(body)).To(ContainSubstring("<h1>Jammy 1.20</h1>"))
+		Expect(string(body)).To(ContainSubstring("<ul><li>Bump kernel for USN-6000-1</li></ul>"))
+	})
+
+	It("strips scripts from notes rendered as HTML", func() {
+		_, body := get("/vsphere/jammy/1.20/notes", "text/html")
+		Expect(string(body)).To(ContainSubstring(`<p><a>x</a> <a href="https://ubuntu.com/security/notices/USN-6000-1">USN-6000-1</a></p>`))
+		Expect(string(body)).ToNot(ContainSubstring("alert"))
+	})
+
+	It("serves the notes as JSON", func() {
+		resp, body := get("/vsphere/jammy/1.20/notes", "application/json")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		var notes struct {
+			Name        string
+			Version     string
+			Title       string
+			URL         string
+			PublishedAt string `json:"published_at"`
+			Markdown    string
+			HTML        string
+		}
+		Expect(json.Unmarshal(body, &notes)).To(Succeed())
+		Expect(notes.Name).To(Equal(name))
+		Expect(notes.Version).To(Equal("1.20"))
+		Expect(notes.Title).To(Equal("Jammy 1.20"))
+		Expect(notes.URL).To(Equal("https://github.com/cloudfoundry/bosh-linux-stemcell-builder/releases/tag/ubuntu-jammy/v1.20"))
+		Expect(notes.PublishedAt).To(Equal("2024-03-01T12:00:00Z"))
+		Expect(notes.Markdown).To(Equal("## Fixes\n\n- Bump kernel for USN-6000-1"))
+		Expect(notes.HTML).ToNot(ContainSubstring("alert"))
+		Expect(notes.HTML).To(ContainSubstring(`<a href="https://ubuntu.com/security/notices/USN-6000-1">USN-6000-1</a>`))
+	})
+
+	It("falls back to the older tag format and escapes notes GitHub did not render", func() {
+		resp, body := get("/vsphere/jammy/1.18/notes", "text/html")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(string(body)).To(ContainSubstring("<h1>stable-1.18</h1>"))
+		Expect(string(body)).To(ContainSubstring("<pre>Older notes &lt;b&gt;unrendered&lt;/b&gt;</pre>"))
+	})
+
+	It("caches notes on disk", func() {
+		resp, _ := get("/vsphere/jammy/1.20/notes", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		notesSession.Kill().Wait()
+		github.Close()
+		notesSession, notesPort = startServer("RELEASE_NOTES_URL="+github.URL, "DATA_DIR="+dataDir)
+
+		resp, body := get("/vsphere/jammy/1.20/notes", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(string(body)).To(Equal("## Fixes\n\n- Bump kernel for USN-6000-1"))
+
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(requests).To(HaveLen(1))
+	})
+
+	It("returns 404 for versions without notes", func() {
+		resp, body := get("/vsphere/jammy/1.17/notes", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		Expect(string(body)).To(Equal(name + " has no release notes for version 1.17\n"))
+	})
+
+	It("remembers versions without notes for a while", func() {
+		resp, _ := get("/vsphere/jammy/1.17/notes", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		resp, _ = get("/vsphere/jammy/1.17/notes", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(requests).To(HaveLen(2))
+	})
+
+	It("does not look up Windows notes in the Linux builder's releases", func() {
+		boshIO.setVersions("bosh-google-kvm-windows2019-go_agent", "2019.20")
+
+		resp, _ := get("/gcp/windows2019/2019.20/notes", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(requests).To(BeEmpty())
+	})
+
+	It("returns 502 when the notes cannot be fetched", func() {
+		resp, _ := get("/vsphere/jammy/1.19/notes", "application/json")
+		Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+	})
+})
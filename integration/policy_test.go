@@ -0,0 +1,122 @@
+package integration_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Policy", func() {
+	const name = "bosh-vsphere-esxi-ubuntu-xenial-go_agent"
+
+	var (
+		policySession *gexec.Session
+		policyPort    int
+		policyDir     string
+		policyPath    string
+		client        *http.Client
+	)
+
+	get := func(path string) *http.Response {
+		response, err := client.Get(fmt.Sprintf("http://localhost:%d%s", policyPort, path))
+		Expect(err).ToNot(HaveOccurred())
+		return response
+	}
+
+	getJSON := func(path string) *http.Response {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d%s", policyPort, path), nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Accept", "application/json")
+		response, err := client.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		return response
+	}
+
+	writePolicy := func(contents string) {
+		Expect(ioutil.WriteFile(policyPath, []byte(contents), 0644)).To(Succeed())
+		later := time.Now().Add(time.Minute)
+		Expect(os.Chtimes(policyPath, later, later)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		policyDir, err = ioutil.TempDir("", "policy")
+		Expect(err).ToNot(HaveOccurred())
+		policyPath = filepath.Join(policyDir, "policy.yml")
+
+		Expect(ioutil.WriteFile(policyPath, []byte(`
+deny_versions:
+- line: xenial
+  version: 97.28
+  reason: known-bad, kernel panics on boot
+  cves: [CVE-2018-1234]
+- version: 96.x
+  reason: superseded
+deny_lines:
+- line: trusty
+  reason: end of life
+allowed_iaases: [vsphere, gcp]
+`), 0644)).To(Succeed())
+
+		client = &http.Client{
+			CheckRedirect: func(r *http.Request, ra []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		boshIO.setVersions(name, "96.1", "96.4", "97.12", "97.28")
+		policySession, policyPort = startServer("POLICY_FILE=" + policyPath)
+	})
+
+	AfterEach(func() {
+		policySession.Kill().Wait()
+		os.RemoveAll(policyDir)
+	})
+
+	It("refuses a denied version with the reason", func() {
+		response := getJSON("/vsphere/xenial/97.28")
+		Expect(response.StatusCode).To(Equal(http.StatusConflict))
+		Expect(response.Header.Get("Content-Type")).To(Equal("application/problem+json"))
+
+		var problem struct {
+			Type   string   `json:"type"`
+			Reason string   `json:"reason"`
+			CVEs   []string `json:"cves"`
+		}
+		Expect(json.NewDecoder(response.Body).Decode(&problem)).To(Succeed())
+		Expect(problem.Type).To(Equal("https://boshstemcells.com/problems/policy-denied"))
+		Expect(problem.Reason).To(Equal("known-bad, kernel panics on boot"))
+		Expect(problem.CVEs).To(Equal([]string{"CVE-2018-1234"}))
+	})
+
+	It("skips denied versions when resolving latest and constraints", func() {
+		response := get("/vsphere/xenial/latest")
+		Expect(response.StatusCode).To(Equal(301))
+		Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/" + name + "?v=97.12"))
+
+		response = get("/vsphere/xenial/previous")
+		Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+
+		response = get("/vsphere/xenial/96.x")
+		Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("refuses denied lines and IaaSes that are not allowed", func() {
+		Expect(get("/vsphere/trusty").StatusCode).To(Equal(http.StatusConflict))
+		Expect(get("/aws/xenial").StatusCode).To(Equal(http.StatusConflict))
+	})
+
+	It("picks up changes to the policy file without a restart", func() {
+		Expect(get("/aws/xenial").StatusCode).To(Equal(http.StatusConflict))
+
+		writePolicy("deny_lines: [{line: bionic}]\n")
+
+		Expect(get("/aws/xenial").StatusCode).To(Equal(301))
+		Expect(get("/aws/bionic").StatusCode).To(Equal(http.StatusConflict))
+	})
+})
@@ -0,0 +1,208 @@
+package integration_test
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Minimum age", func() {
+	const name = "bosh-google-kvm-ubuntu-xenial-go_agent"
+
+	var client *http.Client
+
+	get := func(path string) *http.Response {
+		response, err := client.Get(fmt.Sprintf("http://localhost:%d%s", serverPort, path))
+		Expect(err).ToNot(HaveOccurred())
+		return response
+	}
+
+	BeforeEach(func() {
+		client = &http.Client{
+			CheckRedirect: func(r *http.Request, ra []*http.Request) error { return http.ErrUseLastResponse },
+		}
+
+		boshIO.setVersions(name, "97.10", "97.20", "97.28")
+		boshIO.setPublished(name, "97.10", time.Now().Add(-10*24*time.Hour))
+		boshIO.setPublished(name, "97.20", time.Now().Add(-2*24*time.Hour))
+		boshIO.setPublished(name, "97.28", time.Now().Add(-time.Hour))
+	})
+
+	DescribeTable("resolves latest to the newest version that is old enough", func(path, location string) {
+		response := get(path)
+		Expect(response.StatusCode).To(Equal(301))
+		Expect(response.Header.Get("Location")).To(Equal(location))
+	},
+		Entry("hours", "/gcp/xenial/latest?min-age=72h", "https://bosh.io/d/stemcells/"+name+"?v=97.10"),
+		Entry("days", "/gcp/xenial?min-age=1d", "https://bosh.io/d/stemcells/"+name+"?v=97.20"),
+		Entry("edge", "/gcp/xenial/edge?min-age=30m", "https://bosh.io/d/stemcells/"+name+"?v=97.28"),
+		Entry("no minimum", "/gcp/xenial/latest", "https://bosh.io/d/stemcells/"+name),
+	)
+
+	It("does not apply to explicit versions", func() {
+		response := get("/gcp/xenial/97.28?min-age=72h")
+		Expect(response.StatusCode).To(Equal(301))
+		Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/" + name + "?v=97.28"))
+	})
+
+	It("returns 404 when no version is old enough", func() {
+		Expect(get("/gcp/xenial/latest?min-age=30d").StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("rejects a malformed min-age", func() {
+		Expect(get("/gcp/xenial/latest?min-age=soon").StatusCode).To(Equal(http.StatusBadRequest))
+	})
+
+	It("uses the time a version was first seen when upstream does not date it", func() {
+		const undated = "bosh-google-kvm-ubuntu-bionic-go_agent"
+		boshIO.setVersions(undated, "170.1")
+
+		// A fresh server leaves the versions listed when it starts undated,
+		// which makes them old enough for any minimum age.
+		s, port := startServer()
+		defer s.Kill()
+		get := func(path string) *http.Response {
+			response, err := client.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+			Expect(err).ToNot(HaveOccurred())
+			return response
+		}
+
+		response := get("/gcp/bionic/latest?min-age=1h")
+		Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/" + undated + "?v=170.1"))
+
+		boshIO.setVersions(undated, "170.2", "170.1")
+
+		for _, path := range []string{"/gcp/bionic/latest?min-age=1h", "/gcp/bionic/170.x?min-age=1h"} {
+			response = get(path)
+			Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/"+undated+"?v=170.1"), path)
+		}
+
+		response = get("/gcp/bionic/edge")
+		Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/" + undated + "?v=170.2"))
+
+		time.Sleep(time.Second)
+		for _, path := range []string{"/gcp/bionic/latest?min-age=1s", "/gcp/bionic/170.x?min-age=1s"} {
+			response = get(path)
+			Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/"+undated+"?v=170.2"), path)
+		}
+	})
+})
+
+var _ = Describe("Time travel", func() {
+	const name = "bosh-aws-xen-hvm-ubuntu-trusty-go_agent"
+
+	var client *http.Client
+
+	get := func(path string) *http.Response {
+		response, err := client.Get(fmt.Sprintf("http://localhost:%d%s", serverPort, path))
+		Expect(err).ToNot(HaveOccurred())
+		return response
+	}
+
+	BeforeEach(func() {
+		client = &http.Client{
+			CheckRedirect: func(r *http.Request, ra []*http.Request) error { return http.ErrUseLastResponse },
+		}
+
+		boshIO.setVersions(name, "3586.16", "3586.24", "3586.25")
+		boshIO.setPublished(name, "3586.16", time.Date(2018, 5, 14, 10, 0, 0, 0, time.UTC))
+		boshIO.setPublished(name, "3586.24", time.Date(2018, 6, 1, 18, 0, 0, 0, time.UTC))
+		boshIO.setPublished(name, "3586.25", time.Date(2018, 6, 12, 9, 0, 0, 0, time.UTC))
+	})
+
+	DescribeTable("resolves to what latest was at the time", func(path, version string) {
+		response := get(path)
+		Expect(response.StatusCode).To(Equal(301))
+		Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/" + name + "?v=" + version))
+	},
+		Entry("the end of a date", "/aws/trusty/@2018-06-01", "3586.24"),
+		Entry("a time", "/aws/trusty/@2018-06-01T12:00:00Z", "3586.16"),
+		Entry("a later date", "/aws/trusty/@2018-07-01", "3586.25"),
+		Entry("a date and a minimum age", "/aws/trusty/@2018-06-12?min-age=1d", "3586.24"),
+	)
+
+	It("returns 404 for a date before the first version", func() {
+		Expect(get("/aws/trusty/@2018-01-01").StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("resolves a date before the records of an undated series begin to the versions listed then", func() {
+		const undated = "bosh-aws-xen-hvm-ubuntu-bionic-go_agent"
+		boshIO.setVersions(undated, "170.1")
+
+		s, port := startServer()
+		defer s.Kill()
+		get := func(path string) *http.Response {
+			response, err := client.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+			Expect(err).ToNot(HaveOccurred())
+			return response
+		}
+
+		Expect(get("/aws/bionic/170.x").StatusCode).To(Equal(301))
+		boshIO.setVersions(undated, "170.2", "170.1")
+
+		yesterday := time.Now().Add(-24 * time.Hour).UTC().Format("2006-01-02")
+		response := get("/aws/bionic/@" + yesterday)
+		Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/" + undated + "?v=170.1"))
+	})
+
+	It("rejects a malformed date", func() {
+		Expect(get("/aws/trusty/@last-tuesday").StatusCode).To(Equal(http.StatusBadRequest))
+	})
+})
+
+var _ = Describe("Relative versions", func() {
+	const name = "bosh-azure-hyperv-ubuntu-xenial-go_agent"
+
+	var client *http.Client
+
+	get := func(path string) *http.Response {
+		response, err := client.Get(fmt.Sprintf("http://localhost:%d%s", serverPort, path))
+		Expect(err).ToNot(HaveOccurred())
+		return response
+	}
+
+	BeforeEach(func() {
+		client = &http.Client{
+			CheckRedirect: func(r *http.Request, ra []*http.Request) error { return http.ErrUseLastResponse },
+		}
+
+		boshIO.setVersions(name, "97.10", "250.1", "97.28", "97.12", "250.3")
+	})
+
+	DescribeTable("walks backward through the sorted versions", func(path, version string) {
+		response := get(path)
+		Expect(response.StatusCode).To(Equal(301))
+		Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/" + name + "?v=" + version))
+	},
+		Entry("previous", "/azure/xenial/previous", "250.1"),
+		Entry("latest~2", "/azure/xenial/latest~2", "97.28"),
+		Entry("n-2", "/azure/xenial/n-2", "97.28"),
+		Entry("a constraint", "/azure/xenial/97.x", "97.28"),
+		Entry("a constraint~1", "/azure/xenial/97.x~1", "97.12"),
+		Entry("a version~1", "/azure/xenial/97.28~1", "97.12"),
+	)
+
+	DescribeTable("returns 404 when there are not enough versions", func(path string) {
+		Expect(get(path).StatusCode).To(Equal(http.StatusNotFound))
+	},
+		Entry("too far back", "/azure/xenial/latest~5"),
+		Entry("no matching constraint", "/azure/xenial/98.x"),
+		Entry("unknown anchor", "/azure/xenial/99.1~1"),
+	)
+
+	It("walks back through the default line when the path does not name one", func() {
+		boshIO.setVersions("bosh-azure-hyperv-ubuntu-noble-go_agent", "1.10", "1.28", "1.12")
+
+		response := get("/azure/previous")
+		Expect(response.StatusCode).To(Equal(301))
+		Expect(response.Header.Get("Location")).To(Equal("https://bosh.io/d/stemcells/bosh-azure-hyperv-ubuntu-noble-go_agent?v=1.12"))
+	})
+
+	It("rejects a malformed offset", func() {
+		Expect(get("/azure/xenial/latest~two").StatusCode).To(Equal(http.StatusBadRequest))
+	})
+})
@@ -0,0 +1,152 @@
+package integration_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SBOMs", func() {
+	const name = "bosh-google-kvm-ubuntu-noble-go_agent"
+
+	get := func(path string, v interface{}) *http.Response {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s", serverPort, path))
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+
+		if v != nil {
+			Expect(json.NewDecoder(resp.Body).Decode(v)).To(Succeed())
+		}
+		return resp
+	}
+
+	BeforeEach(func() {
+		boshIO.setVersions(name, "1.50")
+		boshIO.setPackages(name, "1.50",
+			"bash=5.2.21-2ubuntu4",
+			"libstdc++6=14-20240412-0ubuntu1",
+			"openssh-server=1:9.6p1-3ubuntu13.5",
+		)
+	})
+
+	It("serves a CycloneDX BOM", func() {
+		var bom struct {
+			BOMFormat    string
+			SpecVersion  string
+			SerialNumber string
+			Metadata     struct {
+				Component struct {
+					Type, Name, Version string
+					Hashes              []struct{ Alg, Content string }
+				}
+			}
+			Components []struct {
+				Type, Name, Version, PURL string
+			}
+		}
+		resp := get("/sbom/gcp/noble/1.50.cdx.json", &bom)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/vnd.cyclonedx+json"))
+
+		Expect(bom.BOMFormat).To(Equal("CycloneDX"))
+		Expect(bom.SpecVersion).To(Equal("1.5"))
+		Expect(bom.SerialNumber).To(MatchRegexp(`^urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-8[0-9a-f]{3}-[0-9a-f]{12}$`))
+		Expect(bom.SerialNumber).ToNot(HavePrefix("urn:uuid:00000000-0000"))
+		Expect(bom.Metadata.Component.Type).To(Equal("operating-system"))
+		Expect(bom.Metadata.Component.Name).To(Equal(name))
+		Expect(bom.Metadata.Component.Version).To(Equal("1.50"))
+		Expect(bom.Metadata.Component.Hashes[0].Content).To(Equal(strings.Repeat("a", 40)))
+
+		type component struct{ Type, Name, Version, PURL string }
+		var components []component
+		for _, c := range bom.Components {
+			components = append(components, component(c))
+		}
+		Expect(components).To(Equal([]component{
+			{"operating-system", "ubuntu", "24.04", ""},
+			{"library", "bash", "5.2.21-2ubuntu4", "pkg:deb/ubuntu/bash@5.2.21-2ubuntu4?arch=amd64&distro=noble"},
+			{"library", "libstdc++6", "14-20240412-0ubuntu1", "pkg:deb/ubuntu/libstdc%2B%2B6@14-20240412-0ubuntu1?arch=amd64&distro=noble"},
+			{"library", "openssh-server", "1:9.6p1-3ubuntu13.5", "pkg:deb/ubuntu/openssh-server@1%3A9.6p1-3ubuntu13.5?arch=amd64&distro=noble"},
+		}))
+	})
+
+	It("serves an SPDX document", func() {
+		var doc struct {
+			SPDXVersion string
+			Name        string
+			Packages    []struct {
+				SPDXID           string
+				Name             string
+				VersionInfo      string
+				DownloadLocation string
+				ExternalRefs     []struct {
+					ReferenceType    string
+					ReferenceLocator string
+				}
+			}
+			Relationships []struct {
+				SPDXElementID      string
+				RelationshipType   string
+				RelatedSPDXElement string
+			}
+		}
+		resp := get("/sbom/gcp/noble/latest.spdx.json", &doc)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/spdx+json"))
+
+		Expect(doc.SPDXVersion).To(Equal("SPDX-2.3"))
+		Expect(doc.Name).To(Equal(name + "-1.50"))
+		Expect(doc.Packages).To(HaveLen(4))
+		Expect(doc.Packages[0].SPDXID).To(Equal("SPDXRef-Stemcell"))
+		Expect(doc.Packages[0].DownloadLocation).To(Equal(boshIO.server.URL + "/tarballs/" + name + "-1.50.tgz"))
+		Expect(doc.Packages[3].Name).To(Equal("openssh-server"))
+		Expect(doc.Packages[3].VersionInfo).To(Equal("1:9.6p1-3ubuntu13.5"))
+		Expect(doc.Packages[3].ExternalRefs[0].ReferenceType).To(Equal("purl"))
+		Expect(doc.Packages[3].ExternalRefs[0].ReferenceLocator).To(Equal("pkg:deb/ubuntu/openssh-server@1%3A9.6p1-3ubuntu13.5?arch=amd64&distro=noble"))
+
+		Expect(doc.Relationships).To(HaveLen(4))
+		Expect(doc.Relationships[0].RelationshipType).To(Equal("DESCRIBES"))
+		Expect(doc.Relationships[3].RelationshipType).To(Equal("CONTAINS"))
+		Expect(doc.Relationships[3].RelatedSPDXElement).To(Equal(doc.Packages[3].SPDXID))
+	})
+
+	It("is built from the package list without downloading the tarball", func() {
+		Expect(get("/sbom/gcp/noble/1.50.cdx.json", nil).StatusCode).To(Equal(http.StatusOK))
+		Expect(boshIO.downloadCount("/tarballs/" + name + "-1.50.tgz")).To(Equal(0))
+	})
+
+	It("gives each version its own serial number, even without a sha1", func() {
+		boshIO.setVersions(name, "1.51", "1.50")
+		boshIO.setPackages(name, "1.51", "bash=5.2.21-2ubuntu4")
+		boshIO.setPackages(name, "1.50", "bash=5.2.21-2ubuntu4")
+		boshIO.mu.Lock()
+		for _, v := range boshIO.stemcells[name] {
+			v["regular"].(map[string]interface{})["sha1"] = ""
+		}
+		boshIO.mu.Unlock()
+
+		serials := map[string]bool{}
+		for _, version := range []string{"1.50", "1.51", "1.50"} {
+			var bom struct{ SerialNumber string }
+			Expect(get("/sbom/gcp/noble/"+version+".cdx.json", &bom).StatusCode).To(Equal(http.StatusOK))
+			Expect(bom.SerialNumber).ToNot(HavePrefix("urn:uuid:00000000-0000"))
+			serials[bom.SerialNumber] = true
+		}
+		Expect(serials).To(HaveLen(2))
+	})
+
+	It("returns 404 for versions without a package list", func() {
+		boshIO.setVersions(name, "1.52", "1.50")
+		boshIO.setTarball(name, "1.52", false, []byte("full stemcell"))
+		Expect(get("/sbom/gcp/noble/1.52.cdx.json", nil).StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("does not serve other formats", func() {
+		resp := get("/sbom/gcp/noble/1.50.xml", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+	})
+})
@@ -0,0 +1,311 @@
+package integration_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
+)
+
+var _ = Describe("Webhooks", func() {
+	const name = "bosh-openstack-kvm-ubuntu-jammy-go_agent"
+
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+
+	var (
+		webhookSession *gexec.Session
+		webhookPort    int
+		receiver       *httptest.Server
+
+		mu       sync.Mutex
+		calls    []received
+		failures int
+	)
+
+	request := func(method, path, token, body string) (*http.Response, string) {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", webhookPort, path), strings.NewReader(body))
+		Expect(err).ToNot(HaveOccurred())
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		data, err := ioutil.ReadAll(response.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return response, string(data)
+	}
+
+	delivered := func() []received {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]received{}, calls...)
+	}
+
+	subscribe := func(body string) map[string]interface{} {
+		response, data := request("POST", "/api/v1/webhooks", "secret", body)
+		Expect(response.StatusCode).To(Equal(http.StatusCreated))
+		var h map[string]interface{}
+		Expect(json.Unmarshal([]byte(data), &h)).To(Succeed())
+		return h
+	}
+
+	publish := func(versions ...string) {
+		boshIO.setVersions(name, versions...)
+		boshIO.setPublished(name, "1.1", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	}
+
+	// restart replaces the server with one started with env. It waits for a
+	// second poll, so that the first has finished recording what it saw.
+	restart := func(env ...string) {
+		webhookSession.Kill().Wait()
+
+		lookups := boshIO.lookupCount(name)
+		webhookSession, webhookPort = startServer(append([]string{"ADMIN_TOKEN=secret", "POLL_INTERVAL=100ms"}, env...)...)
+		Eventually(func() int { return boshIO.lookupCount(name) }).Should(BeNumerically(">", lookups+1))
+	}
+
+	type deliveryRecord struct {
+		Version  string        `json:"version"`
+		Status   string        `json:"status"`
+		Attempts []interface{} `json:"attempts"`
+	}
+
+	deliveriesOf := func(h map[string]interface{}) []deliveryRecord {
+		_, body := request("GET", "/api/v1/webhooks/"+h["id"].(string)+"/deliveries", "secret", "")
+		var deliveries []deliveryRecord
+		Expect(json.Unmarshal([]byte(body), &deliveries)).To(Succeed())
+		return deliveries
+	}
+
+	BeforeEach(func() {
+		mu.Lock()
+		calls, failures = nil, 0
+		mu.Unlock()
+
+		receiver = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, received{r.Header, body})
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+
+		publish("1.1")
+		lookups := boshIO.lookupCount(name)
+		webhookSession, webhookPort = startServer("ADMIN_TOKEN=secret", "POLL_INTERVAL=100ms", "WEBHOOK_RETRY_BACKOFF=50ms")
+
+		// Wait for the first poll so that later versions are new.
+		Eventually(func() int { return boshIO.lookupCount(name) }).Should(BeNumerically(">", lookups))
+	})
+
+	AfterEach(func() {
+		webhookSession.Kill().Wait()
+		receiver.Close()
+	})
+
+	It("requires the admin token", func() {
+		response, _ := request("POST", "/api/v1/webhooks", "", `{"url": "`+receiver.URL+`"}`)
+		Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		response, _ = request("GET", "/api/v1/webhooks", "wrong", "")
+		Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("POSTs a signed payload when a matching version appears", func() {
+		h := subscribe(`{"url": "` + receiver.URL + `", "iaas": "openstack", "line": "jammy", "secret": "shh"}`)
+		Expect(h["secret"]).To(Equal("shh"))
+
+		publish("1.1", "1.2")
+
+		Eventually(delivered).Should(HaveLen(1))
+		call := delivered()[0]
+		Expect(call.header.Get("X-BoshStemcells-Event")).To(Equal("stemcell.published"))
+
+		mac := hmac.New(sha256.New, []byte("shh"))
+		mac.Write(call.body)
+		Expect(call.header.Get("X-BoshStemcells-Signature")).To(Equal("sha256=" + hex.EncodeToString(mac.Sum(nil))))
+
+		var payload struct {
+			Webhook  string `json:"webhook"`
+			Stemcell struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+				SHA1    string `json:"sha1"`
+			} `json:"stemcell"`
+		}
+		Expect(json.Unmarshal(call.body, &payload)).To(Succeed())
+		Expect(payload.Webhook).To(Equal(h["id"]))
+		Expect(payload.Stemcell.Name).To(Equal(name))
+		Expect(payload.Stemcell.Version).To(Equal("1.2"))
+		Expect(payload.Stemcell.SHA1).To(Equal(strings.Repeat("a", 40)))
+
+		Consistently(delivered, "300ms").Should(HaveLen(1))
+	})
+
+	It("only notifies webhooks whose filters match", func() {
+		subscribe(`{"url": "` + receiver.URL + `", "line": "xenial"}`)
+		subscribe(`{"url": "` + receiver.URL + `", "iaas": "aws"}`)
+		subscribe(`{"url": "` + receiver.URL + `", "iaas": "openstack", "constraint": "2.x"}`)
+
+		publish("1.1", "1.2")
+		Consistently(delivered, "500ms").Should(BeEmpty())
+
+		publish("1.1", "1.2", "2.1")
+		Eventually(delivered).Should(HaveLen(1))
+	})
+
+	It("retries failed deliveries with backoff and records them", func() {
+		h := subscribe(`{"url": "` + receiver.URL + `", "line": "jammy"}`)
+		mu.Lock()
+		failures = 2
+		mu.Unlock()
+
+		publish("1.1", "1.2")
+		Eventually(delivered, "2s").Should(HaveLen(3))
+
+		var deliveries []struct {
+			Version  string `json:"version"`
+			Status   string `json:"status"`
+			Attempts []struct {
+				StatusCode int `json:"status_code"`
+			} `json:"attempts"`
+		}
+		Eventually(func() string {
+			_, body := request("GET", "/api/v1/webhooks/"+h["id"].(string)+"/deliveries", "secret", "")
+			Expect(json.Unmarshal([]byte(body), &deliveries)).To(Succeed())
+			if len(deliveries) == 0 {
+				return ""
+			}
+			return deliveries[0].Status
+		}).Should(Equal("delivered"))
+		Expect(deliveries[0].Version).To(Equal("1.2"))
+		Expect(deliveries[0].Attempts).To(HaveLen(3))
+		Expect(deliveries[0].Attempts[0].StatusCode).To(Equal(http.StatusServiceUnavailable))
+		Expect(deliveries[0].Attempts[2].StatusCode).To(Equal(http.StatusOK))
+	})
+
+	Context("with a data directory", func() {
+		var dataDir string
+
+		BeforeEach(func() {
+			var err error
+			dataDir, err = ioutil.TempDir("", "webhooks")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dataDir)
+		})
+
+		It("resumes pending deliveries after a restart", func() {
+			restart("DATA_DIR="+dataDir, "WEBHOOK_RETRY_BACKOFF=1h")
+			h := subscribe(`{"url": "` + receiver.URL + `", "line": "jammy"}`)
+			mu.Lock()
+			failures = 1
+			mu.Unlock()
+
+			publish("1.1", "1.2")
+			Eventually(func() int {
+				deliveries := deliveriesOf(h)
+				if len(deliveries) == 0 {
+					return 0
+				}
+				return len(deliveries[0].Attempts)
+			}).Should(Equal(1))
+			Expect(delivered()).To(HaveLen(1))
+
+			restart("DATA_DIR="+dataDir, "WEBHOOK_RETRY_BACKOFF=50ms")
+			Eventually(delivered).Should(HaveLen(2))
+			Consistently(delivered, "300ms").Should(HaveLen(2))
+
+			deliveries := deliveriesOf(h)
+			Expect(deliveries).To(HaveLen(1))
+			Expect(deliveries[0].Version).To(Equal("1.2"))
+			Expect(deliveries[0].Status).To(Equal("delivered"))
+			Expect(deliveries[0].Attempts).To(HaveLen(2))
+		})
+
+		It("notifies versions published while it was down", func() {
+			restart("DATA_DIR=" + dataDir)
+			subscribe(`{"url": "` + receiver.URL + `", "line": "jammy"}`)
+
+			webhookSession.Kill().Wait()
+			publish("1.1", "1.2")
+			restart("DATA_DIR=" + dataDir)
+
+			Eventually(delivered).Should(HaveLen(1))
+			Expect(string(delivered()[0].body)).To(ContainSubstring(`"version":"1.2"`))
+		})
+	})
+
+	It("does not notify a version when the policy stops denying it", func() {
+		policyDir, err := ioutil.TempDir("", "policy")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(policyDir)
+		policyPath := filepath.Join(policyDir, "policy.yml")
+		Expect(ioutil.WriteFile(policyPath, []byte("deny_versions: [{line: jammy, version: 1.2}]\n"), 0644)).To(Succeed())
+
+		restart("POLICY_FILE=" + policyPath)
+		subscribe(`{"url": "` + receiver.URL + `", "line": "jammy"}`)
+
+		publish("1.1", "1.2")
+		Consistently(delivered, "300ms").Should(BeEmpty())
+
+		Expect(ioutil.WriteFile(policyPath, []byte("deny_versions: []\n"), 0644)).To(Succeed())
+		later := time.Now().Add(time.Minute)
+		Expect(os.Chtimes(policyPath, later, later)).To(Succeed())
+		Consistently(delivered, "300ms").Should(BeEmpty())
+
+		publish("1.1", "1.2", "1.3")
+		Eventually(delivered).Should(HaveLen(1))
+		Expect(string(delivered()[0].body)).To(ContainSubstring(`"version":"1.3"`))
+	})
+
+	It("lists webhooks without their secrets and deletes them", func() {
+		h := subscribe(`{"url": "` + receiver.URL + `"}`)
+		Expect(h["secret"]).To(HaveLen(64))
+
+		_, body := request("GET", "/api/v1/webhooks", "secret", "")
+		Expect(body).To(ContainSubstring(h["id"].(string)))
+		Expect(body).ToNot(ContainSubstring(h["secret"].(string)))
+
+		response, _ := request("DELETE", "/api/v1/webhooks/"+h["id"].(string), "secret", "")
+		Expect(response.StatusCode).To(Equal(http.StatusNoContent))
+
+		response, _ = request("GET", "/api/v1/webhooks/"+h["id"].(string), "secret", "")
+		Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("rejects invalid subscriptions", func() {
+		response, body := request("POST", "/api/v1/webhooks", "secret", `{"url": "ftp://example.com"}`)
+		Expect(response.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+		Expect(body).To(ContainSubstring("not a valid http or https URL"))
+
+		response, body = request("POST", "/api/v1/webhooks", "secret", `{"url": "`+receiver.URL+`", "line": "jamy"}`)
+		Expect(response.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+		Expect(body).To(ContainSubstring(`unknown stemcell line \"jamy\"`))
+
+		response, _ = request("POST", "/api/v1/webhooks", "secret", `{"url": "`+receiver.URL+`", "constraint": "latest"}`)
+		Expect(response.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+	})
+})
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+)
+
+const problemEndOfLife = "https://boshstemcells.com/problems/end-of-life"
+
+// strictLifecycle refuses to serve lines that have reached end of life.
+var strictLifecycle bool
+
+// endOfLifeError is returned in strict mode for lines past end of life.
+type endOfLifeError struct {
+	line string
+	eol  time.Time
+}
+
+func (e *endOfLifeError) Error() string {
+	return fmt.Sprintf("%s stemcells reached end of life on %s and are no longer served", e.line, e.eol.Format("2006-01-02"))
+}
+
+// checkLifecycle returns an error in strict mode if the line has reached end
+// of life.
+func checkLifecycle(line string, now time.Time) error {
+	l := stemcells.LineLifecycle(line)
+	if strictLifecycle && l.Status(now) == stemcells.StatusEndOfLife {
+		return &endOfLifeError{line: line, eol: l.EOL}
+	}
+	return nil
+}
+
+// setLifecycleHeaders adds RFC 9745 Deprecation, RFC 8594 Sunset and Warning
+// headers to responses for deprecated and end of life lines.
+func setLifecycleHeaders(w http.ResponseWriter, line string, now time.Time) {
+	l := stemcells.LineLifecycle(line)
+	if l.Status(now) == stemcells.StatusSupported {
+		return
+	}
+
+	w.Header().Set("Deprecation", fmt.Sprintf("@%d", l.Deprecated.Unix()))
+	w.Header().Set("Sunset", l.EOL.Format(http.TimeFormat))
+	w.Header().Set("Warning", fmt.Sprintf("299 - %q", l.Warning(line, now)))
+}
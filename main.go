@@ -3,63 +3,235 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"code.benchapman.ie/boshstemcells/stemcells"
 	"github.com/gorilla/mux"
 	"github.com/zaccone/spf"
 )
 
 func main() {
+	if name := os.Getenv("DEFAULT_STEMCELL_LINE"); name != "" {
+		line, ok := stemcells.CanonicalLine(name)
+		if !ok {
+			log.Fatalf("DEFAULT_STEMCELL_LINE %q is not a known stemcell line", name)
+		}
+		defaultLine = line
+	}
+
+	dataDir = os.Getenv("DATA_DIR")
+	adminToken = os.Getenv("ADMIN_TOKEN")
+
+	var err error
+	aliases, err = newAliasStore(newFileStore("aliases.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	channels, err = newChannelStore(newFileStore("channels.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	inspections = newInspectionStore()
+	downloadDir := ""
+	if dataDir != "" {
+		downloadDir = filepath.Join(dataDir, "tarballs")
+	}
+	downloads, err = newTarballDownloader(downloadDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if size := os.Getenv("MAX_TARBALL_SIZE"); size != "" {
+		maxTarballSize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			log.Fatalf("MAX_TARBALL_SIZE: %s", err)
+		}
+	}
+
+	releaseNotesCache, err = newReleaseNotesStore(newFileStore("release-notes.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	releaseNotesURL := "https://api.github.com"
+	if u := os.Getenv("RELEASE_NOTES_URL"); u != "" {
+		releaseNotesURL = u
+	}
+	releaseNotesRepo := "cloudfoundry/bosh-linux-stemcell-builder"
+	if repo := os.Getenv("RELEASE_NOTES_REPO"); repo != "" {
+		releaseNotesRepo = repo
+	}
+	notesSource = newGitHubReleases(releaseNotesURL, releaseNotesRepo, os.Getenv("RELEASE_NOTES_WINDOWS_REPO"), os.Getenv("GITHUB_TOKEN"))
+
+	if soak := os.Getenv("STABLE_SOAK_TIME"); soak != "" {
+		stableSoakTime, err = time.ParseDuration(soak)
+		if err != nil {
+			log.Fatalf("STABLE_SOAK_TIME: %s", err)
+		}
+	}
+
+	if ttl := os.Getenv("UPSTREAM_CACHE_TTL"); ttl != "" {
+		upstreamCacheTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("UPSTREAM_CACHE_TTL: %s", err)
+		}
+	}
+
+	boshIOAPIURL := "https://bosh.io"
+	if u := os.Getenv("BOSH_IO_API_URL"); u != "" {
+		boshIOAPIURL = u
+	}
+	publishDates, err = newPublishDateStore(newFileStore("published.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	recorded := recordingUpstream{stemcells.NewBoshIO(boshIOAPIURL, upstreamCacheTTL), publishDates}
+	source = policyUpstream{recorded}
+
+	strictLifecycle = os.Getenv("STRICT_LIFECYCLE") == "true"
+
+	if interval := os.Getenv("POLL_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalf("POLL_INTERVAL: %s", err)
+		}
+		stemcellPoller = newPoller(d, recorded, publishDates.seen())
+	}
+
+	webhooks, err = newWebhookStore(newFileStore("webhooks.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if backoff := os.Getenv("WEBHOOK_RETRY_BACKOFF"); backoff != "" {
+		webhookBackoff, err = time.ParseDuration(backoff)
+		if err != nil {
+			log.Fatalf("WEBHOOK_RETRY_BACKOFF: %s", err)
+		}
+	}
+
+	if path := os.Getenv("POLICY_FILE"); path != "" {
+		stemcellPolicy, err = newPolicyFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	webhooks.resume()
+	if stemcellPoller != nil {
+		stemcellPoller.subscribe(webhooks.notify)
+		go stemcellPoller.run()
+	}
+
+	if dir := os.Getenv("ADVISORIES_DIR"); dir != "" {
+		advisories, err = newAdvisoryDatabase(dir)
+		if err != nil {
+			log.Fatalf("ADVISORIES_DIR: %s", err)
+		}
+	}
+
+	if directorURL := os.Getenv("BOSH_DIRECTOR_URL"); directorURL != "" {
+		var caCert []byte
+		if path := os.Getenv("BOSH_CA_CERT"); path != "" {
+			caCert, err = ioutil.ReadFile(path)
+			if err != nil {
+				log.Fatalf("BOSH_CA_CERT: %s", err)
+			}
+		}
+		director, err := newDirectorClient(directorURL, os.Getenv("BOSH_UAA_URL"), os.Getenv("BOSH_CLIENT"), os.Getenv("BOSH_CLIENT_SECRET"), caCert)
+		if err != nil {
+			log.Fatalf("BOSH director %s: %s", directorURL, err)
+		}
+
+		target := "latest"
+		if t := os.Getenv("DRIFT_TARGET"); t != "" {
+			target = t
+		}
+		interval := 10 * time.Minute
+		if i := os.Getenv("DRIFT_INTERVAL"); i != "" {
+			interval, err = time.ParseDuration(i)
+			if err != nil {
+				log.Fatalf("DRIFT_INTERVAL: %s", err)
+			}
+		}
+		directorDrift, err = newDriftMonitor(director, target, interval)
+		if err != nil {
+			log.Fatalf("DRIFT_TARGET: %s", err)
+		}
+		go directorDrift.run()
+	}
+
+	if age := os.Getenv("DEFAULT_MIN_AGE"); age != "" {
+		defaultMinAge, err = parseMinAge(age)
+		if err != nil {
+			log.Fatalf("DEFAULT_MIN_AGE: %s", err)
+		}
+	}
+
 	r := mux.NewRouter()
 	r.Handle("/bootstrap.min.css", http.FileServer(http.Dir("./static/")))
+	r.HandleFunc("/api/v1/aliases", handleListAliases).Methods("GET")
+	r.HandleFunc("/api/v1/aliases", requireAdmin(handleCreateAlias)).Methods("POST")
+	r.HandleFunc("/api/v1/aliases/{alias:.+}", handleGetAlias).Methods("GET")
+	r.HandleFunc("/api/v1/aliases/{alias:.+}", requireAdmin(handlePutAlias)).Methods("PUT")
+	r.HandleFunc("/api/v1/aliases/{alias:.+}", requireAdmin(handleDeleteAlias)).Methods("DELETE")
+	r.HandleFunc("/api/v1/channels/{line}", handleGetChannels).Methods("GET")
+	r.HandleFunc("/api/v1/channels/{line}/candidate", requireAdmin(handlePromoteCandidate)).Methods("POST")
+	r.HandleFunc("/api/v1/drift", requireAdmin(handleDrift)).Methods("GET")
+	r.HandleFunc("/api/v1/inspect", requireAdmin(handleInspectUpload)).Methods("POST")
+	r.HandleFunc("/api/v1/inspect/{iaas}/{line}/{version}", handleInspectStemcell).Methods("GET")
+	r.HandleFunc("/api/v1/resolve", handleResolveBatch).Methods("POST")
+	r.HandleFunc("/api/v1/versions/{iaas}/{line}", handleListVersions).Methods("GET")
+	r.HandleFunc("/api/v1/webhooks", requireAdmin(handleListWebhooks)).Methods("GET")
+	r.HandleFunc("/api/v1/webhooks", requireAdmin(handleCreateWebhook)).Methods("POST")
+	r.HandleFunc("/api/v1/webhooks/{id}", requireAdmin(handleGetWebhook)).Methods("GET")
+	r.HandleFunc("/api/v1/webhooks/{id}", requireAdmin(handleDeleteWebhook)).Methods("DELETE")
+	r.HandleFunc("/api/v1/webhooks/{id}/deliveries", requireAdmin(handleListDeliveries)).Methods("GET")
+	r.HandleFunc("/advisories/{iaas}/{line}/{version}", handleAdvisories)
+	r.HandleFunc("/calendar.ics", handleCalendar)
+	r.HandleFunc("/diff/{iaas}/{line}/{from}/{to}", handleDiff)
+	r.HandleFunc("/feeds/all.{format:atom|rss}", handleAllFeed)
+	r.HandleFunc("/feeds/{iaas}/{line:[^/.]+}.{format:atom|rss}", handleStemcellFeed)
+	r.HandleFunc("/metrics", requireAdmin(handleMetrics))
+	r.HandleFunc("/p/{alias:.+}", handleAlias)
+	r.HandleFunc("/sbom/{iaas}/{line}/{version:[^/]+}.{format:cdx|spdx}.json", handleSBOM)
+	r.HandleFunc("/s/{name}", handleStemcellName)
+	r.HandleFunc("/s/{name}/{version}", handleStemcellName)
 	r.HandleFunc("/{iaas}", handleRequest)
 	r.HandleFunc("/{iaas}/{versionOrLine}", handleRequest)
 	r.HandleFunc("/{iaas}/{versionOrLine}/{version}", handleRequest)
+	r.HandleFunc("/{iaas}/{line}/{version}/notes", handleReleaseNotes)
 	r.Handle("/", http.FileServer(http.Dir("./static/")))
 
-	err := http.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("PORT")), r)
+	err = http.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("PORT")), r)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
 func handleRequest(w http.ResponseWriter, r *http.Request) {
-	var iaas, version string
-
-	var line = "ubuntu-xenial"
+	serveStemcellPath(w, r, mux.Vars(r))
+}
 
-	vars := mux.Vars(r)
-	iaasString, ok := vars["iaas"]
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
+// serveStemcellPath serves the stemcell named by the variables of a
+// /{iaas}[/{line}][/{version}] path.
+func serveStemcellPath(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	req, err := parseStemcellPath(vars)
+	if err != nil {
+		writePathError(w, r, err)
 		return
 	}
+	iaasString := req.iaas
 
-	versionOrLineString, ok := vars["versionOrLine"]
-	if ok {
-		if ok, lineVar := isLineVariable(vars["versionOrLine"]); ok {
-			line = lineVar
-		} else {
-			if versionOrLineString != "latest" {
-				version = fmt.Sprintf("?v=%s", versionOrLineString)
-			}
-		}
-	}
-
-	versionString, ok := vars["version"]
-	if ok {
-		if versionString != "latest" {
-			version = fmt.Sprintf("?v=%s", versionString)
-		}
-	}
-
-	if iaasString == "auto" {
+	if name, hypervisor := stemcells.SplitHypervisor(iaasString); name == "auto" {
 		xff := r.Header.Get("X-Forwarded-For")
 		splitXff := strings.Split(xff, ", ")
 		source, err := autodetectSource(net.ParseIP(splitXff[0]))
@@ -69,48 +241,108 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		iaasString = source
+		if hypervisor != "" {
+			iaasString += stemcells.HypervisorSeparator + hypervisor
+		}
 	}
 
-	switch iaasString {
-	case "aws", "amazon":
-		iaas = "aws-xen-hvm"
-	case "azure":
-		iaas = "azure-hyperv"
-	case "gcp", "google":
-		iaas = "google-kvm"
-	case "openstack":
-		iaas = "openstack-kvm"
-	case "softlayer":
-		iaas = "softlayer-xen"
-	case "vsphere":
-		iaas = "vsphere-esxi"
-	case "vcloud":
-		iaas = "vcloud-esxi"
-	case "lite", "boshlite":
-		iaas = "warden-boshlite"
-	default:
-		w.WriteHeader(http.StatusNotFound)
+	infrastructure, hypervisor, err := lookupIaaS(iaasString)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	serveStemcell(w, r, stemcells.Series{Infrastructure: infrastructure, Hypervisor: hypervisor, Line: req.line, Raw: req.raw}, req.version)
+}
+
+func handleStemcellName(w http.ResponseWriter, r *http.Request) {
+	s, selector, err := parseStemcellNamePath(mux.Vars(r))
+	if err != nil {
+		writePathError(w, r, err)
 		return
 	}
 
-	http.Redirect(w, r, fmt.Sprintf("https://bosh.io/d/stemcells/bosh-%s-%s-go_agent%s", iaas, line, version), 301)
+	serveStemcell(w, r, s, selector)
+}
+
+// serveStemcell redirects to the selected version of a stemcell series on
+// bosh.io.
+func serveStemcell(w http.ResponseWriter, r *http.Request, s stemcells.Series, selector stemcells.Selector) {
+	version, err := resolveStemcell(r, s, selector)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	writeStemcell(w, r, s, version)
+}
+
+// resolveStemcell returns the version of a stemcell series that a request
+// selects, checking that the series is published and that the policy and
+// lifecycle allow serving it. An empty version lets bosh.io pick the latest.
+func resolveStemcell(r *http.Request, s stemcells.Series, selector stemcells.Selector) (string, error) {
+	return resolveStemcellIn(source, s, selector, r.URL.Query())
 }
 
-func isLineVariable(line string) (bool, string) {
-	switch line {
-	case "trusty", "ubuntu-trusty", "ubuntutrusty", "t":
-		return true, "ubuntu-trusty"
-	case "xenial", "ubuntu-xenial", "ubuntuxenial", "ubuntu", "x":
-		return true, "ubuntu-xenial"
-	case "windows", "windows2016", "windows16":
-		return true, "windows2016"
-	case "windows2012", "windows12":
-		return true, "windows2012R2"
-	case "centos", "centos7", "centos-7":
-		return true, "centos-7"
-	default:
-		return false, ""
+// resolveStemcellIn is resolveStemcell against upstream, with the min-age and
+// free-of parameters given in params.
+func resolveStemcellIn(upstream stemcells.Upstream, s stemcells.Series, selector stemcells.Selector, params url.Values) (string, error) {
+	if err := stemcells.CheckPublished(s, stemcells.AnyFlavor); err != nil {
+		return "", err
+	}
+
+	p := stemcellPolicy.get()
+	if err := p.checkStemcell(s); err != nil {
+		return "", err
+	}
+
+	if err := checkLifecycle(s.Line, time.Now()); err != nil {
+		return "", err
+	}
+
+	minAge, err := parseMinAge(params.Get("min-age"))
+	if err != nil {
+		return "", err
+	}
+	selector.MinAge = minAge
+
+	version, err := resolverFor(upstream).Resolve(s, selector)
+	if err == nil && version == "" && p.deniesVersionsOf(s.Line) {
+		version, err = newestVersionIn(upstream, s, 0)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if id := params.Get("free-of"); id != "" {
+		if selector.Version != "" || selector.Channel != "" || !selector.At.IsZero() || selector.Offset > 0 {
+			return "", &pathError{problemInvalidVersion, "free-of can only be combined with latest or a version constraint"}
+		}
+		version, err = oldestFreeOf(upstream, s, version, selector.Constraint, id)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := p.checkVersion(s, version); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// parseVersionPath resolves the series and selector of a route with iaas,
+// line and version variables.
+func parseVersionPath(vars map[string]string) (stemcells.Series, stemcells.Selector, error) {
+	req, err := parseStemcellPath(map[string]string{"iaas": vars["iaas"], "versionOrLine": vars["line"], "version": vars["version"]})
+	if err != nil {
+		return stemcells.Series{}, stemcells.Selector{}, err
+	}
+
+	infrastructure, hypervisor, err := lookupIaaS(req.iaas)
+	if err != nil {
+		return stemcells.Series{}, stemcells.Selector{}, err
 	}
+	return stemcells.Series{Infrastructure: infrastructure, Hypervisor: hypervisor, Line: req.line, Raw: req.raw}, req.version, nil
 }
 
 func autodetectSource(ipAddress net.IP) (string, error) {
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// negotiateContentType returns the offered media type that best matches the
+// request's Accept header. The first offer wins ties and is the fallback when
+// nothing matches.
+func negotiateContentType(r *http.Request, offers ...string) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		q := acceptQuality(accept, offer)
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// explicitlyAccepts reports whether the Accept header names mediaType itself,
+// rather than only through a wildcard, and prefers it to anything else.
+func explicitlyAccepts(r *http.Request, mediaType string) bool {
+	accept := r.Header.Get("Accept")
+	q := acceptQuality(accept, mediaType)
+	return q > 0 && q >= acceptQuality(accept, "*/*") && acceptSpecificity(accept, mediaType) == 2
+}
+
+// acceptSpecificity returns 2 if the Accept header names mediaType, 1 if it
+// only matches through type/*, 0 through */* and -1 if not at all.
+func acceptSpecificity(accept, mediaType string) int {
+	offerType := strings.SplitN(mediaType, "/", 2)[0]
+
+	specificity := -1
+	for _, part := range strings.Split(accept, ",") {
+		rangeType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch {
+		case rangeType == mediaType:
+			return 2
+		case rangeType == offerType+"/*" && specificity < 1:
+			specificity = 1
+		case rangeType == "*/*" && specificity < 0:
+			specificity = 0
+		}
+	}
+	return specificity
+}
+
+// acceptQuality returns the q-value the Accept header gives to mediaType,
+// using the most specific matching range.
+func acceptQuality(accept, mediaType string) float64 {
+	offerType := strings.SplitN(mediaType, "/", 2)[0]
+
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		rangeType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		s := -1
+		switch {
+		case rangeType == mediaType:
+			s = 2
+		case rangeType == offerType+"/*":
+			s = 1
+		case rangeType == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+
+		specificity, q = s, 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+	}
+	return q
+}
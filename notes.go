@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/html"
+)
+
+// releaseNotes are the notes published with a version of a stemcell line.
+type releaseNotes struct {
+	Title       string     `json:"title"`
+	URL         string     `json:"url,omitempty"`
+	PublishedAt *time.Time `json:"published_at,omitempty"`
+	Markdown    string     `json:"markdown"`
+	HTML        string     `json:"html,omitempty"`
+}
+
+// releaseNotesSource looks up the release notes of a version of a stemcell
+// line.
+type releaseNotesSource interface {
+	ReleaseNotes(line, version string) (releaseNotes, error)
+}
+
+// noReleaseNotesError is returned by a releaseNotesSource that has no notes
+// for a version.
+type noReleaseNotesError struct {
+	line    string
+	version string
+}
+
+func (e *noReleaseNotesError) Error() string {
+	return fmt.Sprintf("there are no release notes for %s %s", e.line, e.version)
+}
+
+// releaseNotesError is returned when a releaseNotesSource cannot be reached.
+type releaseNotesError struct {
+	detail string
+}
+
+func (e *releaseNotesError) Error() string {
+	return "could not get release notes: " + e.detail
+}
+
+// githubReleases reads release notes from the GitHub releases of the stemcell
+// builders, whose tags are either "<line>/v<version>" or, for older versions,
+// "stable-<version>". Windows stemcells are built apart from Linux ones, so
+// their lines have no notes unless they have a repository of their own.
+type githubReleases struct {
+	baseURL     string
+	repo        string
+	windowsRepo string
+	token       string
+	httpClient  *http.Client
+}
+
+func newGitHubReleases(baseURL, repo, windowsRepo, token string) *githubReleases {
+	return &githubReleases{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		repo:        repo,
+		windowsRepo: windowsRepo,
+		token:       token,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// repoFor returns the repository whose releases hold the notes of a line.
+func (g *githubReleases) repoFor(line string) string {
+	if strings.HasPrefix(line, "windows") {
+		return g.windowsRepo
+	}
+	return g.repo
+}
+
+func (g *githubReleases) ReleaseNotes(line, version string) (releaseNotes, error) {
+	repo := g.repoFor(line)
+	if repo == "" {
+		return releaseNotes{}, &noReleaseNotesError{line, version}
+	}
+
+	for _, tag := range []string{line + "/v" + version, "stable-" + version} {
+		notes, err := g.release(repo, line, version, tag)
+		if _, ok := err.(*noReleaseNotesError); ok {
+			continue
+		}
+		return notes, err
+	}
+	return releaseNotes{}, &noReleaseNotesError{line, version}
+}
+
+func (g *githubReleases) release(repo, line, version, tag string) (releaseNotes, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/repos/%s/releases/tags/%s", g.baseURL, repo, tag), nil)
+	if err != nil {
+		return releaseNotes{}, err
+	}
+	// The full media type includes the notes rendered as HTML.
+	req.Header.Set("Accept", "application/vnd.github.full+json")
+	if g.token != "" {
+		req.Header.Set("Authorization", "token "+g.token)
+	}
+
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return releaseNotes{}, &releaseNotesError{err.Error()}
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return releaseNotes{}, &noReleaseNotesError{line, version}
+	default:
+		return releaseNotes{}, &releaseNotesError{fmt.Sprintf("%s returned %s", req.URL, resp.Status)}
+	}
+
+	var release struct {
+		Name        string     `json:"name"`
+		TagName     string     `json:"tag_name"`
+		HTMLURL     string     `json:"html_url"`
+		PublishedAt *time.Time `json:"published_at"`
+		Body        string     `json:"body"`
+		BodyHTML    string     `json:"body_html"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return releaseNotes{}, &releaseNotesError{err.Error()}
+	}
+
+	notes := releaseNotes{
+		Title:       release.Name,
+		URL:         release.HTMLURL,
+		PublishedAt: release.PublishedAt,
+		Markdown:    release.Body,
+		HTML:        release.BodyHTML,
+	}
+	if notes.Title == "" {
+		notes.Title = release.TagName
+	}
+	return notes, nil
+}
+
+// notesSource is where release notes come from, the GitHub releases of
+// RELEASE_NOTES_REPO, and of RELEASE_NOTES_WINDOWS_REPO for Windows lines, by
+// default.
+var notesSource releaseNotesSource
+
+// releaseNotesMissTTL is how long a version is remembered to have no release
+// notes, since notes can be published a while after the version.
+const releaseNotesMissTTL = time.Hour
+
+// releaseNotesStore caches release notes by line and version, since they do
+// not change once a version has been cut, and for a while which versions
+// have none.
+type releaseNotesStore struct {
+	mu     sync.Mutex
+	file   fileStore
+	notes  map[string]releaseNotes
+	misses map[string]time.Time
+}
+
+// releaseNotesCache is the on-disk cache in front of notesSource.
+var releaseNotesCache *releaseNotesStore
+
+func newReleaseNotesStore(file fileStore) (*releaseNotesStore, error) {
+	s := &releaseNotesStore{file: file, notes: map[string]releaseNotes{}, misses: map[string]time.Time{}}
+	if err := file.load(&s.notes); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *releaseNotesStore) get(key string) (releaseNotes, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.notes[key]
+	return n, ok
+}
+
+// missed reports whether a version was found to have no notes within the
+// last releaseNotesMissTTL.
+func (s *releaseNotesStore) missed(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	at, ok := s.misses[key]
+	return ok && time.Since(at) < releaseNotesMissTTL
+}
+
+func (s *releaseNotesStore) miss(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.misses[key] = time.Now()
+}
+
+func (s *releaseNotesStore) put(key string, n releaseNotes) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.notes[key] = n
+	return s.file.save(s.notes)
+}
+
+// lookupReleaseNotes returns the release notes of a version of a series,
+// from the cache if they have been looked up before. The notes' HTML is
+// sanitized before it is cached, so it is safe to serve in any format.
+func lookupReleaseNotes(s stemcells.Series, version string) (releaseNotes, error) {
+	key := s.Line + "/" + version
+	if n, ok := releaseNotesCache.get(key); ok {
+		return n, nil
+	}
+	noNotes := &stemcells.NoVersionError{Name: s.Name(), Detail: fmt.Sprintf("no release notes for version %s", version)}
+	if releaseNotesCache.missed(key) {
+		return releaseNotes{}, noNotes
+	}
+
+	n, err := notesSource.ReleaseNotes(s.Line, version)
+	if err != nil {
+		if _, ok := err.(*noReleaseNotesError); ok {
+			releaseNotesCache.miss(key)
+			return releaseNotes{}, noNotes
+		}
+		return releaseNotes{}, err
+	}
+	n.HTML = sanitizeNotesHTML(n.HTML)
+	return n, releaseNotesCache.put(key, n)
+}
+
+// notesElements are the elements kept in release notes rendered by GitHub,
+// with the attributes each may keep. Everything else is dropped, keeping
+// the text inside unless it is a script or the like.
+var notesElements = map[string][]string{
+	"a": {"href", "title"}, "b": nil, "blockquote": nil, "br": nil, "code": nil,
+	"del": nil, "em": nil, "h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil,
+	"h6": nil, "hr": nil, "i": nil, "li": nil, "ol": nil, "p": nil, "pre": nil,
+	"strong": nil, "table": nil, "tbody": nil, "td": nil, "th": nil, "thead": nil,
+	"tr": nil, "ul": nil,
+}
+
+// notesDroppedContent are the elements whose content is dropped with them.
+var notesDroppedContent = map[string]bool{"script": true, "style": true, "iframe": true, "object": true, "template": true, "textarea": true, "title": true}
+
+// sanitizeNotesHTML keeps only the formatting of release notes rendered as
+// HTML, so that a release cannot inject scripts into the page.
+func sanitizeNotesHTML(s string) string {
+	var b bytes.Buffer
+	z := html.NewTokenizer(strings.NewReader(s))
+	dropping := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return b.String()
+		case html.TextToken:
+			if dropping == 0 {
+				b.WriteString(html.EscapeString(string(z.Text())))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			if notesDroppedContent[t.Data] {
+				if t.Type == html.StartTagToken {
+					dropping++
+				}
+				continue
+			}
+			allowed, ok := notesElements[t.Data]
+			if !ok || dropping > 0 {
+				continue
+			}
+			b.WriteString("<" + t.Data)
+			for _, a := range t.Attr {
+				if a.Namespace != "" || !contains(allowed, a.Key) || (a.Key == "href" && !safeURL(a.Val)) {
+					continue
+				}
+				fmt.Fprintf(&b, ` %s="%s"`, a.Key, html.EscapeString(a.Val))
+			}
+			b.WriteString(">")
+		case html.EndTagToken:
+			t := z.Token()
+			if notesDroppedContent[t.Data] {
+				if dropping > 0 {
+					dropping--
+				}
+				continue
+			}
+			if _, ok := notesElements[t.Data]; ok && dropping == 0 {
+				b.WriteString("</" + t.Data + ">")
+			}
+		}
+	}
+}
+
+// safeURL reports whether a link is to the web or relative, rather than,
+// say, a javascript: URL.
+func safeURL(s string) bool {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "" || u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "mailto"
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+var notesTemplate = template.Must(template.New("notes").Parse(`<!doctype html5>
+<html>
+  <head>
+    <title>{{.Title}} - BoshStemcells.com</title>
+    <link rel="stylesheet" type="text/css" href="/bootstrap.min.css">
+  </head>
+  <body>
+    <div class="container">
+      <h1>{{.Title}}</h1>
+      <p><code>{{.Name}}</code> version <code>{{.Version}}</code>{{if .URL}} &middot; <a href="{{.URL}}">on GitHub</a>{{end}}</p>
+      {{if .HTML}}{{.HTML}}{{else}}<pre>{{.Markdown}}</pre>{{end}}
+    </div>
+  </body>
+</html>
+`))
+
+// handleReleaseNotes serves the release notes of a version as markdown, or
+// as HTML or JSON to clients that ask for them.
+func handleReleaseNotes(w http.ResponseWriter, r *http.Request) {
+	s, selector, err := parseVersionPath(mux.Vars(r))
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	version, err := resolveStemcell(r, s, selector)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+	if version == "" {
+		version, err = newestVersion(s, 0)
+		if err != nil {
+			writePathError(w, r, err)
+			return
+		}
+	}
+
+	notes, err := lookupReleaseNotes(s, version)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	switch negotiateContentType(r, "text/markdown", "text/html", "application/json") {
+	case "application/json":
+		writeJSON(w, http.StatusOK, struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+			releaseNotes
+		}{s.Name(), version, notes})
+	case "text/html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		notesTemplate.Execute(w, struct {
+			Name, Version, Title, URL, Markdown string
+			HTML                                template.HTML
+		}{s.Name(), version, notes.Title, notes.URL, notes.Markdown, template.HTML(notes.HTML)})
+	default:
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Write([]byte(notes.Markdown))
+	}
+}
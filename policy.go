@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+)
+
+const problemPolicyDenied = "https://boshstemcells.com/problems/policy-denied"
+
+// policy is the installation's stemcell policy, loaded from POLICY_FILE:
+//
+//	deny_versions:
+//	- line: xenial
+//	  version: "97.28"
+//	  reason: known-bad, kernel panics on boot
+//	  cves: [CVE-2018-1234]
+//	deny_lines:
+//	- line: trusty
+//	  reason: end of life
+//	allowed_iaases: [aws, gcp]
+//
+// A version rule without a line applies to every line, and its version may be
+// a constraint such as 97.x. An empty allowed_iaases allows every IaaS.
+type policy struct {
+	DenyVersions  []versionRule `yaml:"deny_versions"`
+	DenyLines     []lineRule    `yaml:"deny_lines"`
+	AllowedIaaSes []string      `yaml:"allowed_iaases"`
+}
+
+type versionRule struct {
+	Line    string   `yaml:"line"`
+	Version string   `yaml:"version"`
+	Reason  string   `yaml:"reason"`
+	CVEs    []string `yaml:"cves"`
+}
+
+type lineRule struct {
+	Line   string `yaml:"line"`
+	Reason string `yaml:"reason"`
+}
+
+// policyDeniedError is returned when the policy forbids serving a stemcell.
+type policyDeniedError struct {
+	detail string
+	reason string
+	cves   []string
+}
+
+func (e *policyDeniedError) Error() string {
+	if e.reason == "" {
+		return e.detail
+	}
+	return fmt.Sprintf("%s: %s", e.detail, e.reason)
+}
+
+// validate resolves every alias in the policy to its canonical name.
+func (p *policy) validate() error {
+	for i, rule := range p.DenyVersions {
+		if rule.Line != "" {
+			line, ok := stemcells.CanonicalLine(rule.Line)
+			if !ok {
+				return fmt.Errorf("deny_versions[%d]: unknown stemcell line %q", i, rule.Line)
+			}
+			p.DenyVersions[i].Line = line
+		}
+		if !stemcells.ValidVersion(rule.Version) && !stemcells.ValidConstraint(rule.Version) {
+			return fmt.Errorf("deny_versions[%d]: %q is not a version or constraint", i, rule.Version)
+		}
+	}
+
+	for i, rule := range p.DenyLines {
+		line, ok := stemcells.CanonicalLine(rule.Line)
+		if !ok {
+			return fmt.Errorf("deny_lines[%d]: unknown stemcell line %q", i, rule.Line)
+		}
+		p.DenyLines[i].Line = line
+	}
+
+	for i, name := range p.AllowedIaaSes {
+		infrastructure, _, err := lookupIaaS(name)
+		if err != nil {
+			return fmt.Errorf("allowed_iaases[%d]: %s", i, err)
+		}
+		p.AllowedIaaSes[i] = infrastructure
+	}
+	return nil
+}
+
+// checkStemcell returns an error if the policy forbids the stemcell's line or
+// IaaS.
+func (p *policy) checkStemcell(s stemcells.Series) error {
+	for _, rule := range p.DenyLines {
+		if rule.Line == s.Line {
+			return &policyDeniedError{detail: fmt.Sprintf("%s stemcells are blocked by policy", s.Line), reason: rule.Reason}
+		}
+	}
+
+	if len(p.AllowedIaaSes) == 0 {
+		return nil
+	}
+	for _, infrastructure := range p.AllowedIaaSes {
+		if infrastructure == s.Infrastructure {
+			return nil
+		}
+	}
+	return &policyDeniedError{detail: fmt.Sprintf("%s stemcells are not served by this installation", stemcells.IaaSDisplayName(s.Infrastructure))}
+}
+
+// deniedVersion returns the rule that denies the version of the line, if any.
+func (p *policy) deniedVersion(line, version string) (versionRule, bool) {
+	for _, rule := range p.DenyVersions {
+		if rule.Line != "" && rule.Line != line {
+			continue
+		}
+		if rule.Version == version || (strings.HasSuffix(rule.Version, ".x") && strings.HasPrefix(version, strings.TrimSuffix(rule.Version, "x"))) {
+			return rule, true
+		}
+	}
+	return versionRule{}, false
+}
+
+// checkVersion returns an error if the policy denies the version of the
+// stemcell.
+func (p *policy) checkVersion(s stemcells.Series, version string) error {
+	rule, denied := p.deniedVersion(s.Line, version)
+	if !denied {
+		return nil
+	}
+	return &policyDeniedError{detail: fmt.Sprintf("%s version %s is blocked by policy", s.Line, version), reason: rule.Reason, cves: rule.CVEs}
+}
+
+// deniesVersionsOf reports whether any version rule applies to the line, in
+// which case latest has to be resolved here rather than by bosh.io.
+func (p *policy) deniesVersionsOf(line string) bool {
+	for _, rule := range p.DenyVersions {
+		if rule.Line == "" || rule.Line == line {
+			return true
+		}
+	}
+	return false
+}
+
+// policyFile reloads the policy whenever the file changes, so that a bad
+// stemcell can be blocked without restarting the service.
+type policyFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	current *policy
+}
+
+// stemcellPolicy is the policy in force. It is empty when POLICY_FILE is not
+// set.
+var stemcellPolicy = &policyFile{}
+
+func newPolicyFile(path string) (*policyFile, error) {
+	f := &policyFile{path: path}
+	if _, err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// load returns the current policy, re-reading the file if it has been
+// modified. If a modified file is invalid the previous policy stays in force.
+func (f *policyFile) load() (*policy, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.path == "" {
+		return &policy{}, nil
+	}
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		if f.current != nil {
+			return f.current, nil
+		}
+		return nil, err
+	}
+	if f.current != nil && info.ModTime().Equal(f.modTime) {
+		return f.current, nil
+	}
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return f.current, err
+	}
+
+	p := &policy{}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return f.current, fmt.Errorf("%s: %s", f.path, err)
+	}
+	if err := p.validate(); err != nil {
+		return f.current, fmt.Errorf("%s: %s", f.path, err)
+	}
+
+	f.current, f.modTime = p, info.ModTime()
+	return p, nil
+}
+
+// get returns the policy in force, logging rather than failing if a changed
+// file cannot be loaded.
+func (f *policyFile) get() *policy {
+	p, err := f.load()
+	if err != nil {
+		log.Printf("could not reload policy, keeping the previous one: %s", err)
+	}
+	if p == nil {
+		return &policy{}
+	}
+	return p
+}
+
+// policyUpstream hides the versions that the policy denies, so that latest,
+// edge, constraint and relative resolution skip them.
+type policyUpstream struct {
+	stemcells.Upstream
+}
+
+func (u policyUpstream) StemcellVersions(name string) ([]stemcells.Version, error) {
+	versions, err := u.Upstream.StemcellVersions(name)
+	if err != nil {
+		return nil, err
+	}
+	return allowedVersions(name, versions), nil
+}
+
+// allowedVersions returns the versions of the named series that the policy
+// does not deny.
+func allowedVersions(name string, versions []stemcells.Version) []stemcells.Version {
+	s, err := stemcells.ParseName(name)
+	if err != nil {
+		return versions
+	}
+
+	p := stemcellPolicy.get()
+	allowed := make([]stemcells.Version, 0, len(versions))
+	for _, v := range versions {
+		if _, denied := p.deniedVersion(s.Line, v.Version); !denied {
+			allowed = append(allowed, v)
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+)
+
+// poller periodically lists every published stemcell series upstream. Doing
+// so records publish dates for new versions as soon as they appear, keeps a
+// snapshot of each series for the feeds and tells listeners about versions
+// that have not been seen before.
+type poller struct {
+	interval time.Duration
+	upstream stemcells.Upstream
+
+	mu        sync.Mutex
+	seen      map[string]map[string]bool
+	snapshots map[string][]stemcells.Version
+	listeners []func(stemcells.Series, stemcells.Version)
+}
+
+// stemcellPoller is the running poller, or nil when POLL_INTERVAL is not set.
+// Its snapshots are empty until the first poll has finished.
+var stemcellPoller *poller
+
+// newPoller returns a poller of upstream, which should not apply the policy so
+// that versions denied when they appear are not announced once allowed. The
+// versions in seen, typically those with a recorded publish date, are not
+// announced either, so that versions published while the service was down
+// are still found by the first poll after a restart.
+func newPoller(interval time.Duration, upstream stemcells.Upstream, seen map[string]map[string]bool) *poller {
+	return &poller{interval: interval, upstream: upstream, seen: seen, snapshots: map[string][]stemcells.Version{}}
+}
+
+// run polls immediately and then every interval. It never returns.
+func (p *poller) run() {
+	for {
+		p.poll()
+		time.Sleep(p.interval)
+	}
+}
+
+func (p *poller) poll() {
+	for _, name := range stemcells.Names() {
+		versions, err := p.upstream.StemcellVersions(name)
+		if err != nil {
+			log.Printf("polling %s: %s", name, err)
+			continue
+		}
+		allowed := allowedVersions(name, versions)
+
+		p.mu.Lock()
+		seen, known := p.seen[name]
+		if !known {
+			seen = map[string]bool{}
+			p.seen[name] = seen
+		}
+		added := newVersions(seen, versions)
+		p.snapshots[name] = allowed
+		listeners := p.listeners
+		p.mu.Unlock()
+
+		if !known {
+			continue
+		}
+		s, err := stemcells.ParseName(name)
+		if err != nil {
+			continue
+		}
+		for _, v := range allowedVersions(name, added) {
+			for _, listener := range listeners {
+				listener(s, v)
+			}
+		}
+	}
+}
+
+// subscribe calls listener with every version the policy allows that has not
+// been seen before. The versions of a series seen for the first time are not
+// new.
+func (p *poller) subscribe(listener func(stemcells.Series, stemcells.Version)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.listeners = append(p.listeners, listener)
+}
+
+// newVersions returns the versions in current that are not in seen, oldest
+// first, and adds them to seen.
+func newVersions(seen map[string]bool, current []stemcells.Version) []stemcells.Version {
+	var added []stemcells.Version
+	for i := len(current) - 1; i >= 0; i-- {
+		if !seen[current[i].Version] {
+			seen[current[i].Version] = true
+			added = append(added, current[i])
+		}
+	}
+	return added
+}
+
+// snapshot returns the versions of the series allowed by the policy at the
+// last poll, newest first.
+func (p *poller) snapshot(name string) []stemcells.Version {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.snapshots[name]
+}
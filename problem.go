@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+	"code.benchapman.ie/boshstemcells/stemcells/tarball"
+)
+
+const (
+	problemInvalidIaaS    = "https://boshstemcells.com/problems/invalid-iaas"
+	problemInvalidLine    = "https://boshstemcells.com/problems/invalid-line"
+	problemInvalidVersion = "https://boshstemcells.com/problems/invalid-version"
+	problemNoSuchVersion  = "https://boshstemcells.com/problems/no-such-version"
+	problemUnknownName    = "https://boshstemcells.com/problems/unknown-name"
+	problemUnsupported    = "https://boshstemcells.com/problems/unsupported-combination"
+	problemUpstream       = "https://boshstemcells.com/problems/upstream-unavailable"
+	problemTooNew         = "https://boshstemcells.com/problems/too-new"
+)
+
+// problem is an RFC 7807 problem details body.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	Suggestions []string `json:"suggestions,omitempty"`
+	Valid       []string `json:"valid,omitempty"`
+	Reason      string   `json:"reason,omitempty"`
+	CVEs        []string `json:"cves,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, p problem) {
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.Instance == "" {
+		p.Instance = r.URL.RequestURI()
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writePathError responds to an error from parsing or resolving a stemcell
+// path.
+func writePathError(w http.ResponseWriter, r *http.Request, err error) {
+	if e, ok := err.(*stemcells.UnknownNameError); ok {
+		writeUnknownName(w, r, e)
+		return
+	}
+
+	p, negotiated := pathProblem(err)
+	if negotiated {
+		writeNegotiatedProblem(w, r, p)
+	} else {
+		writeProblem(w, r, p)
+	}
+}
+
+// pathProblem describes an error from parsing or resolving a stemcell path,
+// and whether it is one that clients which do not ask for JSON should get as
+// plain text.
+func pathProblem(err error) (problem, bool) {
+	switch e := err.(type) {
+	case *stemcells.UnknownNameError:
+		return problem{Type: problemUnknownName, Status: http.StatusNotFound, Detail: e.Error(), Suggestions: e.Suggestions(), Valid: e.Candidates}, true
+	case *stemcells.SelectorError:
+		return problem{Type: problemInvalidVersion, Status: http.StatusBadRequest, Detail: e.Error()}, false
+	case *stemcells.UnsupportedCombinationError:
+		return problem{Type: problemUnsupported, Status: http.StatusNotFound, Detail: e.Error()}, true
+	case *emptyChannelError:
+		return problem{Type: problemEmptyChannel, Status: http.StatusNotFound, Detail: e.Error()}, true
+	case *stemcells.TooNewError:
+		return problem{Type: problemTooNew, Status: http.StatusNotFound, Detail: e.Error()}, true
+	case *endOfLifeError:
+		return problem{Type: problemEndOfLife, Status: http.StatusGone, Detail: e.Error()}, true
+	case *policyDeniedError:
+		return problem{Type: problemPolicyDenied, Status: http.StatusConflict, Detail: e.Error(), Reason: e.reason, CVEs: e.cves}, true
+	case *stemcells.NoVersionError:
+		return problem{Type: problemNoSuchVersion, Status: http.StatusNotFound, Detail: e.Error()}, true
+	case *stemcells.UpstreamError:
+		return problem{Type: problemUpstream, Status: http.StatusBadGateway, Detail: e.Error()}, true
+	case *tarballError:
+		return problem{Type: problemUpstream, Status: http.StatusBadGateway, Detail: e.Error()}, false
+	case *releaseNotesError:
+		return problem{Type: problemUpstream, Status: http.StatusBadGateway, Detail: e.Error()}, false
+	case *tarball.FormatError:
+		return problem{Type: problemInvalidTarball, Status: http.StatusUnprocessableEntity, Detail: e.Error()}, false
+	case *pathError:
+		return problem{Type: e.problemType, Status: http.StatusBadRequest, Detail: e.detail}, false
+	default:
+		return problem{Type: "about:blank", Status: http.StatusInternalServerError, Detail: err.Error()}, false
+	}
+}
+
+// writeNegotiatedProblem writes p as problem JSON to clients that ask for JSON
+// and as plain text to everyone else, so that tools such as the bosh CLI show
+// a readable message.
+func writeNegotiatedProblem(w http.ResponseWriter, r *http.Request, p problem) {
+	switch negotiateContentType(r, "text/plain", "application/json", "application/problem+json") {
+	case "application/json", "application/problem+json":
+		writeProblem(w, r, p)
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(p.Status)
+		fmt.Fprintln(w, p.Detail)
+	}
+}
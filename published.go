@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+)
+
+const problemInvalidMinAge = "https://boshstemcells.com/problems/invalid-min-age"
+
+// defaultMinAge is applied to latest resolution when a request does not give
+// a min-age of its own.
+var defaultMinAge time.Duration
+
+// parseMinAge parses a min-age query parameter, which is a Go duration such
+// as "72h" or a number of days such as "3d".
+func parseMinAge(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultMinAge, nil
+	}
+
+	d, err := stemcells.ParseMinAge(value)
+	if err != nil {
+		return 0, &pathError{problemInvalidMinAge, err.Error()}
+	}
+	return d, nil
+}
+
+// publishDateStore records when each version of a stemcell series was first
+// seen upstream. Versions that were already listed the first time a series
+// was seen are left undated, since they may have come out at any time before.
+type publishDateStore struct {
+	mu    sync.Mutex
+	file  fileStore
+	dates map[string]map[string]time.Time
+}
+
+// publishDates records when versions were first seen upstream.
+var publishDates *publishDateStore
+
+func newPublishDateStore(file fileStore) (*publishDateStore, error) {
+	s := &publishDateStore{file: file, dates: map[string]map[string]time.Time{}}
+	if err := file.load(&s.dates); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// record notes any versions of the series not seen before and returns the
+// publish date of each version, zero for those listed at the series' first
+// observation.
+func (s *publishDateStore) record(name string, versions []stemcells.Version) (map[string]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dates, known := s.dates[name]
+	if !known {
+		dates = map[string]time.Time{}
+		s.dates[name] = dates
+	}
+
+	now := time.Now().UTC()
+	changed := !known
+	for _, v := range versions {
+		if _, ok := dates[v.Version]; ok {
+			continue
+		}
+		if known {
+			dates[v.Version] = now
+		} else {
+			dates[v.Version] = time.Time{}
+		}
+		changed = true
+	}
+
+	result := make(map[string]time.Time, len(dates))
+	for v, t := range dates {
+		result[v] = t
+	}
+
+	if !changed {
+		return result, nil
+	}
+	return result, s.file.save(s.dates)
+}
+
+// discovered reports whether a version of the series was first seen after
+// the series itself, rather than being listed at its first observation.
+func (s *publishDateStore) discovered(name, version string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.dates[name][version]
+	return ok && !t.IsZero()
+}
+
+// seen returns the versions recorded for each series seen so far.
+func (s *publishDateStore) seen() map[string]map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]map[string]bool, len(s.dates))
+	for name, dates := range s.dates {
+		versions := make(map[string]bool, len(dates))
+		for v := range dates {
+			versions[v] = true
+		}
+		seen[name] = versions
+	}
+	return seen
+}
+
+// recordingUpstream fills in the publish date of versions that the wrapped
+// upstream does not date itself.
+type recordingUpstream struct {
+	stemcells.Upstream
+	dates *publishDateStore
+}
+
+func (u recordingUpstream) StemcellVersions(name string) ([]stemcells.Version, error) {
+	versions, err := u.Upstream.StemcellVersions(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dates, err := u.dates.record(name, versions)
+	if err != nil {
+		return nil, err
+	}
+
+	dated := make([]stemcells.Version, len(versions))
+	for i, v := range versions {
+		if v.PublishedAt.IsZero() {
+			v.PublishedAt = dates[v.Version]
+		}
+		dated[i] = v
+	}
+	return dated, nil
+}
+
+// newestVersion returns the newest version of the series published at least
+// minAge ago.
+func newestVersion(s stemcells.Series, minAge time.Duration) (string, error) {
+	return newestVersionIn(source, s, minAge)
+}
+
+// newestVersionIn is newestVersion against upstream.
+func newestVersionIn(upstream stemcells.Upstream, s stemcells.Series, minAge time.Duration) (string, error) {
+	version, err := stemcells.Resolver{Upstream: upstream}.Newest(s, minAge)
+	if _, ok := err.(*stemcells.TooNewError); ok && minAge == 0 {
+		return "", &emptyChannelError{line: s.Line, channel: stemcells.ChannelEdge}
+	}
+	return version, err
+}
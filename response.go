@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+	"github.com/gorilla/mux"
+)
+
+// handleListVersions lists the versions of a stemcell series, newest first,
+// optionally limited to a constraint such as 97.x.
+func handleListVersions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	infrastructure, hypervisor, err := lookupIaaS(vars["iaas"])
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	line, raw, ok := stemcells.LookupLine(vars["line"])
+	if !ok {
+		writePathError(w, r, &stemcells.UnknownNameError{Kind: "stemcell line", Name: vars["line"], Candidates: stemcells.LineNames()})
+		return
+	}
+
+	s := stemcells.Series{Infrastructure: infrastructure, Hypervisor: hypervisor, Line: line, Raw: raw}
+	if err := stemcells.CheckPublished(s, stemcells.AnyFlavor); err != nil {
+		writePathError(w, r, err)
+		return
+	}
+	if err := stemcellPolicy.get().checkStemcell(s); err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	constraint := r.URL.Query().Get("constraint")
+	if constraint != "" && !stemcells.ValidConstraint(constraint) {
+		writePathError(w, r, &pathError{problemInvalidVersion, fmt.Sprintf("%q is not a valid constraint; expected a constraint such as 97.x", constraint)})
+		return
+	}
+
+	versions, err := source.StemcellVersions(s.Name())
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	now := time.Now()
+	list := []stemcells.Resolution{}
+	for _, v := range versions {
+		if constraint == "" || stemcells.MatchesConstraint(v.Version, constraint) {
+			list = append(list, stemcells.NewResolution(s, v, now))
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+var deprecatedTemplate = template.Must(template.New("deprecated").Parse(`<!doctype html5>
+<html>
+  <head>
+    <title>BoshStemcells.com</title>
+    <link rel="stylesheet" type="text/css" href="/bootstrap.min.css">
+  </head>
+  <body>
+    <div class="container">
+      <h1>BoshStemcells.com</h1>
+      <div class="alert alert-warning" role="alert">{{.Warning}}</div>
+      <p>You can still download <code>{{.Name}}</code>{{if .Version}} version <code>{{.Version}}</code>{{end}} from bosh.io:</p>
+      <p><a class="btn btn-default" href="{{.URL}}">Continue to bosh.io</a></p>
+    </div>
+  </body>
+</html>
+`))
+
+// writeStemcell responds with the resolved stemcell: as JSON to clients that
+// ask for it, as the stemcells section of a deployment manifest to clients
+// that ask for YAML, as a warning page to browsers when the line is deprecated, and
+// as a redirect to bosh.io otherwise.
+func writeStemcell(w http.ResponseWriter, r *http.Request, s stemcells.Series, version string) {
+	now := time.Now()
+	setLifecycleHeaders(w, s.Line, now)
+
+	switch {
+	case explicitlyAccepts(r, "application/json"):
+		res, err := resolver().Describe(s, version, now)
+		if err != nil {
+			writePathError(w, r, err)
+			return
+		}
+		if advisories.dir == "" {
+			writeJSON(w, http.StatusOK, res)
+			return
+		}
+
+		// Advisories are null when the version's packages are not known.
+		matches, _, err := advisoryReports.lookup(s, res.Version)
+		if err != nil {
+			log.Printf("looking up advisories of %s %s: %s", res.Name, res.Version, err)
+			matches = nil
+		}
+		writeJSON(w, http.StatusOK, struct {
+			stemcells.Resolution
+			Advisories []advisoryMatch `json:"advisories"`
+		}{res, matches})
+	case explicitlyAccepts(r, "application/x-yaml"):
+		res, err := resolver().Describe(s, version, now)
+		if err != nil {
+			writePathError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-yaml")
+		w.Write([]byte(res.Manifest()))
+	case explicitlyAccepts(r, "text/html") && stemcells.LineLifecycle(s.Line).Status(now) != stemcells.StatusSupported:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		deprecatedTemplate.Execute(w, struct {
+			Warning string
+			Name    string
+			Version string
+			URL     string
+		}{stemcells.LineLifecycle(s.Line).Warning(s.Line, now), s.Name(), version, stemcells.BoshIOURL(s.Name(), version)})
+	default:
+		http.Redirect(w, r, stemcells.BoshIOURL(s.Name(), version), 301)
+	}
+}
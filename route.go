@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+)
+
+var (
+	iaasPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*(:[A-Za-z0-9._-]+)?$`)
+	namePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9._-]*$`)
+)
+
+// defaultLine is the stemcell line served when a path does not name one.
+var defaultLine = stemcells.DefaultLine
+
+// stemcellRequest is the parsed form of a /{iaas}[/{line}][/{version}] path.
+// The IaaS is as given, so may be "auto" or carry a hypervisor override.
+type stemcellRequest struct {
+	iaas    string
+	line    string
+	raw     bool
+	version stemcells.Selector
+}
+
+// pathError describes why a request path does not match the route grammar.
+type pathError struct {
+	problemType string
+	detail      string
+}
+
+func (e *pathError) Error() string {
+	return e.detail
+}
+
+// parseStemcellPath validates the mux variables of a stemcell route. The
+// grammar is:
+//
+//	/{iaas}
+//	/{iaas}/{line|version}
+//	/{iaas}/{line}/{version}
+//
+// where iaas may be followed by ":hypervisor" and version is "latest", a
+// promotion channel, "@" followed by a date or time, or a dotted sequence of
+// numbers.
+func parseStemcellPath(vars map[string]string) (stemcellRequest, error) {
+	req := stemcellRequest{line: defaultLine}
+
+	iaas, ok := vars["iaas"]
+	if !ok || !iaasPattern.MatchString(iaas) {
+		return req, &pathError{problemInvalidIaaS, fmt.Sprintf("%q is not a valid IaaS name", iaas)}
+	}
+	req.iaas = iaas
+
+	versionOrLine, ok := vars["versionOrLine"]
+	if !ok {
+		return req, nil
+	}
+
+	version, hasVersion := vars["version"]
+	if line, raw, ok := stemcells.LookupLine(versionOrLine); ok {
+		req.line, req.raw = line, raw
+	} else if !stemcells.IsVersionKeyword(versionOrLine) && namePattern.MatchString(versionOrLine) {
+		return req, &stemcells.UnknownNameError{Kind: "stemcell line", Name: versionOrLine, Candidates: stemcells.LineNames()}
+	} else if hasVersion {
+		return req, &pathError{problemInvalidLine, fmt.Sprintf("%q is not a stemcell line", versionOrLine)}
+	} else {
+		version = versionOrLine
+		hasVersion = true
+	}
+
+	if hasVersion {
+		v, err := stemcells.ParseSelector(version)
+		if err != nil {
+			return req, err
+		}
+		req.version = v
+	}
+
+	return req, nil
+}
+
+// parseStemcellNamePath validates the mux variables of a /s/{name}[/{version}]
+// route, which names a stemcell series by its canonical bosh.io name.
+func parseStemcellNamePath(vars map[string]string) (stemcells.Series, stemcells.Selector, error) {
+	s, err := stemcells.ParseName(vars["name"])
+	if err != nil {
+		return s, stemcells.Selector{}, err
+	}
+
+	version, ok := vars["version"]
+	if !ok {
+		return s, stemcells.Selector{}, nil
+	}
+
+	selector, err := stemcells.ParseSelector(version)
+	return s, selector, err
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+	"code.benchapman.ie/boshstemcells/stemcells/tarball"
+	"github.com/gorilla/mux"
+)
+
+// ubuntuReleases maps the codenames in stemcells' operating_system to Ubuntu
+// release numbers.
+var ubuntuReleases = map[string]string{
+	"trusty": "14.04",
+	"xenial": "16.04",
+	"bionic": "18.04",
+	"jammy":  "22.04",
+	"noble":  "24.04",
+}
+
+// distro is the operating system of a stemcell as a package ecosystem.
+type distro struct {
+	name     string // e.g. "ubuntu"
+	version  string // e.g. "22.04"
+	codename string // e.g. "jammy", for the purl distro qualifier
+	purlType string // "deb" or "rpm"
+}
+
+// lineOperatingSystem is the operating_system that the stemcells of a line
+// declare, e.g. "ubuntu-jammy" for ubuntu-jammy-fips.
+func lineOperatingSystem(line string) string {
+	return strings.TrimSuffix(line, "-fips")
+}
+
+// parseDistro interprets a stemcell's operating_system, such as
+// "ubuntu-jammy" or "centos-7". The distro has no purl type for operating
+// systems, such as Windows, whose packages have no package URLs.
+func parseDistro(operatingSystem string) distro {
+	parts := strings.SplitN(operatingSystem, "-", 2)
+	if len(parts) != 2 {
+		return distro{name: operatingSystem}
+	}
+
+	switch parts[0] {
+	case "ubuntu":
+		return distro{name: "ubuntu", version: ubuntuReleases[parts[1]], codename: parts[1], purlType: "deb"}
+	case "centos":
+		return distro{name: "centos", version: parts[1], codename: operatingSystem, purlType: "rpm"}
+	}
+	return distro{name: parts[0], version: parts[1]}
+}
+
+// packageURL returns the purl of a package, or an empty string if the
+// distro's packages have none.
+func (d distro) packageURL(p tarball.Package) string {
+	if d.purlType == "" {
+		return ""
+	}
+
+	qualifiers := []string{}
+	if p.Architecture != "" {
+		qualifiers = append(qualifiers, "arch="+purlEscape(p.Architecture))
+	}
+	qualifiers = append(qualifiers, "distro="+purlEscape(d.codename))
+	return fmt.Sprintf("pkg:%s/%s/%s@%s?%s", d.purlType, d.name, purlEscape(p.Name), purlEscape(p.Version), strings.Join(qualifiers, "&"))
+}
+
+// purlEscape percent-encodes a purl component, including the colon of an
+// epoch and the plus signs common in Debian versions.
+func purlEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// cycloneDX is a CycloneDX 1.5 JSON BOM.
+type cycloneDX struct {
+	BOMFormat    string                `json:"bomFormat"`
+	SpecVersion  string                `json:"specVersion"`
+	SerialNumber string                `json:"serialNumber"`
+	Version      int                   `json:"version"`
+	Metadata     cycloneDXMetadata     `json:"metadata"`
+	Components   []cycloneDXComponent  `json:"components"`
+	Dependencies []cycloneDXDependency `json:"dependencies"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     []cycloneDXTool    `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTool struct {
+	Vendor string `json:"vendor"`
+	Name   string `json:"name"`
+}
+
+type cycloneDXComponent struct {
+	Type        string              `json:"type"`
+	BOMRef      string              `json:"bom-ref"`
+	Name        string              `json:"name"`
+	Version     string              `json:"version,omitempty"`
+	Description string              `json:"description,omitempty"`
+	PURL        string              `json:"purl,omitempty"`
+	Hashes      []cycloneDXHash     `json:"hashes,omitempty"`
+	Properties  []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXHash struct {
+	Algorithm string `json:"alg"`
+	Content   string `json:"content"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cycloneDXDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+// spdx is an SPDX 2.3 JSON document.
+type spdx struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID                string            `json:"SPDXID"`
+	Name                  string            `json:"name"`
+	VersionInfo           string            `json:"versionInfo"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	Description           string            `json:"description,omitempty"`
+	Checksums             []spdxChecksum    `json:"checksums,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	Category string `json:"referenceCategory"`
+	Type     string `json:"referenceType"`
+	Locator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	Element string `json:"spdxElementId"`
+	Type    string `json:"relationshipType"`
+	Related string `json:"relatedSpdxElement"`
+}
+
+// serialNumber derives a UUID URN from a stemcell's name and version, so that
+// the SBOM of a version always has the same serial number.
+func serialNumber(name, version string) string {
+	hex := hashOf(name + "/" + version)
+	return fmt.Sprintf("urn:uuid:%s-%s-5%s-8%s-%s", hex[0:8], hex[8:12], hex[13:16], hex[17:20], hex[20:32])
+}
+
+// newCycloneDX describes a stemcell and its packages as a CycloneDX BOM.
+func newCycloneDX(res stemcells.Resolution, operatingSystem string, packages []tarball.Package, now time.Time) cycloneDX {
+	d := parseDistro(operatingSystem)
+	stemcellRef := "stemcell:" + res.Name + "@" + res.Version
+	osRef := "os:" + operatingSystem
+
+	var hashes []cycloneDXHash
+	if res.SHA1 != "" {
+		hashes = []cycloneDXHash{{"SHA-1", res.SHA1}}
+	}
+
+	bom := cycloneDX{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: serialNumber(res.Name, res.Version),
+		Version:      1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: now.UTC().Format(time.RFC3339),
+			Tools:     []cycloneDXTool{{Vendor: "boshstemcells.com", Name: "boshstemcells"}},
+			Component: cycloneDXComponent{
+				Type:        "operating-system",
+				BOMRef:      stemcellRef,
+				Name:        res.Name,
+				Version:     res.Version,
+				Description: "BOSH stemcell " + res.Name + " version " + res.Version,
+				Hashes:      hashes,
+				Properties: []cycloneDXProperty{
+					{"bosh:operating_system", operatingSystem},
+					{"bosh:iaas", res.IaaS},
+					{"bosh:hypervisor", res.Hypervisor},
+					{"bosh:tarball_url", res.TarballURL},
+				},
+			},
+		},
+		Components: []cycloneDXComponent{{
+			Type:    "operating-system",
+			BOMRef:  osRef,
+			Name:    d.name,
+			Version: d.version,
+		}},
+	}
+
+	refs := []string{osRef}
+	for _, p := range packages {
+		purl := d.packageURL(p)
+		ref := purl
+		if ref == "" {
+			ref = "package:" + p.Name + "@" + p.Version
+		}
+		refs = append(refs, ref)
+		bom.Components = append(bom.Components, cycloneDXComponent{
+			Type:        "library",
+			BOMRef:      ref,
+			Name:        p.Name,
+			Version:     p.Version,
+			Description: p.Description,
+			PURL:        purl,
+		})
+	}
+	bom.Dependencies = []cycloneDXDependency{{Ref: stemcellRef, DependsOn: refs}}
+	return bom
+}
+
+// newSPDX describes a stemcell and its packages as an SPDX document.
+func newSPDX(res stemcells.Resolution, operatingSystem string, packages []tarball.Package, now time.Time) spdx {
+	d := parseDistro(operatingSystem)
+
+	doc := spdx{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              res.Name + "-" + res.Version,
+		DocumentNamespace: fmt.Sprintf("https://boshstemcells.com/sbom/%s/%s", res.Name, res.Version),
+		CreationInfo: spdxCreationInfo{
+			Created:  now.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: boshstemcells", "Organization: boshstemcells.com"},
+		},
+		Packages: []spdxPackage{{
+			SPDXID:                "SPDXRef-Stemcell",
+			Name:                  res.Name,
+			VersionInfo:           res.Version,
+			DownloadLocation:      res.TarballURL,
+			PrimaryPackagePurpose: "OPERATING-SYSTEM",
+			Description:           fmt.Sprintf("BOSH stemcell of %s %s", d.name, d.version),
+		}},
+		Relationships: []spdxRelationship{{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Stemcell"}},
+	}
+	if doc.Packages[0].DownloadLocation == "" {
+		doc.Packages[0].DownloadLocation = "NOASSERTION"
+	}
+	if res.SHA1 != "" {
+		doc.Packages[0].Checksums = []spdxChecksum{{"SHA1", res.SHA1}}
+	}
+
+	for n, p := range packages {
+		id := fmt.Sprintf("SPDXRef-Package-%d", n+1)
+		pkg := spdxPackage{
+			SPDXID:           id,
+			Name:             p.Name,
+			VersionInfo:      p.Version,
+			DownloadLocation: "NOASSERTION",
+			Description:      p.Description,
+		}
+		if purl := d.packageURL(p); purl != "" {
+			pkg.ExternalRefs = []spdxExternalRef{{"PACKAGE-MANAGER", "purl", purl}}
+		}
+		doc.Packages = append(doc.Packages, pkg)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{"SPDXRef-Stemcell", "CONTAINS", id})
+	}
+	return doc
+}
+
+// handleSBOM serves the software bill of materials of a version, in
+// CycloneDX or SPDX format, from the package list published next to its
+// tarball. Operating systems without package URLs, such as Windows, do not
+// publish package lists and get a bill of the stemcell alone.
+func handleSBOM(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	s, selector, err := parseVersionPath(vars)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	version, err := resolveStemcell(r, s, selector)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	now := time.Now()
+	res, err := resolver().Describe(s, version, now)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	operatingSystem := lineOperatingSystem(s.Line)
+	var packages []tarball.Package
+	if parseDistro(operatingSystem).purlType != "" {
+		if packages, err = source.StemcellPackages(res.Name, res.Version); err != nil {
+			writePathError(w, r, err)
+			return
+		}
+	}
+
+	var body interface{}
+	contentType := "application/vnd.cyclonedx+json"
+	if vars["format"] == "spdx" {
+		body, contentType = newSPDX(res, operatingSystem, packages, now), "application/spdx+json"
+	} else {
+		body = newCycloneDX(res, operatingSystem, packages, now)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	json.NewEncoder(w).Encode(body)
+}
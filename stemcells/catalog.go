@@ -0,0 +1,378 @@
+// Package stemcells resolves BOSH stemcells: it knows which stemcell lines are
+// published for which IaaSes, accepts the same short names and version
+// selectors as boshstemcells.com URLs, and resolves them against bosh.io. A
+// Client resolves stemcells either through a boshstemcells server or in
+// process.
+package stemcells
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// IaaS is an infrastructure that stemcells are published for. The first
+// hypervisor is the default and the first name is the one shown to users.
+type IaaS struct {
+	Infrastructure string
+	Hypervisors    []string
+	Names          []string
+}
+
+// Flavors records which tarball flavors are published for an IaaS. Raw
+// stemcells carry a raw disk image instead of the IaaS's usual format and have
+// a "-raw" suffix on their name.
+type Flavors struct {
+	Full  bool
+	Light bool
+	Raw   bool
+}
+
+// Flavor is the kind of tarball a request asks for.
+type Flavor int
+
+const (
+	// AnyFlavor accepts whichever tarball bosh.io serves for the series.
+	AnyFlavor Flavor = iota
+	FullFlavor
+	LightFlavor
+)
+
+func (f Flavor) String() string {
+	switch f {
+	case FullFlavor:
+		return "full"
+	case LightFlavor:
+		return "light"
+	}
+	return ""
+}
+
+// offers reports whether the flavors include the requested one, and its raw
+// variant if raw is set.
+func (f Flavors) offers(raw bool, flavor Flavor) bool {
+	if raw && !f.Raw {
+		return false
+	}
+	switch flavor {
+	case FullFlavor:
+		return f.Full
+	case LightFlavor:
+		return f.Light && !raw
+	}
+	return true
+}
+
+// Line is an operating system line, the infrastructures that it is published
+// for and its lifecycle.
+type Line struct {
+	Name      string
+	Aliases   []string
+	Published map[string]Flavors
+	Lifecycle Lifecycle
+}
+
+// Series identifies one series of stemcells on bosh.io.
+type Series struct {
+	Infrastructure string
+	Hypervisor     string
+	Line           string
+	Raw            bool
+}
+
+// Name is the canonical bosh.io name of the series, e.g.
+// "bosh-aws-xen-hvm-ubuntu-xenial-go_agent".
+func (s Series) Name() string {
+	name := fmt.Sprintf("bosh-%s-%s-%s-go_agent", s.Infrastructure, s.Hypervisor, s.Line)
+	if s.Raw {
+		name += RawSuffix
+	}
+	return name
+}
+
+var (
+	fullOnly   = Flavors{Full: true}
+	lightOnly  = Flavors{Light: true}
+	both       = Flavors{Full: true, Light: true}
+	fullAndRaw = Flavors{Full: true, Raw: true}
+)
+
+// IaaSes lists every infrastructure in the catalog.
+var IaaSes = []IaaS{
+	{"aws", []string{"xen-hvm", "xen"}, []string{"aws", "amazon"}},
+	{"azure", []string{"hyperv"}, []string{"azure"}},
+	{"google", []string{"kvm"}, []string{"gcp", "google"}},
+	{"openstack", []string{"kvm", "esxi"}, []string{"openstack"}},
+	{"softlayer", []string{"xen", "esxi"}, []string{"softlayer"}},
+	{"vsphere", []string{"esxi"}, []string{"vsphere"}},
+	{"vcloud", []string{"esxi"}, []string{"vcloud"}},
+	{"warden", []string{"boshlite"}, []string{"lite", "boshlite"}},
+}
+
+var ubuntuPublished = map[string]Flavors{
+	"aws":       both,
+	"azure":     fullAndRaw,
+	"google":    both,
+	"openstack": fullAndRaw,
+	"softlayer": fullOnly,
+	"vsphere":   fullOnly,
+	"vcloud":    fullOnly,
+	"warden":    fullOnly,
+}
+
+var modernUbuntuPublished = map[string]Flavors{
+	"aws":       both,
+	"azure":     fullAndRaw,
+	"google":    both,
+	"openstack": fullAndRaw,
+	"vsphere":   fullOnly,
+	"warden":    fullOnly,
+}
+
+var fipsPublished = map[string]Flavors{
+	"aws":    both,
+	"azure":  fullOnly,
+	"google": both,
+}
+
+var windowsPublished = map[string]Flavors{
+	"aws":    lightOnly,
+	"azure":  lightOnly,
+	"google": lightOnly,
+}
+
+// Lines lists every stemcell line in the catalog. Ubuntu lines reach end of
+// life when Canonical's standard support ends and are deprecated a year
+// before, following the release schedule at
+// https://ubuntu.com/about/release-cycle (also shipped as distro-info-data's
+// ubuntu.csv).
+var Lines = []Line{
+	{"ubuntu-trusty", []string{"trusty", "ubuntu-trusty", "ubuntutrusty", "t"}, ubuntuPublished, Lifecycle{date("2014-04-17"), date("2018-04-30"), date("2019-04-30")}},
+	{"ubuntu-xenial", []string{"xenial", "ubuntu-xenial", "ubuntuxenial", "ubuntu", "x"}, ubuntuPublished, Lifecycle{date("2016-04-21"), date("2020-04-30"), date("2021-04-30")}},
+	{"ubuntu-xenial-fips", []string{"xenial-fips", "ubuntu-xenial-fips", "ubuntuxenialfips", "x-fips"}, fipsPublished, Lifecycle{date("2018-01-15"), date("2020-04-30"), date("2021-04-30")}},
+	{"ubuntu-bionic", []string{"bionic", "ubuntu-bionic", "ubuntubionic", "b"}, ubuntuPublished, Lifecycle{date("2018-04-26"), date("2022-05-31"), date("2023-05-31")}},
+	{"ubuntu-bionic-fips", []string{"bionic-fips", "ubuntu-bionic-fips", "ubuntubionicfips", "b-fips"}, fipsPublished, Lifecycle{date("2019-06-03"), date("2022-05-31"), date("2023-05-31")}},
+	{"ubuntu-jammy", []string{"jammy", "ubuntu-jammy", "ubuntujammy", "j"}, modernUbuntuPublished, Lifecycle{date("2022-04-21"), date("2026-06-01"), date("2027-06-01")}},
+	{"ubuntu-jammy-fips", []string{"jammy-fips", "ubuntu-jammy-fips", "ubuntujammyfips", "j-fips"}, fipsPublished, Lifecycle{date("2022-10-03"), date("2026-06-01"), date("2027-06-01")}},
+	{"ubuntu-noble", []string{"noble", "ubuntu-noble", "ubuntunoble", "n"}, modernUbuntuPublished, Lifecycle{date("2024-04-25"), date("2028-05-31"), date("2029-05-31")}},
+	{"windows2016", []string{"windows", "windows2016", "windows16", "win2016", "win16"}, windowsPublished, Lifecycle{date("2017-10-17"), date("2021-01-11"), date("2022-01-11")}},
+	{"windows2012R2", []string{"windows2012", "windows12", "windows2012r2", "win2012"}, windowsPublished, Lifecycle{date("2016-12-01"), date("2019-01-01"), date("2023-10-10")}},
+	{"windows1803", []string{"windows1803", "win1803"}, windowsPublished, Lifecycle{date("2018-06-01"), date("2019-05-12"), date("2019-11-12")}},
+	{"windows2019", []string{"windows2019", "windows19", "win2019", "win19"}, windowsPublished, Lifecycle{date("2019-03-01"), date("2023-01-09"), date("2024-01-09")}},
+	{"centos-7", []string{"centos", "centos7", "centos-7"}, map[string]Flavors{
+		"aws":       fullOnly,
+		"azure":     fullOnly,
+		"google":    fullOnly,
+		"openstack": fullOnly,
+		"vsphere":   fullOnly,
+		"warden":    fullOnly,
+	}, Lifecycle{date("2017-02-01"), date("2020-12-08"), date("2024-06-30")}},
+}
+
+// RawSuffix selects the raw disk image variant when appended to a line name,
+// e.g. "xenial-raw".
+const RawSuffix = "-raw"
+
+// HypervisorSeparator separates an IaaS name from a hypervisor override, e.g.
+// "aws:xen".
+const HypervisorSeparator = ":"
+
+var (
+	iaasAliases = map[string]IaaS{}
+	lineAliases = map[string]string{}
+)
+
+func init() {
+	for _, i := range IaaSes {
+		for _, name := range i.Names {
+			iaasAliases[name] = i
+		}
+	}
+	for _, l := range Lines {
+		for _, alias := range l.Aliases {
+			lineAliases[alias] = l.Name
+		}
+	}
+}
+
+// UnsupportedCombinationError is returned when a stemcell line is not
+// published for the requested IaaS.
+type UnsupportedCombinationError struct {
+	IaaS       string
+	Line       string
+	Publishers []string
+}
+
+func (e *UnsupportedCombinationError) Error() string {
+	if len(e.Publishers) == 0 {
+		return fmt.Sprintf("%s stemcells are not published for any IaaS", e.Line)
+	}
+	return fmt.Sprintf("%s stemcells are not published for %s; they are only published for %s", e.Line, e.IaaS, strings.Join(e.Publishers, ", "))
+}
+
+// CanonicalLine resolves a line alias, such as "xenial", to the line's name,
+// such as "ubuntu-xenial".
+func CanonicalLine(name string) (string, bool) {
+	canonical, ok := lineAliases[name]
+	return canonical, ok
+}
+
+// LookupLine resolves a line alias, which may carry a "-raw" suffix to select
+// the raw variant.
+func LookupLine(name string) (line string, raw bool, ok bool) {
+	if line, ok := CanonicalLine(name); ok {
+		return line, false, true
+	}
+	if strings.HasSuffix(name, RawSuffix) {
+		if line, ok := CanonicalLine(strings.TrimSuffix(name, RawSuffix)); ok {
+			return line, true, true
+		}
+	}
+	return "", false, false
+}
+
+// LookupIaaS resolves an IaaS name, which may carry a ":hypervisor" override,
+// to its infrastructure and hypervisor.
+func LookupIaaS(name string) (infrastructure, hypervisor string, err error) {
+	name, override := SplitHypervisor(name)
+
+	i, ok := iaasAliases[name]
+	if !ok {
+		return "", "", &UnknownNameError{Kind: "IaaS", Name: name, Candidates: IaaSNames()}
+	}
+	if override == "" {
+		return i.Infrastructure, i.Hypervisors[0], nil
+	}
+
+	for _, h := range i.Hypervisors {
+		if h == override {
+			return i.Infrastructure, h, nil
+		}
+	}
+	return "", "", &UnknownNameError{Kind: name + " hypervisor", Name: override, Candidates: i.Hypervisors}
+}
+
+// Lookup resolves an IaaS and a line name to a series published in the
+// flavor.
+func Lookup(iaas, line string, flavor Flavor) (Series, error) {
+	infrastructure, hypervisor, err := LookupIaaS(iaas)
+	if err != nil {
+		return Series{}, err
+	}
+
+	name, raw, ok := LookupLine(line)
+	if !ok {
+		return Series{}, &UnknownNameError{Kind: "stemcell line", Name: line, Candidates: LineNames()}
+	}
+
+	s := Series{infrastructure, hypervisor, name, raw}
+	return s, CheckPublished(s, flavor)
+}
+
+// SplitHypervisor splits an IaaS name from its hypervisor override, if any.
+func SplitHypervisor(name string) (string, string) {
+	parts := strings.SplitN(name, HypervisorSeparator, 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// ParseName splits a canonical bosh.io stemcell name, such as
+// "bosh-aws-xen-hvm-ubuntu-xenial-go_agent", into its parts.
+func ParseName(name string) (Series, error) {
+	for _, i := range IaaSes {
+		for _, h := range i.Hypervisors {
+			for _, l := range Lines {
+				for _, raw := range []bool{false, true} {
+					s := Series{Infrastructure: i.Infrastructure, Hypervisor: h, Line: l.Name, Raw: raw}
+					if s.Name() == name {
+						return s, nil
+					}
+				}
+			}
+		}
+	}
+	return Series{}, &UnknownNameError{Kind: "stemcell", Name: name, Candidates: Names()}
+}
+
+// CheckPublished returns an error unless the series' line, or its raw
+// variant, is published for its infrastructure in the flavor.
+func CheckPublished(s Series, flavor Flavor) error {
+	name := s.Line
+	if s.Raw {
+		name += RawSuffix
+	}
+	if flavor != AnyFlavor {
+		name = flavor.String() + " " + name
+	}
+
+	for _, l := range Lines {
+		if l.Name != s.Line {
+			continue
+		}
+		if f, ok := l.Published[s.Infrastructure]; ok && f.offers(s.Raw, flavor) {
+			return nil
+		}
+
+		var publishers []string
+		for _, i := range IaaSes {
+			if f, ok := l.Published[i.Infrastructure]; ok && f.offers(s.Raw, flavor) {
+				publishers = append(publishers, i.Names[0])
+			}
+		}
+		return &UnsupportedCombinationError{IaaS: IaaSDisplayName(s.Infrastructure), Line: name, Publishers: publishers}
+	}
+	return &UnsupportedCombinationError{IaaS: IaaSDisplayName(s.Infrastructure), Line: name}
+}
+
+// IaaSDisplayName is the name shown to users for an infrastructure.
+func IaaSDisplayName(infrastructure string) string {
+	for _, i := range IaaSes {
+		if i.Infrastructure == infrastructure {
+			return i.Names[0]
+		}
+	}
+	return infrastructure
+}
+
+// IaaSNames lists every IaaS name and alias.
+func IaaSNames() []string {
+	names := make([]string, 0, len(iaasAliases))
+	for name := range iaasAliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LineNames lists every line name and alias.
+func LineNames() []string {
+	names := make([]string, 0, len(lineAliases))
+	for name := range lineAliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Names lists the canonical name of every published stemcell series.
+func Names() []string {
+	var names []string
+	for _, l := range Lines {
+		for _, i := range IaaSes {
+			f, ok := l.Published[i.Infrastructure]
+			if !ok {
+				continue
+			}
+			for _, h := range i.Hypervisors {
+				names = append(names, Series{i.Infrastructure, h, l.Name, false}.Name())
+				if f.Raw {
+					names = append(names, Series{i.Infrastructure, h, l.Name, true}.Name())
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,302 @@
+package stemcells
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultServerURL is the public boshstemcells server.
+const DefaultServerURL = "https://boshstemcells.com"
+
+// DefaultLine is the stemcell line resolved when a query does not name one,
+// unless a server is configured with a different default. It should be a line
+// whose lifecycle is still supported, so that a bare IaaS keeps resolving when
+// a server enforces the lifecycle.
+const DefaultLine = "ubuntu-noble"
+
+// Query names a stemcell the way boshstemcells.com URLs do. IaaS and Line
+// accept aliases such as "gcp" and "xenial", Line is the default line when
+// empty, and Version accepts any selector, "latest" when empty. MinAge is the
+// min-age parameter, such as "72h" or "3d". Light asks for the light
+// stemcell's checksum.
+type Query struct {
+	IaaS    string `json:"iaas"`
+	Line    string `json:"line"`
+	Version string `json:"version,omitempty"`
+	MinAge  string `json:"min_age,omitempty"`
+	Light   bool   `json:"light,omitempty"`
+}
+
+// Query returns the query for a version of the series.
+func (s Series) Query(version string) Query {
+	q := Query{IaaS: s.Infrastructure, Line: s.Line, Version: version}
+	for _, i := range IaaSes {
+		if i.Infrastructure == s.Infrastructure {
+			q.IaaS = i.Names[0] + HypervisorSeparator + s.Hypervisor
+		}
+	}
+	for _, l := range Lines {
+		if l.Name == s.Line {
+			q.Line = l.Aliases[0]
+		}
+	}
+	if s.Raw {
+		q.Line += RawSuffix
+	}
+	return q
+}
+
+func (q Query) selector() string {
+	if q.Version == "" {
+		return "latest"
+	}
+	return q.Version
+}
+
+// flavor is the tarball flavor that the query asks for.
+func (q Query) flavor() Flavor {
+	if q.Light {
+		return LightFlavor
+	}
+	return AnyFlavor
+}
+
+// Client resolves stemcells.
+type Client interface {
+	// Resolve returns the version the query resolves to.
+	Resolve(ctx context.Context, q Query) (Resolution, error)
+	// List returns the versions of a series, newest first, limited to a
+	// constraint such as 97.x unless it is empty.
+	List(ctx context.Context, iaas, line, constraint string) ([]Resolution, error)
+	// Checksum returns the sha1 of the tarball the query resolves to.
+	Checksum(ctx context.Context, q Query) (string, error)
+	// Manifest returns the stemcells section of a deployment manifest for
+	// the version the query resolves to.
+	Manifest(ctx context.Context, q Query) (string, error)
+}
+
+// APIError is an error response from a boshstemcells server.
+type APIError struct {
+	Status int    `json:"status"`
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (e *APIError) Error() string {
+	if e.Detail == "" {
+		return http.StatusText(e.Status)
+	}
+	return e.Detail
+}
+
+// HTTPClient is a Client for a boshstemcells server. Requests that fail with
+// a network error or a 5xx status are retried with exponential backoff.
+type HTTPClient struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Retries    int
+	Backoff    time.Duration
+}
+
+// NewHTTPClient returns a client for the server at baseURL that retries
+// failed requests three times.
+func NewHTTPClient(baseURL string) *HTTPClient {
+	return &HTTPClient{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		Retries:    3,
+		Backoff:    500 * time.Millisecond,
+	}
+}
+
+func (c *HTTPClient) Resolve(ctx context.Context, q Query) (Resolution, error) {
+	var res Resolution
+	body, err := c.get(ctx, stemcellPath(q), "application/json")
+	if err != nil {
+		return res, err
+	}
+	return res, json.Unmarshal(body, &res)
+}
+
+func (c *HTTPClient) List(ctx context.Context, iaas, line, constraint string) ([]Resolution, error) {
+	p := "/api/v1/versions/" + url.PathEscape(iaas) + "/" + url.PathEscape(line)
+	if constraint != "" {
+		p += "?" + url.Values{"constraint": {constraint}}.Encode()
+	}
+
+	var list []Resolution
+	body, err := c.get(ctx, p, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	return list, json.Unmarshal(body, &list)
+}
+
+func (c *HTTPClient) Checksum(ctx context.Context, q Query) (string, error) {
+	res, err := c.Resolve(ctx, q)
+	if err != nil {
+		return "", err
+	}
+	_, sha1, err := res.Tarball(q.Light)
+	return sha1, err
+}
+
+func (c *HTTPClient) Manifest(ctx context.Context, q Query) (string, error) {
+	body, err := c.get(ctx, stemcellPath(q), "application/x-yaml")
+	return string(body), err
+}
+
+// stemcellPath is the server path of a query. Without a line the server's
+// default line is used.
+func stemcellPath(q Query) string {
+	p := "/" + url.PathEscape(q.IaaS)
+	if q.Line != "" {
+		p += "/" + url.PathEscape(q.Line)
+	}
+	p += "/" + url.PathEscape(q.selector())
+	if q.MinAge != "" {
+		p += "?" + url.Values{"min-age": {q.MinAge}}.Encode()
+	}
+	return p
+}
+
+func (c *HTTPClient) get(ctx context.Context, p, accept string) ([]byte, error) {
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		body, retry, err := c.try(ctx, p, accept)
+		if !retry || attempt >= c.Retries {
+			return body, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// try makes one request, reporting whether a failure is worth retrying.
+func (c *HTTPClient) try(ctx context.Context, p, accept string) ([]byte, bool, error) {
+	req, err := http.NewRequest("GET", c.BaseURL+p, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", accept)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := &APIError{}
+		if json.Unmarshal(body, apiErr) != nil || apiErr.Detail == "" {
+			apiErr.Detail = strings.TrimSpace(string(body))
+		}
+		apiErr.Status = resp.StatusCode
+		return nil, resp.StatusCode >= 500, apiErr
+	}
+	return body, false, nil
+}
+
+// LocalClient is a Client that resolves stemcells in process against an
+// upstream, without a server. Promotion channels other than edge, aliases
+// and policies are only known to servers.
+type LocalClient struct {
+	resolver Resolver
+}
+
+// NewLocalClient returns a client that resolves against u, such as
+// NewBoshIO(DefaultBoshIOURL, 5*time.Minute).
+func NewLocalClient(u Upstream) *LocalClient {
+	return &LocalClient{resolver: Resolver{Upstream: u}}
+}
+
+func (c *LocalClient) Resolve(ctx context.Context, q Query) (Resolution, error) {
+	if err := ctx.Err(); err != nil {
+		return Resolution{}, err
+	}
+	line := q.Line
+	if line == "" {
+		line = DefaultLine
+	}
+
+	s, err := Lookup(q.IaaS, line, q.flavor())
+	if err != nil {
+		return Resolution{}, err
+	}
+	selector, err := ParseSelector(q.selector())
+	if err != nil {
+		return Resolution{}, err
+	}
+	if q.MinAge != "" {
+		if selector.MinAge, err = ParseMinAge(q.MinAge); err != nil {
+			return Resolution{}, err
+		}
+	}
+
+	version, err := c.resolver.Resolve(s, selector)
+	if err != nil {
+		return Resolution{}, err
+	}
+	return c.resolver.Describe(s, version, time.Now())
+}
+
+func (c *LocalClient) List(ctx context.Context, iaas, line, constraint string) ([]Resolution, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if constraint != "" && !ValidConstraint(constraint) {
+		return nil, &SelectorError{fmt.Sprintf("%q is not a valid constraint; expected a constraint such as 97.x", constraint)}
+	}
+
+	s, err := Lookup(iaas, line, AnyFlavor)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := c.resolver.Upstream.StemcellVersions(s.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	list := []Resolution{}
+	for _, v := range versions {
+		if constraint == "" || MatchesConstraint(v.Version, constraint) {
+			list = append(list, NewResolution(s, v, now))
+		}
+	}
+	return list, nil
+}
+
+func (c *LocalClient) Checksum(ctx context.Context, q Query) (string, error) {
+	res, err := c.Resolve(ctx, q)
+	if err != nil {
+		return "", err
+	}
+	_, sha1, err := res.Tarball(q.Light)
+	return sha1, err
+}
+
+func (c *LocalClient) Manifest(ctx context.Context, q Query) (string, error) {
+	res, err := c.Resolve(ctx, q)
+	if err != nil {
+		return "", err
+	}
+	return res.Manifest(), nil
+}
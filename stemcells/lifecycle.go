@@ -0,0 +1,88 @@
+package stemcells
+
+import (
+	"fmt"
+	"time"
+)
+
+// Lifecycle statuses of a stemcell line.
+const (
+	StatusSupported  = "supported"
+	StatusDeprecated = "deprecated"
+	StatusEndOfLife  = "end-of-life"
+)
+
+// Lifecycle holds the dates a stemcell line became generally available, was
+// deprecated and reaches end of life.
+type Lifecycle struct {
+	GA         time.Time
+	Deprecated time.Time
+	EOL        time.Time
+}
+
+// LifecycleInfo is the JSON form of a line's lifecycle.
+type LifecycleInfo struct {
+	Status     string `json:"status"`
+	GA         string `json:"ga"`
+	Deprecated string `json:"deprecated"`
+	EndOfLife  string `json:"end_of_life"`
+	Warning    string `json:"warning,omitempty"`
+}
+
+func date(value string) time.Time {
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// LineLifecycle returns the lifecycle of a line, which is zero for lines not
+// in the catalog.
+func LineLifecycle(line string) Lifecycle {
+	for _, l := range Lines {
+		if l.Name == line {
+			return l.Lifecycle
+		}
+	}
+	return Lifecycle{}
+}
+
+// Status returns whether the line is supported, deprecated or end of life at
+// the given time.
+func (l Lifecycle) Status(now time.Time) string {
+	switch {
+	case !l.EOL.IsZero() && !now.Before(l.EOL):
+		return StatusEndOfLife
+	case !l.Deprecated.IsZero() && !now.Before(l.Deprecated):
+		return StatusDeprecated
+	}
+	return StatusSupported
+}
+
+// Warning describes a deprecated or end of life line, or is empty for a
+// supported one.
+func (l Lifecycle) Warning(line string, now time.Time) string {
+	switch l.Status(now) {
+	case StatusEndOfLife:
+		return fmt.Sprintf("%s stemcells reached end of life on %s; move to a supported line", line, l.EOL.Format("2006-01-02"))
+	case StatusDeprecated:
+		return fmt.Sprintf("%s stemcells are deprecated and reach end of life on %s", line, l.EOL.Format("2006-01-02"))
+	}
+	return ""
+}
+
+// Info returns the lifecycle of the line at the given time in its JSON form,
+// or nil for lines not in the catalog.
+func (l Lifecycle) Info(line string, now time.Time) *LifecycleInfo {
+	if l.GA.IsZero() {
+		return nil
+	}
+	return &LifecycleInfo{
+		Status:     l.Status(now),
+		GA:         l.GA.Format("2006-01-02"),
+		Deprecated: l.Deprecated.Format("2006-01-02"),
+		EndOfLife:  l.EOL.Format("2006-01-02"),
+		Warning:    l.Warning(line, now),
+	}
+}
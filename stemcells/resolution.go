@@ -0,0 +1,112 @@
+package stemcells
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Resolution describes a resolved version of a stemcell series.
+type Resolution struct {
+	Name            string         `json:"name"`
+	IaaS            string         `json:"iaas"`
+	Hypervisor      string         `json:"hypervisor"`
+	Line            string         `json:"line"`
+	Version         string         `json:"version"`
+	URL             string         `json:"url"`
+	TarballURL      string         `json:"tarball_url,omitempty"`
+	SHA1            string         `json:"sha1,omitempty"`
+	LightTarballURL string         `json:"light_tarball_url,omitempty"`
+	LightSHA1       string         `json:"light_sha1,omitempty"`
+	PublishedAt     *time.Time     `json:"published_at,omitempty"`
+	Lifecycle       *LifecycleInfo `json:"lifecycle,omitempty"`
+}
+
+// BoshIOURL is the bosh.io download URL of a version of a series. An empty
+// version lets bosh.io pick the latest.
+func BoshIOURL(name, version string) string {
+	u := url.URL{
+		Scheme: "https",
+		Host:   "bosh.io",
+		Path:   "/d/stemcells/" + name,
+	}
+	if version != "" {
+		u.RawQuery = url.Values{"v": {version}}.Encode()
+	}
+	return u.String()
+}
+
+// NewResolution describes an upstream version of a series.
+func NewResolution(s Series, v Version, now time.Time) Resolution {
+	res := Resolution{
+		Name:       s.Name(),
+		IaaS:       s.Infrastructure,
+		Hypervisor: s.Hypervisor,
+		Line:       s.Line,
+		Version:    v.Version,
+		URL:        BoshIOURL(s.Name(), v.Version),
+		Lifecycle:  LineLifecycle(s.Line).Info(s.Line, now),
+	}
+
+	tarball := v.Regular
+	if tarball == nil {
+		tarball = v.Light
+	}
+	if tarball != nil {
+		res.TarballURL, res.SHA1 = tarball.URL, tarball.SHA1
+	}
+	if v.Light != nil {
+		res.LightTarballURL, res.LightSHA1 = v.Light.URL, v.Light.SHA1
+	}
+	if !v.PublishedAt.IsZero() {
+		publishedAt := v.PublishedAt
+		res.PublishedAt = &publishedAt
+	}
+	return res
+}
+
+// Describe looks up a version of a series upstream. An empty version is
+// resolved to the newest one.
+func (r Resolver) Describe(s Series, version string, now time.Time) (Resolution, error) {
+	versions, err := r.Upstream.StemcellVersions(s.Name())
+	if err != nil {
+		return Resolution{}, err
+	}
+	if version == "" {
+		if len(versions) == 0 {
+			return Resolution{}, &NoVersionError{Name: s.Name(), Detail: "no versions"}
+		}
+		version = versions[0].Version
+	}
+
+	for _, v := range versions {
+		if v.Version == version {
+			return NewResolution(s, v, now), nil
+		}
+	}
+	return NewResolution(s, Version{Name: s.Name(), Version: version}, now), nil
+}
+
+// Tarball returns the URL and sha1 of the full or light stemcell.
+func (res Resolution) Tarball(light bool) (url, sha1 string, err error) {
+	if light {
+		if res.LightTarballURL == "" {
+			return "", "", fmt.Errorf("%s %s has no light stemcell", res.Name, res.Version)
+		}
+		return res.LightTarballURL, res.LightSHA1, nil
+	}
+	if res.TarballURL == "" {
+		return "", "", fmt.Errorf("%s %s has no tarball", res.Name, res.Version)
+	}
+	return res.TarballURL, res.SHA1, nil
+}
+
+// Manifest is the stemcells section of a BOSH deployment manifest that
+// deploys the resolved version, with the command that uploads it.
+func (res Resolution) Manifest() string {
+	manifest := ""
+	if res.TarballURL != "" {
+		manifest = fmt.Sprintf("# bosh upload-stemcell --sha1 %s %s\n", res.SHA1, res.TarballURL)
+	}
+	return manifest + fmt.Sprintf("stemcells:\n- alias: default\n  os: %s\n  version: %q\n", res.Line, res.Version)
+}
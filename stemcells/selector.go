@@ -0,0 +1,312 @@
+package stemcells
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Promotion channels. Edge is the newest version upstream, candidate is the
+// version most recently promoted on a server and stable is the newest
+// candidate that has soaked in candidate for long enough.
+const (
+	ChannelEdge      = "edge"
+	ChannelCandidate = "candidate"
+	ChannelStable    = "stable"
+)
+
+// timeTravelPrefix marks a version selector as a date, e.g. "@2018-06-01".
+const timeTravelPrefix = "@"
+
+// offsetSeparator separates a selector from the number of versions to step
+// back from it, e.g. "latest~2".
+const offsetSeparator = "~"
+
+var (
+	versionPattern    = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+	constraintPattern = regexp.MustCompile(`^([0-9]+(\.[0-9]+)*)\.x$`)
+	nMinusPattern     = regexp.MustCompile(`^n-([0-9]+)$`)
+	dayPattern        = regexp.MustCompile(`^([0-9]+)d$`)
+)
+
+// IsChannel reports whether name is a promotion channel.
+func IsChannel(name string) bool {
+	switch name {
+	case ChannelEdge, ChannelCandidate, ChannelStable:
+		return true
+	}
+	return false
+}
+
+// ValidVersion reports whether version is a dotted sequence of numbers, such
+// as 3586.26.
+func ValidVersion(version string) bool {
+	return versionPattern.MatchString(version)
+}
+
+// ValidConstraint reports whether constraint is a version prefix followed by
+// ".x", such as 97.x.
+func ValidConstraint(constraint string) bool {
+	return constraintPattern.MatchString(constraint)
+}
+
+// MatchesConstraint reports whether version satisfies a constraint such as
+// 97.x.
+func MatchesConstraint(version, constraint string) bool {
+	return strings.HasPrefix(version, strings.TrimSuffix(constraint, "x"))
+}
+
+// Selector picks a version of a stemcell series. The zero value picks the
+// latest version. A non-zero time picks the version that latest would have
+// resolved to at that time. A constraint such as "97." limits latest to the
+// versions that start with it, and an offset steps back that many versions
+// from whatever the rest of the selector picks. A minimum age excludes
+// versions published more recently from latest, edge and time-travel
+// resolution.
+type Selector struct {
+	Version    string
+	Channel    string
+	At         time.Time
+	Constraint string
+	Offset     int
+	MinAge     time.Duration
+}
+
+// SelectorError is returned for a version selector that cannot be parsed.
+type SelectorError struct {
+	Detail string
+}
+
+func (e *SelectorError) Error() string {
+	return e.Detail
+}
+
+// NoVersionError is returned when a selector matches no version upstream.
+type NoVersionError struct {
+	Name   string
+	Detail string
+}
+
+func (e *NoVersionError) Error() string {
+	return fmt.Sprintf("%s has %s", e.Name, e.Detail)
+}
+
+// TooNewError is returned when no version of a series is old enough. The
+// reason says what old enough means, e.g. "at least 72h0m0s ago".
+type TooNewError struct {
+	Name   string
+	Reason string
+}
+
+func (e *TooNewError) Error() string {
+	return fmt.Sprintf("no version of %s was published %s", e.Name, e.Reason)
+}
+
+// ParseSelector parses a version selector: "latest", "previous", "n-1", a
+// channel, "@" followed by a date or time, a constraint such as 97.x, an
+// exact version, or any of these followed by "~" and a number of versions to
+// step back.
+func ParseSelector(version string) (Selector, error) {
+	switch {
+	case version == "previous":
+		return Selector{Offset: 1}, nil
+	case nMinusPattern.MatchString(version):
+		n, _ := strconv.Atoi(nMinusPattern.FindStringSubmatch(version)[1])
+		return Selector{Offset: n}, nil
+	case strings.Contains(version, offsetSeparator):
+		i := strings.LastIndex(version, offsetSeparator)
+		n, err := strconv.Atoi(version[i+1:])
+		if err != nil || n < 0 {
+			return Selector{}, &SelectorError{fmt.Sprintf("%q is not a valid relative version; expected a selector followed by ~ and a number, such as latest~2", version)}
+		}
+		selector, err := ParseSelector(version[:i])
+		if err != nil {
+			return Selector{}, err
+		}
+		selector.Offset += n
+		return selector, nil
+	}
+
+	switch {
+	case version == "latest":
+		return Selector{}, nil
+	case IsChannel(version):
+		return Selector{Channel: version}, nil
+	case strings.HasPrefix(version, timeTravelPrefix):
+		return parseTimeTravel(strings.TrimPrefix(version, timeTravelPrefix))
+	case constraintPattern.MatchString(version):
+		return Selector{Constraint: strings.TrimSuffix(version, "x")}, nil
+	case versionPattern.MatchString(version):
+		return Selector{Version: version}, nil
+	}
+	return Selector{}, &SelectorError{fmt.Sprintf("%q is not a valid stemcell version; expected \"latest\", a channel such as \"stable\", a constraint such as 97.x or a version such as 3586.26", version)}
+}
+
+// parseTimeTravel parses the date of an @date selector. A bare date such as
+// 2018-06-01 means the end of that day in UTC; an RFC 3339 time is used as is.
+func parseTimeTravel(value string) (Selector, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return Selector{At: t}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return Selector{At: t.Add(24*time.Hour - time.Second)}, nil
+	}
+	return Selector{}, &SelectorError{fmt.Sprintf("%q is not a valid date; expected a date such as 2018-06-01 or a time such as 2018-06-01T12:00:00Z", value)}
+}
+
+// ParseMinAge parses a minimum age, which is a Go duration such as "72h" or
+// a number of days such as "3d".
+func ParseMinAge(value string) (time.Duration, error) {
+	if m := dayPattern.FindStringSubmatch(value); m != nil {
+		days, _ := strconv.Atoi(m[1])
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, &SelectorError{fmt.Sprintf("%q is not a valid min-age; expected a duration such as 72h or 3d", value)}
+	}
+	return d, nil
+}
+
+// IsVersionKeyword reports whether a path segment is a word that selects a
+// version rather than naming a stemcell line.
+func IsVersionKeyword(segment string) bool {
+	return segment == "latest" || segment == "previous" || IsChannel(segment) || nMinusPattern.MatchString(segment)
+}
+
+// Resolver resolves selectors against an upstream.
+type Resolver struct {
+	Upstream Upstream
+
+	// Channel resolves promotion channels, which are kept by a server. When
+	// it is nil only the edge channel can be resolved.
+	Channel func(s Series, channel string, minAge time.Duration) (string, error)
+}
+
+// Resolve returns the version picked by the selector, or an empty string to
+// let bosh.io pick the latest.
+func (r Resolver) Resolve(s Series, selector Selector) (string, error) {
+	if selector.Constraint != "" || selector.Offset > 0 {
+		return r.resolveRelative(s, selector)
+	}
+
+	switch {
+	case selector.Channel != "":
+		return r.resolveChannel(s, selector.Channel, selector.MinAge)
+	case selector.Version != "":
+		return selector.Version, nil
+	case !selector.At.IsZero():
+		return r.NewestAt(s, selector.At.Add(-selector.MinAge))
+	case selector.MinAge > 0:
+		return r.Newest(s, selector.MinAge)
+	}
+	return "", nil
+}
+
+func (r Resolver) resolveChannel(s Series, channel string, minAge time.Duration) (string, error) {
+	if r.Channel != nil {
+		return r.Channel(s, channel, minAge)
+	}
+	if channel == ChannelEdge {
+		return r.Newest(s, minAge)
+	}
+	return "", fmt.Errorf("the %s channel is only known to a boshstemcells server", channel)
+}
+
+// resolveRelative resolves constraints and offsets by walking backward
+// through the upstream version list, which is sorted newest first.
+func (r Resolver) resolveRelative(s Series, selector Selector) (string, error) {
+	versions, err := r.Upstream.StemcellVersions(s.Name())
+	if err != nil {
+		return "", err
+	}
+
+	var candidates []string
+	anchor := 0
+	if selector.Channel == "" && selector.Version == "" {
+		cutoff := time.Now()
+		if !selector.At.IsZero() {
+			cutoff = selector.At
+		}
+		cutoff = cutoff.Add(-selector.MinAge)
+
+		for _, v := range versions {
+			if strings.HasPrefix(v.Version, selector.Constraint) && publishedBy(v, cutoff) {
+				candidates = append(candidates, v.Version)
+			}
+		}
+		if len(candidates) == 0 {
+			return "", &NoVersionError{Name: s.Name(), Detail: fmt.Sprintf("no version matching %sx", selector.Constraint)}
+		}
+	} else {
+		base := selector
+		base.Offset = 0
+		version, err := r.Resolve(s, base)
+		if err != nil {
+			return "", err
+		}
+
+		anchor = -1
+		for i, v := range versions {
+			candidates = append(candidates, v.Version)
+			if v.Version == version {
+				anchor = i
+			}
+		}
+		if anchor < 0 {
+			return "", &NoVersionError{Name: s.Name(), Detail: fmt.Sprintf("no version %s", version)}
+		}
+	}
+
+	if anchor+selector.Offset >= len(candidates) {
+		return "", &NoVersionError{Name: s.Name(), Detail: fmt.Sprintf("fewer than %d versions before %s", selector.Offset, candidates[anchor])}
+	}
+	return candidates[anchor+selector.Offset], nil
+}
+
+// Newest returns the newest version of the series published at least minAge
+// ago.
+func (r Resolver) Newest(s Series, minAge time.Duration) (string, error) {
+	if minAge <= 0 {
+		versions, err := r.Upstream.StemcellVersions(s.Name())
+		if err != nil {
+			return "", err
+		}
+		if len(versions) == 0 {
+			return "", &TooNewError{Name: s.Name(), Reason: "yet"}
+		}
+		return versions[0].Version, nil
+	}
+
+	version, err := r.NewestAt(s, time.Now().Add(-minAge))
+	if _, ok := err.(*TooNewError); ok {
+		return "", &TooNewError{Name: s.Name(), Reason: fmt.Sprintf("at least %s ago", minAge)}
+	}
+	return version, err
+}
+
+// NewestAt returns the newest version of the series published by the cutoff,
+// i.e. the version latest would have resolved to at that time.
+func (r Resolver) NewestAt(s Series, cutoff time.Time) (string, error) {
+	versions, err := r.Upstream.StemcellVersions(s.Name())
+	if err != nil {
+		return "", err
+	}
+
+	for _, v := range versions {
+		if publishedBy(v, cutoff) {
+			return v.Version, nil
+		}
+	}
+	return "", &TooNewError{Name: s.Name(), Reason: "by " + cutoff.UTC().Format(time.RFC3339)}
+}
+
+// publishedBy reports whether v was published by the cutoff. Versions with no
+// known publish date predate the records and are taken to be published by
+// every cutoff.
+func publishedBy(v Version, cutoff time.Time) bool {
+	return v.PublishedAt.IsZero() || !v.PublishedAt.After(cutoff)
+}
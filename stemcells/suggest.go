@@ -0,0 +1,87 @@
+package stemcells
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnknownNameError is returned when a name, such as an IaaS or stemcell line,
+// does not exist. Candidates are the valid names.
+type UnknownNameError struct {
+	Kind       string
+	Name       string
+	Candidates []string
+}
+
+func (e *UnknownNameError) Error() string {
+	return fmt.Sprintf("unknown %s %q", e.Kind, e.Name)
+}
+
+// Suggestions are the candidates the name is probably a misspelling of.
+func (e *UnknownNameError) Suggestions() []string {
+	return Suggest(e.Name, e.Candidates)
+}
+
+// Suggest returns the candidates closest to name by edit distance, or nil
+// when none of them is a plausible misspelling.
+func Suggest(name string, candidates []string) []string {
+	name = strings.ToLower(name)
+
+	maxDistance := 2
+	if len(name) <= 3 {
+		maxDistance = 1
+	}
+
+	var suggestions []string
+	best := maxDistance + 1
+	for _, candidate := range candidates {
+		d := editDistance(name, strings.ToLower(candidate))
+		switch {
+		case d < best:
+			best, suggestions = d, []string{candidate}
+		case d == best:
+			suggestions = append(suggestions, candidate)
+		}
+	}
+	return suggestions
+}
+
+// editDistance is the optimal string alignment distance between a and b:
+// the number of insertions, deletions, substitutions and adjacent
+// transpositions needed to turn one into the other.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
+
+func minInt(first int, rest ...int) int {
+	m := first
+	for _, v := range rest {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
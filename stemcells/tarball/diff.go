@@ -0,0 +1,201 @@
+package tarball
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Change is a package whose version differs between two stemcells.
+type Change struct {
+	Name         string `json:"name"`
+	Architecture string `json:"architecture,omitempty"`
+	From         string `json:"from"`
+	To           string `json:"to"`
+}
+
+// KernelChange is a change of kernel, which usually also renames the kernel
+// package.
+type KernelChange struct {
+	From *Package `json:"from"`
+	To   *Package `json:"to"`
+}
+
+// Diff is what changed between the packages of two stemcells. The kernel
+// change, if any, is also listed among the other packages.
+type Diff struct {
+	Added      []Package     `json:"added"`
+	Removed    []Package     `json:"removed"`
+	Upgraded   []Change      `json:"upgraded"`
+	Downgraded []Change      `json:"downgraded"`
+	Kernel     *KernelChange `json:"kernel,omitempty"`
+}
+
+// Empty reports whether nothing changed.
+func (d Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Upgraded) == 0 && len(d.Downgraded) == 0
+}
+
+// packageKey identifies a package across stemcells. Multiarch images can
+// have a package installed once for each architecture.
+type packageKey struct {
+	name, architecture string
+}
+
+func (k packageKey) less(other packageKey) bool {
+	if k.name != other.name {
+		return k.name < other.name
+	}
+	return k.architecture < other.architecture
+}
+
+// DiffPackages compares the packages of two stemcells by name and
+// architecture, sorting each list by package name.
+func DiffPackages(from, to []Package) Diff {
+	d := Diff{Added: []Package{}, Removed: []Package{}, Upgraded: []Change{}, Downgraded: []Change{}}
+
+	old := make(map[packageKey]Package, len(from))
+	for _, p := range from {
+		old[packageKey{p.Name, p.Architecture}] = p
+	}
+	seen := make(map[packageKey]bool, len(to))
+	for _, p := range to {
+		key := packageKey{p.Name, p.Architecture}
+		seen[key] = true
+		previous, ok := old[key]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, p)
+		case CompareVersions(previous.Version, p.Version) < 0:
+			d.Upgraded = append(d.Upgraded, Change{p.Name, p.Architecture, previous.Version, p.Version})
+		case CompareVersions(previous.Version, p.Version) > 0:
+			d.Downgraded = append(d.Downgraded, Change{p.Name, p.Architecture, previous.Version, p.Version})
+		}
+	}
+	for _, p := range from {
+		if !seen[packageKey{p.Name, p.Architecture}] {
+			d.Removed = append(d.Removed, p)
+		}
+	}
+
+	sortPackages(d.Added)
+	sortPackages(d.Removed)
+	sortChanges(d.Upgraded)
+	sortChanges(d.Downgraded)
+
+	fromKernel, toKernel := Kernel(from), Kernel(to)
+	if fromKernel != nil || toKernel != nil {
+		if fromKernel == nil || toKernel == nil || *fromKernel != *toKernel {
+			d.Kernel = &KernelChange{fromKernel, toKernel}
+		}
+	}
+	return d
+}
+
+func sortPackages(packages []Package) {
+	sort.Slice(packages, func(i, j int) bool {
+		return packageKey{packages[i].Name, packages[i].Architecture}.less(packageKey{packages[j].Name, packages[j].Architecture})
+	})
+}
+
+func sortChanges(changes []Change) {
+	sort.Slice(changes, func(i, j int) bool {
+		return packageKey{changes[i].Name, changes[i].Architecture}.less(packageKey{changes[j].Name, changes[j].Architecture})
+	})
+}
+
+// CompareVersions orders two Debian or RPM package versions, returning -1, 0
+// or 1. An epoch such as "1:" outranks the rest of the version, and a tilde
+// sorts before anything, even the end of the version, so that 1.0~rc1 comes
+// before 1.0.
+func CompareVersions(a, b string) int {
+	epochA, restA := splitEpoch(a)
+	epochB, restB := splitEpoch(b)
+	if epochA != epochB {
+		if epochA < epochB {
+			return -1
+		}
+		return 1
+	}
+
+	for restA != "" || restB != "" {
+		var textA, textB string
+		textA, restA = splitLeading(restA, false)
+		textB, restB = splitLeading(restB, false)
+		if c := compareText(textA, textB); c != 0 {
+			return c
+		}
+
+		var digitsA, digitsB string
+		digitsA, restA = splitLeading(restA, true)
+		digitsB, restB = splitLeading(restB, true)
+		if c := compareDigits(digitsA, digitsB); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func splitEpoch(version string) (int, string) {
+	i := strings.Index(version, ":")
+	if i < 0 {
+		return 0, version
+	}
+	epoch, err := strconv.Atoi(version[:i])
+	if err != nil {
+		return 0, version
+	}
+	return epoch, version[i+1:]
+}
+
+// splitLeading splits off the leading run of digits, or of non-digits.
+func splitLeading(s string, digits bool) (string, string) {
+	i := 0
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9') == digits {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func compareDigits(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// compareText compares non-digit runs the way dpkg does: letters sort before
+// other characters, and a tilde before everything.
+func compareText(a, b string) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var ca, cb int
+		if i < len(a) {
+			ca = textOrder(a[i])
+		}
+		if i < len(b) {
+			cb = textOrder(b[i])
+		}
+		if ca != cb {
+			if ca < cb {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func textOrder(c byte) int {
+	switch {
+	case c == '~':
+		return -1
+	case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		return int(c)
+	default:
+		return int(c) + 256
+	}
+}
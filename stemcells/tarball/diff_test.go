@@ -0,0 +1,85 @@
+package tarball_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"code.benchapman.ie/boshstemcells/stemcells/tarball"
+)
+
+var _ = Describe("CompareVersions", func() {
+	DescribeTable("orders package versions", func(a, b string, expected int) {
+		Expect(tarball.CompareVersions(a, b)).To(Equal(expected))
+		Expect(tarball.CompareVersions(b, a)).To(Equal(-expected))
+	},
+		Entry("equal versions", "3.0.13-0ubuntu3.1", "3.0.13-0ubuntu3.1", 0),
+		Entry("numbers rather than text", "3.0.13-0ubuntu3.1", "3.0.13-0ubuntu3.10", -1),
+		Entry("leading zeros", "1.010", "1.10", 0),
+		Entry("an epoch", "1:1.0", "2.0", 1),
+		Entry("a tilde before the end", "2024a~rc1", "2024a", -1),
+		Entry("a tilde before anything", "1.0~rc1", "1.0~~", 1),
+		Entry("letters before other characters", "1.0a", "1.0+", -1),
+		Entry("a longer version", "1.0", "1.0.1", -1),
+		Entry("RPM releases", "5.1.8-6.el8", "5.1.8-10.el8", -1),
+	)
+})
+
+var _ = Describe("DiffPackages", func() {
+	It("lists added, removed, upgraded and downgraded packages by name", func() {
+		d := tarball.DiffPackages([]tarball.Package{
+			{Name: "openssl", Version: "3.0.13-0ubuntu3.1"},
+			{Name: "curl", Version: "8.5.0"},
+			{Name: "libfoo", Version: "2.0"},
+			{Name: "bash", Version: "5.2"},
+		}, []tarball.Package{
+			{Name: "wget", Version: "1.21"},
+			{Name: "openssl", Version: "3.0.13-0ubuntu3.10"},
+			{Name: "libfoo", Version: "1.9"},
+			{Name: "bash", Version: "5.2"},
+			{Name: "apt", Version: "2.7"},
+		})
+
+		Expect(d.Added).To(Equal([]tarball.Package{{Name: "apt", Version: "2.7"}, {Name: "wget", Version: "1.21"}}))
+		Expect(d.Removed).To(Equal([]tarball.Package{{Name: "curl", Version: "8.5.0"}}))
+		Expect(d.Upgraded).To(Equal([]tarball.Change{{Name: "openssl", From: "3.0.13-0ubuntu3.1", To: "3.0.13-0ubuntu3.10"}}))
+		Expect(d.Downgraded).To(Equal([]tarball.Change{{Name: "libfoo", From: "2.0", To: "1.9"}}))
+		Expect(d.Kernel).To(BeNil())
+		Expect(d.Empty()).To(BeFalse())
+	})
+
+	It("tells apart the architectures of a package", func() {
+		d := tarball.DiffPackages([]tarball.Package{
+			{Name: "libc6", Version: "2.39-0ubuntu8.1", Architecture: "amd64"},
+			{Name: "libc6", Version: "2.39-0ubuntu8.1", Architecture: "i386"},
+		}, []tarball.Package{
+			{Name: "libc6", Version: "2.39-0ubuntu8.3", Architecture: "amd64"},
+			{Name: "libc6", Version: "2.39-0ubuntu8.1", Architecture: "i386"},
+			{Name: "libc6", Version: "2.39-0ubuntu8.3", Architecture: "arm64"},
+		})
+
+		Expect(d.Added).To(Equal([]tarball.Package{{Name: "libc6", Version: "2.39-0ubuntu8.3", Architecture: "arm64"}}))
+		Expect(d.Removed).To(BeEmpty())
+		Expect(d.Upgraded).To(Equal([]tarball.Change{{Name: "libc6", Architecture: "amd64", From: "2.39-0ubuntu8.1", To: "2.39-0ubuntu8.3"}}))
+		Expect(d.Downgraded).To(BeEmpty())
+	})
+
+	It("calls out kernel changes", func() {
+		d := tarball.DiffPackages([]tarball.Package{
+			{Name: "linux-image-6.8.0-40-generic", Version: "6.8.0-40.40"},
+		}, []tarball.Package{
+			{Name: "linux-image-6.8.0-45-generic", Version: "6.8.0-45.45"},
+		})
+
+		Expect(d.Kernel).ToNot(BeNil())
+		Expect(d.Kernel.From).To(Equal(&tarball.Package{Name: "linux-image-6.8.0-40-generic", Version: "6.8.0-40.40"}))
+		Expect(d.Kernel.To).To(Equal(&tarball.Package{Name: "linux-image-6.8.0-45-generic", Version: "6.8.0-45.45"}))
+	})
+
+	It("is empty when nothing changed", func() {
+		packages := []tarball.Package{{Name: "bash", Version: "5.2"}}
+		d := tarball.DiffPackages(packages, packages)
+		Expect(d.Empty()).To(BeTrue())
+		Expect(d.Kernel).To(BeNil())
+	})
+})
@@ -0,0 +1,279 @@
+// Package tarball reads BOSH stemcell tarballs: the stemcell.MF manifest at
+// their root, the checksum of the image it describes, and the list of
+// packages installed in the image.
+package tarball
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Manifest is the stemcell.MF of a stemcell.
+type Manifest struct {
+	Name            string                 `json:"name" yaml:"name"`
+	Version         string                 `json:"version" yaml:"version"`
+	OperatingSystem string                 `json:"operating_system" yaml:"operating_system"`
+	APIVersion      int                    `json:"api_version,omitempty" yaml:"api_version"`
+	BoshProtocol    string                 `json:"bosh_protocol,omitempty" yaml:"bosh_protocol"`
+	SHA1            string                 `json:"sha1" yaml:"sha1"`
+	StemcellFormats []string               `json:"stemcell_formats,omitempty" yaml:"stemcell_formats"`
+	CloudProperties map[string]interface{} `json:"cloud_properties" yaml:"-"`
+}
+
+// Package is a package installed in a stemcell's image.
+type Package struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Architecture string `json:"architecture,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+// Inspection is what a stemcell tarball contains. SHA1 is the checksum of the
+// tarball itself, and ImageSHA1 that of the image in it, which should match
+// the manifest's sha1 for full stemcells. Packages is empty for stemcells,
+// such as Windows ones, that do not list their packages.
+type Inspection struct {
+	Manifest  Manifest  `json:"manifest"`
+	SHA1      string    `json:"sha1"`
+	ImageSHA1 string    `json:"image_sha1,omitempty"`
+	Packages  []Package `json:"packages"`
+	Kernel    *Package  `json:"kernel,omitempty"`
+}
+
+// FormatError is returned for input that is not a stemcell tarball.
+type FormatError struct {
+	Detail string
+}
+
+func (e *FormatError) Error() string {
+	return "not a stemcell tarball: " + e.Detail
+}
+
+// maxManifestSize is the largest stemcell.MF that will be read. Manifests
+// are a few kilobytes, and the limit keeps a tarball that decompresses to far
+// more from filling memory.
+const maxManifestSize = 1 << 20
+
+// packageLists are the files that stemcells list their packages in, in order
+// of preference, with their parsers. Ubuntu stemcells ship the output of
+// dpkg -l and CentOS ones that of rpm -qa.
+var packageLists = []struct {
+	name  string
+	parse func(io.Reader) ([]Package, error)
+}{
+	{"stemcell_dpkg_l.txt", ParsePackages},
+	{"packages.txt", ParsePackages},
+	{"stemcell_rpm_qa.txt", ParseRPMPackages},
+}
+
+// PackageListNames returns the names of the files that stemcells list their
+// packages in, in order of preference.
+func PackageListNames() []string {
+	names := make([]string, len(packageLists))
+	for i, list := range packageLists {
+		names[i] = list.name
+	}
+	return names
+}
+
+// ParsePackageList parses a package list by the name of its file, one of
+// PackageListNames.
+func ParsePackageList(name string, r io.Reader) ([]Package, error) {
+	for _, list := range packageLists {
+		if list.name == name {
+			return list.parse(r)
+		}
+	}
+	return nil, fmt.Errorf("%s is not a known package list", name)
+}
+
+// Inspect reads a gzipped stemcell tarball to the end.
+func Inspect(r io.Reader) (Inspection, error) {
+	var i Inspection
+
+	hash := sha1.New()
+	gz, err := gzip.NewReader(io.TeeReader(r, hash))
+	if err != nil {
+		return i, &FormatError{err.Error()}
+	}
+
+	lists := map[string][]Package{}
+	hasManifest := false
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return i, &FormatError{err.Error()}
+		}
+
+		switch name := strings.TrimPrefix(hdr.Name, "./"); name {
+		case "stemcell.MF":
+			data, err := ioutil.ReadAll(io.LimitReader(tr, maxManifestSize+1))
+			if err != nil {
+				return i, &FormatError{err.Error()}
+			}
+			if len(data) > maxManifestSize {
+				return i, &FormatError{fmt.Sprintf("stemcell.MF is larger than %d bytes", maxManifestSize)}
+			}
+			if i.Manifest, err = ParseManifest(data); err != nil {
+				return i, err
+			}
+			hasManifest = true
+		case "image":
+			imageHash := sha1.New()
+			if _, err := io.Copy(imageHash, tr); err != nil {
+				return i, &FormatError{err.Error()}
+			}
+			i.ImageSHA1 = hex.EncodeToString(imageHash.Sum(nil))
+		default:
+			for _, list := range packageLists {
+				if name == list.name {
+					if lists[name], err = list.parse(tr); err != nil {
+						return i, &FormatError{fmt.Sprintf("%s: %s", name, err)}
+					}
+				}
+			}
+		}
+	}
+	if !hasManifest {
+		return i, &FormatError{"it has no stemcell.MF"}
+	}
+
+	// Read whatever follows the tar stream so the checksum covers it.
+	if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+		return i, &FormatError{err.Error()}
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return i, err
+	}
+	i.SHA1 = hex.EncodeToString(hash.Sum(nil))
+
+	i.Packages = []Package{}
+	for _, list := range packageLists {
+		if packages, ok := lists[list.name]; ok {
+			i.Packages = packages
+			break
+		}
+	}
+	i.Kernel = Kernel(i.Packages)
+	return i, nil
+}
+
+// ParseManifest parses a stemcell.MF.
+func ParseManifest(data []byte) (Manifest, error) {
+	var raw struct {
+		Manifest        `yaml:",inline"`
+		CloudProperties interface{} `yaml:"cloud_properties"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return Manifest{}, &FormatError{"stemcell.MF: " + err.Error()}
+	}
+	if raw.Name == "" || raw.Version == "" {
+		return Manifest{}, &FormatError{"stemcell.MF has no name or version"}
+	}
+
+	m := raw.Manifest
+	m.CloudProperties = map[string]interface{}{}
+	if properties, ok := jsonValue(raw.CloudProperties).(map[string]interface{}); ok {
+		m.CloudProperties = properties
+	}
+	return m, nil
+}
+
+// jsonValue converts the maps of a decoded YAML value, which may have keys
+// of any type, to maps with string keys that can be encoded as JSON.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, value := range v {
+			list[i] = jsonValue(value)
+		}
+		return list
+	default:
+		return v
+	}
+}
+
+// ParsePackages parses the output of dpkg -l, keeping installed packages.
+func ParsePackages(r io.Reader) ([]Package, error) {
+	packages := []Package{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || len(fields[0]) < 2 || fields[0][1] != 'i' {
+			continue
+		}
+
+		p := Package{Name: fields[1], Version: fields[2]}
+		if i := strings.Index(p.Name, ":"); i >= 0 {
+			p.Name, p.Architecture = p.Name[:i], p.Name[i+1:]
+		}
+		if len(fields) > 3 {
+			p.Architecture = fields[3]
+		}
+		if len(fields) > 4 {
+			p.Description = strings.Join(fields[4:], " ")
+		}
+		packages = append(packages, p)
+	}
+	return packages, scanner.Err()
+}
+
+// ParseRPMPackages parses the output of rpm -qa, whose lines name packages as
+// name-version-release.arch.
+func ParseRPMPackages(r io.Reader) ([]Package, error) {
+	packages := []Package{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		p := Package{}
+		if i := strings.LastIndex(line, "."); i >= 0 {
+			line, p.Architecture = line[:i], line[i+1:]
+		}
+
+		parts := strings.Split(line, "-")
+		if len(parts) < 3 {
+			continue
+		}
+		p.Name = strings.Join(parts[:len(parts)-2], "-")
+		p.Version = strings.Join(parts[len(parts)-2:], "-")
+		packages = append(packages, p)
+	}
+	return packages, scanner.Err()
+}
+
+// kernelPattern matches the package of a specific kernel, such as
+// linux-image-4.15.0-50-generic, rather than a metapackage that depends on
+// the newest one. RPM-based stemcells call it kernel.
+var kernelPattern = regexp.MustCompile(`^(linux-image-(unsigned-)?[0-9]|kernel$)`)
+
+// Kernel returns the kernel package among packages, if any.
+func Kernel(packages []Package) *Package {
+	for _, p := range packages {
+		if kernelPattern.MatchString(p.Name) {
+			kernel := p
+			return &kernel
+		}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package tarball_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestTarball(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Tarball Suite")
+}
@@ -0,0 +1,182 @@
+package stemcells
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells/tarball"
+)
+
+// DefaultBoshIOURL is the bosh.io API.
+const DefaultBoshIOURL = "https://bosh.io"
+
+// Upstream lists the published versions of a stemcell series, newest first,
+// and the packages installed in each version.
+type Upstream interface {
+	StemcellVersions(name string) ([]Version, error)
+	StemcellPackages(name, version string) ([]tarball.Package, error)
+}
+
+// Version is one published version of a stemcell series as described by the
+// bosh.io API. PublishedAt is zero when the publish date is unknown, and
+// such versions are taken to be older than any minimum age or date.
+type Version struct {
+	Name        string    `json:"name"`
+	Version     string    `json:"version"`
+	PublishedAt time.Time `json:"published_at"`
+	Regular     *Tarball  `json:"regular,omitempty"`
+	Light       *Tarball  `json:"light,omitempty"`
+}
+
+// Tarball is a downloadable stemcell.
+type Tarball struct {
+	URL    string `json:"url"`
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5,omitempty"`
+	SHA1   string `json:"sha1,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// UpstreamError is returned when the upstream cannot be reached or answers
+// with something unexpected.
+type UpstreamError struct {
+	Err error
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("could not list stemcell versions from bosh.io: %s", e.Err)
+}
+
+type cachedVersions struct {
+	fetchedAt time.Time
+	versions  []Version
+}
+
+// BoshIO lists stemcell versions from the bosh.io API, caching each series
+// for a while.
+type BoshIO struct {
+	baseURL    string
+	ttl        time.Duration
+	httpClient *http.Client
+
+	mu       sync.Mutex
+	cache    map[string]cachedVersions
+	packages map[string][]tarball.Package
+}
+
+// NewBoshIO returns an upstream for the bosh.io API at baseURL that reuses a
+// series' version list for ttl before asking again.
+func NewBoshIO(baseURL string, ttl time.Duration) *BoshIO {
+	return &BoshIO{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		ttl:        ttl,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		cache:      map[string]cachedVersions{},
+		packages:   map[string][]tarball.Package{},
+	}
+}
+
+// StemcellVersions returns the versions of the named series, newest first.
+func (c *BoshIO) StemcellVersions(name string) ([]Version, error) {
+	c.mu.Lock()
+	cached, ok := c.cache[name]
+	c.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < c.ttl {
+		return cached.versions, nil
+	}
+
+	r, err := c.httpClient.Get(fmt.Sprintf("%s/api/v1/stemcells/%s", c.baseURL, url.PathEscape(name)))
+	if err != nil {
+		return nil, &UpstreamError{err}
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return nil, &UpstreamError{fmt.Errorf("unexpected status %s", r.Status)}
+	}
+
+	var versions []Version
+	if err := json.NewDecoder(r.Body).Decode(&versions); err != nil {
+		return nil, &UpstreamError{err}
+	}
+	SortDescending(versions)
+
+	c.mu.Lock()
+	c.cache[name] = cachedVersions{fetchedAt: time.Now(), versions: versions}
+	c.mu.Unlock()
+
+	return versions, nil
+}
+
+// StemcellPackages returns the packages installed in a version of the named
+// series. Stemcells publish their package list next to their tarball, named
+// after the tarball with the list's file name in place of .tgz, such as
+// bosh-stemcell-1.40-vsphere-esxi-ubuntu-noble-go_agent.stemcell_dpkg_l.txt.
+// Lists are kept once fetched, since a version's packages never change.
+func (c *BoshIO) StemcellPackages(name, version string) ([]tarball.Package, error) {
+	key := name + "/" + version
+	c.mu.Lock()
+	packages, ok := c.packages[key]
+	c.mu.Unlock()
+	if ok {
+		return packages, nil
+	}
+
+	versions, err := c.StemcellVersions(name)
+	if err != nil {
+		return nil, err
+	}
+	var t *Tarball
+	for _, v := range versions {
+		if v.Version == version {
+			if t = v.Regular; t == nil {
+				t = v.Light
+			}
+		}
+	}
+	if t == nil {
+		return nil, &NoVersionError{Name: name, Detail: fmt.Sprintf("no version %s", version)}
+	}
+
+	for _, list := range tarball.PackageListNames() {
+		packages, found, err := c.packageList(strings.TrimSuffix(t.URL, ".tgz")+"."+list, list)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			c.mu.Lock()
+			c.packages[key] = packages
+			c.mu.Unlock()
+			return packages, nil
+		}
+	}
+	return nil, &NoVersionError{Name: name, Detail: fmt.Sprintf("no package list for version %s", version)}
+}
+
+func (c *BoshIO) packageList(u, list string) ([]tarball.Package, bool, error) {
+	r, err := c.httpClient.Get(u)
+	if err != nil {
+		return nil, false, &UpstreamError{err}
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusForbidden:
+		// Buckets answer 403 rather than 404 for objects that do not exist.
+		return nil, false, nil
+	default:
+		return nil, false, &UpstreamError{fmt.Errorf("unexpected status %s for %s", r.Status, u)}
+	}
+
+	packages, err := tarball.ParsePackageList(list, r.Body)
+	if err != nil {
+		return nil, false, &UpstreamError{fmt.Errorf("%s: %s", u, err)}
+	}
+	return packages, true, nil
+}
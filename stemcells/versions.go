@@ -0,0 +1,38 @@
+package stemcells
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CompareVersions orders dotted numeric versions, returning -1, 0 or 1. A
+// version with more components sorts after one it is a prefix of.
+func CompareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, _ := strconv.Atoi(as[i])
+		bn, _ := strconv.Atoi(bs[i])
+		if an != bn {
+			if an < bn {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+// SortDescending orders versions newest first.
+func SortDescending(versions []Version) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		return CompareVersions(versions[i].Version, versions[j].Version) > 0
+	})
+}
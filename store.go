@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// dataDir is where state such as aliases is persisted. When it is empty state
+// is only held in memory.
+var dataDir string
+
+// fileStore persists a JSON document to a file. A fileStore with an empty
+// path does nothing, which keeps state in memory only.
+type fileStore struct {
+	path string
+}
+
+func newFileStore(name string) fileStore {
+	if dataDir == "" {
+		return fileStore{}
+	}
+	return fileStore{path: filepath.Join(dataDir, name)}
+}
+
+// load decodes the file into v, leaving v untouched if the file does not
+// exist yet.
+func (s fileStore) load(v interface{}) error {
+	if s.path == "" {
+		return nil
+	}
+
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewDecoder(f).Decode(v)
+}
+
+// save replaces the file with v, writing to a temporary file first so that a
+// crash never leaves a partial document behind.
+func (s fileStore) save(v interface{}) error {
+	if s.path == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
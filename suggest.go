@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+)
+
+var unknownNameTemplate = template.Must(template.New("unknown").Parse(`<!doctype html5>
+<html>
+  <head>
+    <title>BoshStemcells.com</title>
+    <link rel="stylesheet" type="text/css" href="/bootstrap.min.css">
+  </head>
+  <body>
+    <div class="container">
+      <h1>BoshStemcells.com</h1>
+      <p>Unknown {{.Kind}} <code>{{.Name}}</code>.</p>
+      {{if .Suggestions}}<p>Did you mean {{range $i, $s := .Suggestions}}{{if $i}} or {{end}}<code>{{$s}}</code>{{end}}?</p>{{end}}
+      <p>Valid values are: {{range $i, $v := .Valid}}{{if $i}}, {{end}}<code>{{$v}}</code>{{end}}</p>
+    </div>
+  </body>
+</html>
+`))
+
+// writeUnknownName responds with a 404 that suggests what the client probably
+// meant, as plain text, HTML or problem JSON depending on the Accept header.
+func writeUnknownName(w http.ResponseWriter, r *http.Request, e *stemcells.UnknownNameError) {
+	suggestions := e.Suggestions()
+
+	switch negotiateContentType(r, "text/plain", "text/html", "application/json", "application/problem+json") {
+	case "text/html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		unknownNameTemplate.Execute(w, struct {
+			Kind        string
+			Name        string
+			Suggestions []string
+			Valid       []string
+		}{e.Kind, e.Name, suggestions, e.Candidates})
+	case "application/json", "application/problem+json":
+		writeProblem(w, r, problem{
+			Type:        problemUnknownName,
+			Status:      http.StatusNotFound,
+			Detail:      e.Error(),
+			Suggestions: suggestions,
+			Valid:       e.Candidates,
+		})
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%s\n", e.Error())
+		if len(suggestions) > 0 {
+			fmt.Fprintf(w, "Did you mean %s?\n", strings.Join(suggestions, " or "))
+		}
+		fmt.Fprintf(w, "Valid values are: %s\n", strings.Join(e.Candidates, ", "))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+)
+
+// upstreamCacheTTL is how long a series' version list is reused before
+// bosh.io is asked again.
+var upstreamCacheTTL = 5 * time.Minute
+
+// source is the upstream that versions are resolved against.
+var source stemcells.Upstream = stemcells.NewBoshIO(stemcells.DefaultBoshIOURL, upstreamCacheTTL)
+
+// resolver resolves selectors against the source, using the channel store
+// for promotion channels.
+func resolver() stemcells.Resolver {
+	return resolverFor(source)
+}
+
+// resolverFor resolves selectors against upstream, using the channel store
+// for promotion channels and upstream for the edge channel.
+func resolverFor(upstream stemcells.Upstream) stemcells.Resolver {
+	return stemcells.Resolver{
+		Upstream: upstream,
+		Channel: func(s stemcells.Series, channel string, minAge time.Duration) (string, error) {
+			return resolveChannel(upstream, s, channel, minAge)
+		},
+	}
+}
+
+// resolveVersion returns the version picked by the selector, or an empty
+// string to let bosh.io pick the latest.
+func resolveVersion(s stemcells.Series, selector stemcells.Selector) (string, error) {
+	return resolver().Resolve(s, selector)
+}
+
+// batchUpstream lets the queries of one batch share upstream lookups: each
+// series is fetched at most once for the batch, and concurrent lookups of a
+// series wait for the same fetch. A new one is made for every batch, so the
+// wrapped upstream's caching applies between batches.
+type batchUpstream struct {
+	stemcells.Upstream
+
+	mu      sync.Mutex
+	lookups map[string]*batchLookup
+}
+
+type batchLookup struct {
+	done     chan struct{}
+	versions []stemcells.Version
+	err      error
+}
+
+func newBatchUpstream(upstream stemcells.Upstream) *batchUpstream {
+	return &batchUpstream{Upstream: upstream, lookups: map[string]*batchLookup{}}
+}
+
+func (u *batchUpstream) StemcellVersions(name string) ([]stemcells.Version, error) {
+	u.mu.Lock()
+	l, ok := u.lookups[name]
+	if !ok {
+		l = &batchLookup{done: make(chan struct{})}
+		u.lookups[name] = l
+	}
+	u.mu.Unlock()
+
+	if ok {
+		<-l.done
+		return l.versions, l.err
+	}
+
+	l.versions, l.err = u.Upstream.StemcellVersions(name)
+	close(l.done)
+	return l.versions, l.err
+}
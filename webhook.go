@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.benchapman.ie/boshstemcells/stemcells"
+	"github.com/gorilla/mux"
+)
+
+const problemInvalidWebhook = "https://boshstemcells.com/problems/invalid-webhook"
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// maxDeliveries is the number of deliveries kept in each webhook's history.
+const maxDeliveries = 50
+
+var (
+	// webhooks holds the subscriptions notified of new stemcell versions.
+	webhooks *webhookStore
+
+	// webhookAttempts is how many times a delivery is tried before it is
+	// marked as failed.
+	webhookAttempts = 5
+
+	// webhookBackoff is the wait before the first retry of a delivery. It
+	// doubles after every further attempt.
+	webhookBackoff = 30 * time.Second
+
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// webhook subscribes a URL to new versions of the stemcells matching its
+// filters, which use the same names accepted in stemcell paths. Empty filters
+// match everything; a constraint such as "97.x" limits the versions.
+type webhook struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`
+	IaaS       string    `json:"iaas,omitempty"`
+	Line       string    `json:"line,omitempty"`
+	Constraint string    `json:"constraint,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// validate checks that the webhook's URL and filters make sense.
+func (h webhook) validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not a valid http or https URL", h.URL)
+	}
+
+	if h.IaaS != "" {
+		if _, _, err := lookupIaaS(h.IaaS); err != nil {
+			return err
+		}
+	}
+	if h.Line != "" {
+		if _, _, ok := stemcells.LookupLine(h.Line); !ok {
+			return &stemcells.UnknownNameError{Kind: "stemcell line", Name: h.Line, Candidates: stemcells.LineNames()}
+		}
+	}
+	if h.Constraint != "" && !stemcells.ValidConstraint(h.Constraint) {
+		return fmt.Errorf("%q is not a valid constraint; expected a constraint such as 97.x", h.Constraint)
+	}
+	return nil
+}
+
+// matches reports whether the webhook wants to hear about a version of a
+// stemcell series.
+func (h webhook) matches(s stemcells.Series, version string) bool {
+	if h.IaaS != "" {
+		infrastructure, hypervisor, err := lookupIaaS(h.IaaS)
+		if err != nil || infrastructure != s.Infrastructure || hypervisor != s.Hypervisor {
+			return false
+		}
+	}
+	if h.Line != "" {
+		line, raw, ok := stemcells.LookupLine(h.Line)
+		if !ok || line != s.Line || raw != s.Raw {
+			return false
+		}
+	}
+	if h.Constraint != "" {
+		return strings.HasPrefix(version, strings.TrimSuffix(h.Constraint, "x"))
+	}
+	return true
+}
+
+// delivery records the attempts to notify a webhook of a version.
+type delivery struct {
+	ID        string            `json:"id"`
+	Webhook   string            `json:"webhook"`
+	Stemcell  string            `json:"stemcell"`
+	Version   string            `json:"version"`
+	Status    string            `json:"status"`
+	CreatedAt time.Time         `json:"created_at"`
+	Attempts  []deliveryAttempt `json:"attempts"`
+}
+
+type deliveryAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// webhookPayload is the body POSTed to a webhook.
+type webhookPayload struct {
+	Event    string               `json:"event"`
+	Delivery string               `json:"delivery"`
+	Webhook  string               `json:"webhook"`
+	Stemcell stemcells.Resolution `json:"stemcell"`
+}
+
+type webhookState struct {
+	Webhooks   map[string]webhook    `json:"webhooks"`
+	Deliveries map[string][]delivery `json:"deliveries"`
+}
+
+type webhookStore struct {
+	mu    sync.Mutex
+	file  fileStore
+	state webhookState
+}
+
+func newWebhookStore(file fileStore) (*webhookStore, error) {
+	s := &webhookStore{file: file}
+	if err := file.load(&s.state); err != nil {
+		return nil, err
+	}
+	if s.state.Webhooks == nil {
+		s.state.Webhooks = map[string]webhook{}
+	}
+	if s.state.Deliveries == nil {
+		s.state.Deliveries = map[string][]delivery{}
+	}
+	return s, nil
+}
+
+func (s *webhookStore) get(id string) (webhook, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.state.Webhooks[id]
+	return h, ok
+}
+
+func (s *webhookStore) list() []webhook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]webhook, 0, len(s.state.Webhooks))
+	for _, h := range s.state.Webhooks {
+		list = append(list, h)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// add stores a new webhook, giving it an ID and, unless it has one, a secret.
+func (s *webhookStore) add(h webhook) (webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h.ID = randomHex(8)
+	if h.Secret == "" {
+		h.Secret = randomHex(32)
+	}
+	h.CreatedAt = time.Now().UTC()
+
+	s.state.Webhooks[h.ID] = h
+	if err := s.file.save(s.state); err != nil {
+		delete(s.state.Webhooks, h.ID)
+		return webhook{}, err
+	}
+	return h, nil
+}
+
+func (s *webhookStore) remove(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.state.Webhooks[id]
+	if !ok {
+		return false, nil
+	}
+
+	delete(s.state.Webhooks, id)
+	deliveries := s.state.Deliveries[id]
+	delete(s.state.Deliveries, id)
+	if err := s.file.save(s.state); err != nil {
+		s.state.Webhooks[id] = h
+		s.state.Deliveries[id] = deliveries
+		return false, err
+	}
+	return true, nil
+}
+
+// deliveries returns a webhook's delivery history, newest first.
+func (s *webhookStore) deliveries(id string) []delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := s.state.Deliveries[id]
+	list := make([]delivery, len(history))
+	for i, d := range history {
+		list[len(history)-1-i] = d
+	}
+	return list
+}
+
+// record adds or updates a delivery in its webhook's history, dropping the
+// oldest deliveries beyond maxDeliveries.
+func (s *webhookStore) record(d delivery) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.state.Webhooks[d.Webhook]; !ok {
+		return
+	}
+
+	history := s.state.Deliveries[d.Webhook]
+	found := false
+	for i := range history {
+		if history[i].ID == d.ID {
+			history[i] = d
+			found = true
+		}
+	}
+	if !found {
+		history = append(history, d)
+	}
+	if len(history) > maxDeliveries {
+		history = history[len(history)-maxDeliveries:]
+	}
+	s.state.Deliveries[d.Webhook] = history
+
+	if err := s.file.save(s.state); err != nil {
+		log.Printf("saving webhook deliveries: %s", err)
+	}
+}
+
+// notify delivers a newly discovered version to every matching webhook. It is
+// called by the poller.
+func (s *webhookStore) notify(st stemcells.Series, v stemcells.Version) {
+	for _, h := range s.list() {
+		if !h.matches(st, v.Version) {
+			continue
+		}
+
+		d := delivery{
+			ID:        randomHex(8),
+			Webhook:   h.ID,
+			Stemcell:  st.Name(),
+			Version:   v.Version,
+			Status:    deliveryPending,
+			CreatedAt: time.Now().UTC(),
+			Attempts:  []deliveryAttempt{},
+		}
+		s.record(d)
+		go s.deliver(h, st, d)
+	}
+}
+
+// resume carries on with the deliveries that were still pending when the
+// service stopped. The history is saved after every attempt, so they pick up
+// where they left off.
+func (s *webhookStore) resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, history := range s.state.Deliveries {
+		h, ok := s.state.Webhooks[id]
+		if !ok {
+			continue
+		}
+		for _, d := range history {
+			if d.Status != deliveryPending {
+				continue
+			}
+			st, err := stemcells.ParseName(d.Stemcell)
+			if err != nil {
+				log.Printf("resuming delivery %s: %s", d.ID, err)
+				continue
+			}
+			go s.deliver(h, st, d)
+		}
+	}
+}
+
+// deliver POSTs the delivery's version to the webhook, retrying with
+// exponential backoff until it is accepted or webhookAttempts have failed.
+func (s *webhookStore) deliver(h webhook, st stemcells.Series, d delivery) {
+	res, err := resolver().Describe(st, d.Version, time.Now())
+	if err != nil {
+		res = stemcells.Resolution{Name: st.Name(), IaaS: st.Infrastructure, Hypervisor: st.Hypervisor, Line: st.Line, Version: d.Version, URL: stemcells.BoshIOURL(st.Name(), d.Version)}
+	}
+	body, err := json.Marshal(webhookPayload{Event: "stemcell.published", Delivery: d.ID, Webhook: h.ID, Stemcell: res})
+	if err != nil {
+		log.Printf("encoding webhook payload: %s", err)
+		return
+	}
+
+	for {
+		result := postWebhook(h, d.ID, body)
+		d.Attempts = append(d.Attempts, result)
+		if result.Error == "" && result.StatusCode >= 200 && result.StatusCode < 300 {
+			d.Status = deliveryDelivered
+			s.record(d)
+			return
+		}
+		if len(d.Attempts) >= webhookAttempts {
+			d.Status = deliveryFailed
+			s.record(d)
+			return
+		}
+		s.record(d)
+
+		time.Sleep(webhookBackoff << uint(len(d.Attempts)-1))
+	}
+}
+
+// postWebhook makes one delivery attempt. The body is signed with the
+// webhook's secret in the X-BoshStemcells-Signature header.
+func postWebhook(h webhook, deliveryID string, body []byte) deliveryAttempt {
+	attempt := deliveryAttempt{At: time.Now().UTC()}
+
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "boshstemcells-webhook")
+	req.Header.Set("X-BoshStemcells-Event", "stemcell.published")
+	req.Header.Set("X-BoshStemcells-Delivery", deliveryID)
+	req.Header.Set("X-BoshStemcells-Signature", "sha256="+signWebhook(h.Secret, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	resp.Body.Close()
+
+	attempt.StatusCode = resp.StatusCode
+	return attempt
+}
+
+// signWebhook returns the hex encoded HMAC-SHA256 of body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// withoutSecret hides a webhook's secret, which is only shown when it is
+// created.
+func withoutSecret(h webhook) webhook {
+	h.Secret = ""
+	return h
+}
+
+func handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	list := []webhook{}
+	for _, h := range webhooks.list() {
+		list = append(list, withoutSecret(h))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func handleGetWebhook(w http.ResponseWriter, r *http.Request) {
+	h, ok := webhooks.get(mux.Vars(r)["id"])
+	if !ok {
+		writeUnknownWebhook(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, withoutSecret(h))
+}
+
+func handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var h webhook
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		writeProblem(w, r, problem{Type: problemInvalidWebhook, Status: http.StatusBadRequest, Detail: err.Error()})
+		return
+	}
+
+	if err := h.validate(); err != nil {
+		writeProblem(w, r, problem{Type: problemInvalidWebhook, Status: http.StatusUnprocessableEntity, Detail: err.Error()})
+		return
+	}
+
+	h, err := webhooks.add(h)
+	if err != nil {
+		writeProblem(w, r, problem{Type: "about:blank", Status: http.StatusInternalServerError, Detail: err.Error()})
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/webhooks/"+h.ID)
+	writeJSON(w, http.StatusCreated, h)
+}
+
+func handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	removed, err := webhooks.remove(mux.Vars(r)["id"])
+	if err != nil {
+		writeProblem(w, r, problem{Type: "about:blank", Status: http.StatusInternalServerError, Detail: err.Error()})
+		return
+	}
+	if !removed {
+		writeUnknownWebhook(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, ok := webhooks.get(id); !ok {
+		writeUnknownWebhook(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, webhooks.deliveries(id))
+}
+
+func writeUnknownWebhook(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, problem{Type: problemUnknownName, Status: http.StatusNotFound, Detail: fmt.Sprintf("unknown webhook %q", mux.Vars(r)["id"])})
+}